@@ -1,9 +0,0 @@
-module github.com/maxmcd/bramble/cmd/url_fetcher
-
-go 1.16
-
-require (
-	github.com/certifi/gocertifi v0.0.0-20210507211836-431795d63e8d
-	github.com/mholt/archiver/v3 v3.5.0
-	github.com/pkg/errors v0.9.1
-)
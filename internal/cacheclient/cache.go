@@ -10,17 +10,39 @@ import (
 	"os"
 	"strings"
 
+	"github.com/maxmcd/bramble/internal/offline"
 	"github.com/maxmcd/bramble/internal/store"
 	"github.com/maxmcd/bramble/pkg/chunkedarchive"
 	"github.com/maxmcd/bramble/pkg/httpx"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 )
 
+// TokenEnvVar is the environment variable that holds the token that is sent to
+// cache servers when uploading
+const TokenEnvVar = "BRAMBLE_CACHE_TOKEN"
+
 type Client struct {
 	host   string
 	client *http.Client
 }
 
+var _ store.Cache = new(Client)
+
+// Open returns the cache at a location. Http and https urls are bramble cache
+// servers, any other location is opened as cache storage, so a directory,
+// "file://" url or "s3://" url can be used as a cache without a server. Cache
+// servers are sent the token in BRAMBLE_CACHE_TOKEN.
+func Open(location string) (store.Cache, error) {
+	if strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://") {
+		return New(location).WithToken(os.Getenv(TokenEnvVar)), nil
+	}
+	storage, err := store.OpenCacheStorage(location)
+	if err != nil {
+		return nil, err
+	}
+	return store.NewStorageCache(storage), nil
+}
+
 func New(host string) *Client {
 	return &Client{
 		host: host,
@@ -30,11 +52,21 @@ func New(host string) *Client {
 	}
 }
 
+// WithToken sends the token to the cache server with uploads, servers require
+// it for them. The token is only sent over https or to a loopback address.
+func (cc *Client) WithToken(token string) *Client {
+	cc.client.Transport = httpx.TokenTransport(token, cc.client.Transport)
+	return cc
+}
+
 func (cc *Client) request(ctx context.Context, method, path, contentType string, body io.Reader, resp interface{}) (err error) {
 	url := fmt.Sprintf("%s/%s",
 		strings.TrimSuffix(cc.host, "/"),
 		strings.TrimPrefix(path, "/"),
 	)
+	if err := offline.Check("can't reach cache %s", cc.host); err != nil {
+		return err
+	}
 	return httpx.Request(ctx, cc.client, method, url, contentType, body, resp)
 }
 
@@ -75,7 +107,7 @@ func (cc *Client) GetDerivation(ctx context.Context, filename string) (drv store
 		"/derivation/"+filename,
 		"",
 		nil,
-		drv)
+		&drv)
 	if err == os.ErrNotExist {
 		return drv, false, nil
 	}
@@ -0,0 +1,99 @@
+package cacheclient
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/maxmcd/bramble/internal/config"
+	"github.com/maxmcd/bramble/internal/store"
+	"github.com/maxmcd/bramble/pkg/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpen(t *testing.T) {
+	ctx := context.Background()
+	available := true
+	fileServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if !available {
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = rw.Write([]byte("bramble"))
+	}))
+	defer fileServer.Close()
+	drv := store.Derivation{
+		Name:        "test",
+		Builder:     "basic_fetch_url",
+		OutputNames: []string{"out"},
+		Env:         map[string]string{"url": fileServer.URL + "/hi.txt"},
+	}
+
+	cacheServer := httptest.NewServer(store.NewCacheServer(store.NewFileCacheStorage(t.TempDir()), store.CacheServerOptions{Token: "token"}))
+	defer cacheServer.Close()
+
+	test.SetEnv(t, TokenEnvVar, "token")
+	dir := t.TempDir()
+	for _, location := range []string{
+		cacheServer.URL,
+		dir,
+		"file://" + t.TempDir(),
+	} {
+		t.Run(location, func(t *testing.T) {
+			available = true
+			cache, err := Open(location)
+			require.NoError(t, err)
+
+			buildStore, err := store.NewStore(test.TmpDir(t))
+			require.NoError(t, err)
+			built, _, err := buildStore.NewBuilder(&config.LockFile{}).
+				BuildDerivation(ctx, drv, store.BuildDerivationOptions{})
+			require.NoError(t, err)
+			require.NoError(t, buildStore.UploadDerivationsToCache(ctx, []store.Derivation{built}, cache))
+
+			available = false
+			clientStore, err := store.NewStore(test.TmpDir(t))
+			require.NoError(t, err)
+			clientStore.AddCacheSubstituter(cache)
+			substituted, didBuild, err := clientStore.NewBuilder(&config.LockFile{}).
+				BuildDerivation(ctx, drv, store.BuildDerivationOptions{})
+			require.NoError(t, err)
+			require.False(t, didBuild)
+			require.Equal(t, built.Outputs, substituted.Outputs)
+		})
+	}
+	_, err := Open("ftp://nope")
+	require.Error(t, err)
+}
+
+func TestClient_WithToken(t *testing.T) {
+	ctx := context.Background()
+	headers := map[string]string{}
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		headers[r.Method] = r.Header.Get("Authorization")
+		if r.Method == http.MethodGet {
+			_, _ = rw.Write([]byte(`{}`))
+			return
+		}
+		_, _ = rw.Write([]byte(`""`))
+	}))
+	defer server.Close()
+
+	// The token is only sent with uploads
+	client := New(server.URL).WithToken("token")
+	_, err := client.PostChunk(ctx, strings.NewReader("chunk"))
+	require.NoError(t, err)
+	_, _, err = client.GetDerivation(ctx, "drv")
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		http.MethodPost: "Bearer token",
+		http.MethodGet:  "",
+	}, headers)
+
+	// And never over http to another host
+	_, err = New("http://example.com").WithToken("token").PostChunk(ctx, strings.NewReader("chunk"))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "refusing to send the token")
+}
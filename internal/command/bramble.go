@@ -1,11 +1,17 @@
 package command
 
 import (
+	"context"
+	"os"
 	"path/filepath"
+	"strings"
 
+	"github.com/maxmcd/bramble/internal/cacheclient"
+	"github.com/maxmcd/bramble/internal/config"
 	"github.com/maxmcd/bramble/internal/dependency"
 	"github.com/maxmcd/bramble/internal/project"
 	"github.com/maxmcd/bramble/internal/store"
+	"github.com/pkg/errors"
 )
 
 type bramble struct {
@@ -14,18 +20,105 @@ type bramble struct {
 }
 
 func newBramble(wd string, bramblePath string) (b bramble, err error) {
-	if b.store, err = store.NewStore(bramblePath); err != nil {
-		return
+	p, err := project.NewProject(wd)
+	if err != nil {
+		return b, err
+	}
+	return newBrambleForProject(p, bramblePath)
+}
+
+// newBrambleAnywhere returns a bramble for the project in wd. Outside of a
+// project the packages of the module arguments are added to an ephemeral
+// project in a temporary directory, so that published modules can be built
+// from any directory. The arguments are returned without their versions and
+// cleanup removes the ephemeral project.
+func newBrambleAnywhere(ctx context.Context, wd string, modules []string) (b bramble, args []string, cleanup func(), err error) {
+	cleanup = func() {}
+	b, err = newBramble(wd, "")
+	if err != project.ErrNotInProject {
+		return b, modules, cleanup, err
+	}
+	dir, err := os.MkdirTemp("", "bramble-ephemeral-")
+	if err != nil {
+		return b, nil, cleanup, err
 	}
-	if b.project, err = project.NewProject(wd); err != nil {
+	cleanup = func() { _ = os.RemoveAll(dir) }
+	p, err := project.NewEphemeralProject(wd, dir)
+	if err != nil {
+		return b, nil, cleanup, err
+	}
+	if b, err = newBrambleForProject(p, ""); err != nil {
+		return b, nil, cleanup, err
+	}
+	args, err = b.project.RequireModules(ctx, modules)
+	return b, args, cleanup, err
+}
+
+func newBrambleForProject(p *project.Project, bramblePath string) (b bramble, err error) {
+	if b.store, err = store.NewStore(bramblePath); err != nil {
 		return
 	}
+	b.project = p
 
+	registries, err := config.Registries(b.project.Config().Registries)
+	if err != nil {
+		return b, err
+	}
 	b.project.AddModuleFetcher(
 		dependency.NewManager(
 			filepath.Join(b.store.BramblePath, "var/dependencies"),
-			"https://bramble-server.fly.dev",
+			registries,
 		),
 	)
+	// Outputs are only substituted from caches that the user trusts, a
+	// cache can serve any output for a derivation
+	caches, err := configuredCaches()
+	if err != nil {
+		return b, err
+	}
+	for _, cache := range caches {
+		b.store.AddCacheSubstituter(cache)
+	}
+	// Registries serve the build cache of the packages they publish, it's
+	// only used if the registry is configured with cache = true
+	for _, registry := range registries {
+		if registry.Cache {
+			b.store.AddCacheSubstituter(cacheclient.New(strings.TrimSuffix(registry.URL, "/") + "/cache"))
+		}
+	}
 	return b, nil
 }
+
+// publishRegistry returns the url of the first registry that serves the
+// package, the registries of the project in wd are used if there is one.
+func publishRegistry(wd, pkg string) (url string, err error) {
+	var projectRegistries []config.Registry
+	p, err := project.NewProject(wd)
+	if err == nil {
+		projectRegistries = p.Config().Registries
+	} else if err != project.ErrNotInProject {
+		return "", err
+	}
+	registries, err := config.Registries(projectRegistries)
+	if err != nil {
+		return "", err
+	}
+	if registries = config.RegistriesFor(registries, pkg); len(registries) == 0 {
+		return "", errors.Errorf("no registry is configured for package %q", pkg)
+	}
+	return registries[0].URL, nil
+}
+
+// configuredCaches opens the caches listed in the BRAMBLE_CACHE environment
+// variable. Caches are separated by spaces and can be cache server urls,
+// directories, "file://" or "s3://" urls.
+func configuredCaches() (caches []store.Cache, err error) {
+	for _, location := range strings.Fields(os.Getenv("BRAMBLE_CACHE")) {
+		cache, err := cacheclient.Open(location)
+		if err != nil {
+			return nil, err
+		}
+		caches = append(caches, cache)
+	}
+	return caches, nil
+}
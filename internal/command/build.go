@@ -3,6 +3,8 @@ package command
 import (
 	"context"
 	"fmt"
+	"io"
+	"os"
 	"path/filepath"
 	"strings"
 	"sync"
@@ -65,7 +67,14 @@ type runBuildOptions struct {
 	verbose      bool
 	includeTests bool
 	quiet        bool
-	callback     func(dep project.Dependency, drv project.Derivation, buildDrv store.Derivation)
+	// verify builds the output derivations again and checks them against the
+	// lockfile without adding them to the store, dependencies are built as
+	// usual. No lockfile entries are added.
+	verify bool
+	// output receives build progress and derivation build output, defaults
+	// to stdout
+	output   io.Writer
+	callback func(dep project.Dependency, drv project.Derivation, buildDrv store.Derivation)
 }
 
 func (b bramble) runBuild(ctx context.Context, output project.ExecModuleOutput, ops runBuildOptions) (outputDerivations []store.Derivation, err error) {
@@ -80,7 +89,15 @@ func (b bramble) runBuild(ctx context.Context, output project.ExecModuleOutput,
 	if len(output.Output) != 1 && ops.shell {
 		return nil, errors.New("Can't open a shell if the function doesn't return a single derivation")
 	}
-	builder := b.store.NewBuilder(b.project.LockfileWriter())
+	lockfileWriter := b.project.LockfileWriter()
+	if ops.verify {
+		lockfileWriter = readOnlyLockfile{lockfileWriter}
+	}
+	builder := b.store.NewBuilder(lockfileWriter)
+	var progress io.Writer = os.Stdout
+	if ops.output != nil {
+		progress = ops.output
+	}
 	derivationIDUpdates := map[project.Dependency]store.DerivationOutput{}
 	var derivationDataLock sync.Mutex
 
@@ -122,6 +139,7 @@ func (b bramble) runBuild(ctx context.Context, output project.ExecModuleOutput,
 			Dependencies: dependencies,
 			Name:         drv.Name,
 			Network:      drv.Network,
+			OutputHash:   drv.OutputHash,
 			Outputs:      drv.Outputs,
 			Platform:     drv.Platform,
 			Source:       source,
@@ -143,10 +161,14 @@ func (b bramble) runBuild(ctx context.Context, output project.ExecModuleOutput,
 			}
 		}
 
+		_, isOutput := output.Output[dep.Hash]
 		if buildDrv, didBuild, err = builder.BuildDerivation(ctx, buildDrv, store.BuildDerivationOptions{
+			Verify:     ops.verify && isOutput,
 			Shell:      runShell,
 			Verbose:    ops.verbose,
 			ForceBuild: runShell,
+			Output:     ops.output,
+			Progress:   progress,
 		}); err != nil {
 			return nil, nil, err
 		}
@@ -154,6 +176,7 @@ func (b bramble) runBuild(ctx context.Context, output project.ExecModuleOutput,
 		if ops.check {
 			secondBuildDrv, _, err := builder.BuildDerivation(ctx, buildDrv, store.BuildDerivationOptions{
 				ForceBuild: true,
+				Output:     ops.output,
 			})
 			if err != nil {
 				return nil, nil, err
@@ -181,7 +204,7 @@ func (b bramble) runBuild(ctx context.Context, output project.ExecModuleOutput,
 		}
 		// Don't print if we're quiet, unless we built something
 		if !ops.quiet || didBuild {
-			fmt.Printf("✔ %s - %s\n", buildDrv.Name, ts)
+			fmt.Fprintf(progress, "✔ %s - %s\n", buildDrv.Name, ts)
 		}
 		derivationDataLock.Lock()
 		// allDerivations = append(allDerivations, buildDrv)
@@ -216,6 +239,11 @@ func (b bramble) runBuild(ctx context.Context, output project.ExecModuleOutput,
 	if err := b.project.WriteLockfile(); err != nil {
 		return nil, err
 	}
+	// Ephemeral projects are removed after the build so they aren't
+	// registered with the store
+	if b.project.Ephemeral() {
+		return outputDerivations, nil
+	}
 	if err = b.store.WriteConfigLink(b.project.Location()); err != nil {
 		return nil, err
 	}
@@ -230,7 +258,8 @@ func (b bramble) fullBuild(ctx context.Context, args []string, opts types.BuildO
 	}
 	var lock sync.Mutex
 	_, err = b.runBuild(ctx, br.Output, runBuildOptions{
-		check: opts.Check,
+		check:  opts.Check,
+		output: opts.Output,
 		callback: func(dep project.Dependency, drv project.Derivation, buildDrv store.Derivation) {
 			lock.Lock()
 			br.FinalHashMapping[dep.Hash] = buildDrv
@@ -258,7 +287,10 @@ func (br buildResponse) moduleFunctionMapping() (mapping map[string]map[string][
 	return mapping
 }
 
-func newBuilder(store *store.Store) func(location string) (types.Builder, error) {
+// newBuilder returns a types.NewBuilder that builds projects in the passed
+// store. If cache is not nil every derivation that is built is also uploaded to
+// the cache.
+func newBuilder(store *store.Store, cache store.CacheClient) func(location string) (types.Builder, error) {
 	return func(location string) (types.Builder, error) {
 		modules := make(map[string]config.Config)
 		paths, err := project.FindAllProjects(location)
@@ -274,13 +306,14 @@ func newBuilder(store *store.Store) func(location string) (types.Builder, error)
 			}
 			modules[path] = cfg
 		}
-		return builder{modules: modules, store: store}, nil
+		return builder{modules: modules, store: store, cache: cache}, nil
 	}
 }
 
 type builder struct {
 	modules map[string]config.Config
 	store   *store.Store
+	cache   store.CacheClient
 }
 
 var _ types.Builder = builder{}
@@ -296,8 +329,15 @@ func (b builder) Build(ctx context.Context, location string, args []string, opts
 	}
 	resp.Packages = br.moduleFunctionMapping()
 	resp.FinalHashMapping = map[string]string{}
+	drvs := []store.Derivation{}
 	for hash, drv := range br.FinalHashMapping {
 		resp.FinalHashMapping[hash] = drv.Filename()
+		drvs = append(drvs, drv)
+	}
+	if b.cache != nil {
+		if err := b.store.UploadDerivationsToCache(ctx, drvs, b.cache); err != nil {
+			return types.BuildResponse{}, errors.Wrap(err, "error uploading build outputs to the cache")
+		}
 	}
 	return resp, err
 }
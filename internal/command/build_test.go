@@ -0,0 +1,192 @@
+package command
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/maxmcd/bramble/internal/store"
+	"github.com/maxmcd/bramble/pkg/test"
+	"github.com/stretchr/testify/require"
+)
+
+// stdProject creates a project with a copy of lib/std so that derivations can
+// be built through the std helpers without the network
+func stdProject(t *testing.T, bramble string) (dir string) {
+	t.Helper()
+	dir = t.TempDir()
+	// A fixed suffix keeps the store path padding away from an exact multiple
+	// of the padding characters
+	test.SetEnv(t, "BRAMBLE_PATH", filepath.Join(test.TmpDir(t), "bramble"))
+	std, err := os.ReadFile("../../lib/std/default.bramble")
+	require.NoError(t, err)
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "lib/std"), 0755))
+	test.WriteFile(t, filepath.Join(dir, "lib/std/default.bramble"), string(std))
+	test.WriteFile(t, filepath.Join(dir, "bramble.toml"),
+		"[package]\nname = \"github.com/maxmcd/bramble\"\nversion = \"0.0.1\"\n")
+	test.WriteFile(t, filepath.Join(dir, "default.bramble"),
+		"load(\"github.com/maxmcd/bramble/lib/std\")\n\n"+bramble)
+	return dir
+}
+
+func TestStdFetchURL_sha256(t *testing.T) {
+	content := []byte("hello std")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(content)
+	}))
+	defer server.Close()
+
+	for _, tt := range []struct {
+		name   string
+		sha256 string
+		err    bool
+	}{
+		{"matching sha256", fmt.Sprintf("%x", sha256.Sum256(content)), false},
+		{"wrong sha256", fmt.Sprintf("%x", sha256.Sum256([]byte("nope"))), true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := stdProject(t, fmt.Sprintf(
+				"def file():\n    return std.fetch_url(%q, sha256=%q, unpack=False)\n",
+				server.URL+"/file.txt", tt.sha256))
+			err := cliApp(dir).Run([]string{"bramble", "build", "./:file"})
+			if !tt.err {
+				require.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			require.Contains(t, err.Error(), "sha256")
+		})
+	}
+}
+
+func TestStdFetchURL_archive(t *testing.T) {
+	tarball := bytes.NewBuffer(nil)
+	{
+		gw := gzip.NewWriter(tarball)
+		tw := tar.NewWriter(gw)
+		_ = tw.WriteHeader(&tar.Header{Name: "dir-1.2/", Typeflag: tar.TypeDir, Mode: 0755})
+		_ = tw.WriteHeader(&tar.Header{Name: "dir-1.2/foo.txt", Typeflag: tar.TypeReg, Size: 7, Mode: 0644})
+		_, _ = tw.Write([]byte("bramble"))
+		_ = tw.Close()
+		_ = gw.Close()
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(tarball.Bytes())
+	}))
+	defer server.Close()
+
+	for _, tt := range []struct {
+		name string
+		args string
+		file string
+	}{
+		{"unpack", "", "dir-1.2/foo.txt"},
+		{"strip_prefix", ", strip_prefix=\"dir-1.2\"", "foo.txt"},
+		{"unpack false", ", unpack=False", "archive"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			// The url has no extension, the format is detected from the content
+			dir := stdProject(t, fmt.Sprintf(
+				"def archive():\n    return std.fetch_url(%q%s)\n", server.URL+"/archive", tt.args))
+			require.NoError(t, cliApp(dir).Run([]string{"bramble", "build", "./:archive"}))
+
+			s, err := store.NewStore(os.Getenv("BRAMBLE_PATH"))
+			require.NoError(t, err)
+			matches, err := filepath.Glob(filepath.Join(s.StorePath, "*", tt.file))
+			require.NoError(t, err)
+			require.Len(t, matches, 1)
+		})
+	}
+}
+
+func TestStdFetchURL_sameURL(t *testing.T) {
+	tarball := bytes.NewBuffer(nil)
+	{
+		gw := gzip.NewWriter(tarball)
+		tw := tar.NewWriter(gw)
+		for _, name := range []string{"a/", "b/"} {
+			_ = tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeDir, Mode: 0755})
+			_ = tw.WriteHeader(&tar.Header{Name: name + "file.txt", Typeflag: tar.TypeReg, Size: 1, Mode: 0644})
+			_, _ = tw.Write([]byte(name[:1]))
+		}
+		_ = tw.Close()
+		_ = gw.Close()
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(tarball.Bytes())
+	}))
+	defer server.Close()
+
+	// Each prefix of the same url has its own lockfile entry and download
+	// cache entry, so neither is checked against the other's output
+	url := server.URL + "/archive"
+	dir := stdProject(t, fmt.Sprintf("def a():\n    return std.fetch_url(%q, strip_prefix=\"a\")\n\n"+
+		"def b():\n    return std.fetch_url(%q, strip_prefix=\"b\")\n", url, url))
+	for i := 0; i < 2; i++ {
+		require.NoError(t, cliApp(dir).Run([]string{"bramble", "build", "./:a", "./:b"}))
+	}
+
+	lockfile, err := os.ReadFile(filepath.Join(dir, "bramble.lock"))
+	require.NoError(t, err)
+	require.Contains(t, string(lockfile), "fetch_url "+url+" strip_prefix=a")
+	require.Contains(t, string(lockfile), "fetch_url "+url+" strip_prefix=b")
+}
+
+func TestStdFetchURL_resume(t *testing.T) {
+	body := bytes.Repeat([]byte("bramble"), 1000)
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			// Drop the connection halfway through the first download
+			w.Header().Set("Content-Length", fmt.Sprint(len(body)))
+			_, _ = w.Write(body[:len(body)/2])
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(body))
+	}))
+	defer server.Close()
+
+	dir := stdProject(t, fmt.Sprintf(
+		"def file():\n    return std.fetch_url(%q, sha256=%q)\n",
+		server.URL+"/file.txt", fmt.Sprintf("%x", sha256.Sum256(body))))
+	require.NoError(t, cliApp(dir).Run([]string{"bramble", "build", "./:file"}))
+	require.Equal(t, 2, requests)
+}
+
+func TestStdFetchURL_downloadCache(t *testing.T) {
+	content := []byte("hello cache")
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		_, _ = w.Write(content)
+	}))
+	defer server.Close()
+	url, hash := server.URL+"/file.txt", fmt.Sprintf("%x", sha256.Sum256(content))
+
+	first := stdProject(t, fmt.Sprintf("def file():\n    return std.fetch_url(%q, sha256=%q)\n", url, hash))
+	bramblePath := os.Getenv("BRAMBLE_PATH")
+	require.NoError(t, cliApp(first).Run([]string{"bramble", "build", "./:file"}))
+	require.Equal(t, 1, requests)
+
+	// A different derivation in another project that fetches the same url and
+	// hash is built from the download cache
+	second := stdProject(t, fmt.Sprintf(
+		"def file():\n    return std.fetch_url(%q, sha256=%q, unpack=False)\n", url, hash))
+	test.SetEnv(t, "BRAMBLE_PATH", bramblePath)
+	require.NoError(t, cliApp(second).Run([]string{"bramble", "build", "./:file"}))
+	require.Equal(t, 1, requests)
+
+	entries, err := os.ReadDir(filepath.Join(bramblePath, "var/downloads"))
+	require.NoError(t, err)
+	require.NotEmpty(t, entries)
+}
@@ -14,12 +14,16 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/maxmcd/bramble/internal/cacheclient"
+	"github.com/maxmcd/bramble/internal/config"
 	"github.com/maxmcd/bramble/internal/dependency"
 	"github.com/maxmcd/bramble/internal/logger"
+	"github.com/maxmcd/bramble/internal/offline"
 	"github.com/maxmcd/bramble/internal/project"
 	"github.com/maxmcd/bramble/internal/store"
 	"github.com/maxmcd/bramble/internal/tracing"
 	"github.com/maxmcd/bramble/internal/types"
+	"github.com/maxmcd/bramble/pkg/metrics"
 	"github.com/maxmcd/bramble/pkg/sandbox"
 	"github.com/maxmcd/bramble/pkg/starutil"
 	"github.com/mitchellh/go-wordwrap"
@@ -67,6 +71,19 @@ func cliApp(wd string) *cli.App {
 		Version:               "0.1.0",
 		HideHelpCommand:       true,
 		CustomAppHelpTemplate: appHelpTemplate,
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:    "offline",
+				EnvVars: []string{"BRAMBLE_OFFLINE"},
+				Usage:   "never access the network, only use the store, downloaded dependencies and the lockfile",
+			},
+		},
+		Before: func(c *cli.Context) error {
+			if c.Bool("offline") {
+				offline.Enable()
+			}
+			return nil
+		},
 		Commands: []*cli.Command{
 			{
 				Name:  "build",
@@ -92,6 +109,12 @@ calling all of their public functions. Any derivations that are returned by
 these functions are built along with all of their dependencies. Call to build
 without a path will run all builds from the current directory and its
 subdirectories.
+
+Outside of a project published modules can be built from any directory. A
+version can be given with "@", otherwise the newest version is used. Nothing is
+written to the current directory.
+
+bramble build github.com/maxmcd/busybox@0.0.1:busybox
 `,
 				Flags: []cli.Flag{
 					&cli.BoolFlag{
@@ -124,11 +147,12 @@ subdirectories.
 						return cli.ShowCommandHelp(c, "build")
 					}
 
-					b, err := newBramble(wd, "")
+					b, args, cleanup, err := newBrambleAnywhere(ctx, wd, c.Args().Slice())
+					defer cleanup()
 					if err != nil {
 						return err
 					}
-					output, err := b.execModule(ctx, c.Args().Slice(), execModuleOptions{
+					output, err := b.execModule(ctx, args, execModuleOptions{
 						target: c.String("target"),
 					})
 					if err != nil {
@@ -145,9 +169,12 @@ subdirectories.
 				},
 			},
 			{
-				Name:      "run",
-				Usage:     "Run an executable in a derivation output",
-				UsageText: "bramble run [options] [module]:<function> [args...]",
+				Name:  "run",
+				Usage: "Run an executable in a derivation output",
+				UsageText: `bramble run [options] [module]:<function> [args...]
+
+Outside of a project a published module can be run from any directory, with an
+optional version: bramble run github.com/maxmcd/busybox@0.0.1:busybox ls`,
 				Flags: []cli.Flag{
 					&cli.StringSliceFlag{
 						Name:  "paths",
@@ -172,7 +199,11 @@ subdirectories.
 					},
 				},
 				Action: func(c *cli.Context) error {
-					b, err := newBramble(wd, "")
+					if c.Args().Len() == 0 {
+						return cli.ShowCommandHelp(c, "run")
+					}
+					b, module, cleanup, err := newBrambleAnywhere(c.Context, wd, c.Args().Slice()[:1])
+					defer cleanup()
 					if err != nil {
 						return err
 					}
@@ -201,7 +232,7 @@ subdirectories.
 						}
 					}
 
-					return b.run(c.Context, c.Args().Slice(), runOptions{
+					return b.run(c.Context, append(module, c.Args().Tail()...), runOptions{
 						paths:         paths,
 						readOnlyPaths: readOnlyPaths,
 						hiddenPaths:   hiddenPaths,
@@ -222,14 +253,125 @@ subdirectories.
 				},
 			},
 			{
-				Name:      "magic",
-				UsageText: "bramble magic",
-				Action: func(c *cli.Context) error {
-					b, err := newBramble(wd, "")
-					if err != nil {
-						return err
-					}
-					return b.project.CalculateDependencies()
+				Name:      "mod",
+				Usage:     "Manage the dependencies of a project",
+				UsageText: "bramble mod <command> [args]",
+				Subcommands: []*cli.Command{
+					{
+						Name:  "tidy",
+						Usage: "Add missing and remove unused dependencies",
+						UsageText: `bramble mod tidy
+
+Tidy scans the project's bramble files for load() statements. Packages that are
+loaded but aren't dependencies are added at their newest version, dependencies
+that are never loaded are removed, and bramble.toml is rewritten with the new
+build list.
+`,
+						Action: func(c *cli.Context) error {
+							b, err := newBramble(wd, "")
+							if err != nil {
+								return err
+							}
+							return b.project.Tidy(c.Context)
+						},
+					},
+					{
+						Name:  "vendor",
+						Usage: "Copy dependencies into the project",
+						UsageText: `bramble mod vendor
+
+Vendor copies the source of every dependency into the bramble_vendor directory
+of the project. Vendored dependencies are used instead of fetching them, so a
+project with its dependencies vendored can be built without registry access.
+`,
+						Action: func(c *cli.Context) error {
+							b, err := newBramble(wd, "")
+							if err != nil {
+								return err
+							}
+							return b.project.Vendor(c.Context)
+						},
+					},
+					{
+						Name:  "graph",
+						Usage: "Print the module requirement graph",
+						UsageText: `bramble mod graph
+
+Graph prints every requirement in the project's module graph, one per line as
+"module@version requirement@version". Requirements of versions that weren't
+selected for the build list are included.
+`,
+						Action: func(c *cli.Context) error {
+							b, err := newBramble(wd, "")
+							if err != nil {
+								return err
+							}
+							return b.project.PrintRequirementGraph(os.Stdout)
+						},
+					},
+					{
+						Name:  "why",
+						Usage: "Explain why a dependency is in the build list",
+						UsageText: `bramble mod why <module>
+
+Why prints the shortest chain of requirements from the project to the version
+of a dependency that was selected for the build list.
+`,
+						Action: func(c *cli.Context) error {
+							if c.Args().Len() != 1 {
+								return errors.New("bramble mod why takes one argument: \"module\"")
+							}
+							b, err := newBramble(wd, "")
+							if err != nil {
+								return err
+							}
+							return b.project.PrintRequirementChain(os.Stdout, c.Args().First())
+						},
+					},
+				},
+			},
+			{
+				Name:      "lock",
+				Usage:     "Check and clean up the bramble.lock file",
+				UsageText: "bramble lock <command> [args]",
+				Subcommands: []*cli.Command{
+					{
+						Name:  "verify",
+						Usage: "Fetch every locked url again and report hashes that changed",
+						UsageText: `bramble lock verify
+
+Verify runs the project's modules, without building them, to find the
+derivations that have entries in bramble.lock. Each of these derivations is
+then built again, after its dependencies, and its hash is compared with the
+hash in the lockfile. Every entry that no longer matches is reported and
+verify exits with an error.
+`,
+						Action: func(c *cli.Context) error {
+							b, err := newBramble(wd, "")
+							if err != nil {
+								return err
+							}
+							return b.verifyLockfile(c.Context, os.Stdout)
+						},
+					},
+					{
+						Name:  "prune",
+						Usage: "Remove lockfile entries that aren't used",
+						UsageText: `bramble lock prune
+
+Prune runs the project's modules, without building them, and removes every
+url from bramble.lock that isn't fetched by one of the project's derivations.
+The source hashes of dependencies that aren't in the build list are removed
+as well.
+`,
+						Action: func(c *cli.Context) error {
+							b, err := newBramble(wd, "")
+							if err != nil {
+								return err
+							}
+							return b.pruneLockfile(c.Context, os.Stdout)
+						},
+					},
 				},
 			},
 			{
@@ -330,17 +472,113 @@ their public functions with documentation. If an immediate subdirectory has a
 				},
 			},
 			{
-				Name:      "publish",
-				UsageText: `bramble publish module [reference]`,
+				Name:  "push",
+				Usage: "Build derivations and upload them to a cache",
+				UsageText: `
+bramble push [options] [modules]
+
+Push builds derivations like "bramble build" and then uploads every derivation
+and output that was built to a cache. The cache can be the url of a bramble
+server or a directory, so a cache can be shared on a network mount without
+running a server:
+
+bramble push --cache file:///mnt/cache ./...
+BRAMBLE_CACHE=file:///mnt/cache bramble build ./...
+
+Builds only substitute outputs from the caches in BRAMBLE_CACHE. Pushes to a
+server send the token in BRAMBLE_CACHE_TOKEN.
+`,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "cache",
+						Value: "",
+						Usage: "the cache to push to, a server url, a directory or a \"file://\" or \"s3://\" url. Defaults to the first cache in BRAMBLE_CACHE",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					if c.Args().Len() == 0 {
+						return cli.ShowCommandHelp(c, "push")
+					}
+					location := c.String("cache")
+					if location == "" {
+						if caches := strings.Fields(os.Getenv("BRAMBLE_CACHE")); len(caches) > 0 {
+							location = caches[0]
+						}
+					}
+					if location == "" {
+						return errors.New("bramble push requires a cache, pass --cache or set BRAMBLE_CACHE")
+					}
+					cache, err := cacheclient.Open(location)
+					if err != nil {
+						return err
+					}
+					b, err := newBramble(wd, "")
+					if err != nil {
+						return err
+					}
+					br, err := b.fullBuild(c.Context, c.Args().Slice(), types.BuildOptions{})
+					if err != nil {
+						return err
+					}
+					drvs := []store.Derivation{}
+					for _, drv := range br.FinalHashMapping {
+						drvs = append(drvs, drv)
+					}
+					return b.store.UploadDerivationsToCache(c.Context, drvs, cache)
+				},
+			},
+			{
+				Name: "publish",
+				UsageText: `bramble publish [options] module [reference]
+
+Publish asks a server to download, build and publish a module. Modules can be
+github packages like "github.com/maxmcd/bramble" or https, http or ssh git
+urls on any host. The package name of a git url is its host and path, like
+"example.com/org/repo" for "https://example.com/org/repo.git". With --local
+the sources in a directory are uploaded to the server instead:
+
+bramble publish --local .
+
+Uploads, and "file://" repositories on servers that allow them, are named by
+their bramble.toml. The server only accepts them with the token in
+BRAMBLE_PUBLISH_TOKEN.
+
+Packages are published to the first registry that serves them unless --url is
+passed.
+`,
 				Flags: []cli.Flag{
 					&cli.StringFlag{
 						Name:  "url",
 						Value: "",
 						Usage: "The url (schema+host) of the module cache server. Eg: \"https://cache.bramble.bramble\"",
 					},
+					&cli.BoolFlag{
+						Name:  "local",
+						Usage: "upload and publish the project in a local directory",
+					},
 				},
 				Action: func(c *cli.Context) error {
 					args := c.Args().Slice()
+					registryURL := func(pkg string) (string, error) {
+						if u := c.String("url"); u != "" {
+							return u, nil
+						}
+						return publishRegistry(wd, pkg)
+					}
+					if c.Bool("local") {
+						if len(args) != 1 {
+							return errors.New("bramble publish --local takes one argument: \"directory\"")
+						}
+						cfg, err := config.ReadConfig(filepath.Join(args[0], "bramble.toml"))
+						if err != nil {
+							return err
+						}
+						url, err := registryURL(cfg.Package.Name)
+						if err != nil {
+							return err
+						}
+						return dependency.PublishLocal(c.Context, url, args[0], os.Stdout)
+					}
 					if len(args) == 0 {
 						return errors.New("bramble publish takes at least one argument: \"module\"")
 					}
@@ -353,11 +591,11 @@ their public functions with documentation. If an immediate subdirectory has a
 					if len(args) == 2 {
 						reference = args[1]
 					}
-					url := "http://localhost:2726"
-					if u := c.String("url"); u != "" {
-						url = u
+					url, err := registryURL(module)
+					if err != nil {
+						return err
 					}
-					return dependency.PostJob(url, module, reference)
+					return dependency.PostJob(c.Context, url, module, reference, os.Stdout)
 				},
 			},
 			{
@@ -379,12 +617,53 @@ their public functions with documentation. If an immediate subdirectory has a
 					return b.project.AddDependency(types.Package{Version: parts[1], Name: parts[0]})
 				},
 			},
+			{
+				Name:    "update",
+				Aliases: []string{"upgrade"},
+				Usage:   "Upgrade dependencies to their newest compatible versions",
+				UsageText: `bramble update [module...]
+
+Update upgrades dependencies to the newest published versions that have the same
+major version and rewrites bramble.toml with the new build list. If modules are
+passed only those dependencies, and the dependencies they require, are upgraded.
+`,
+				Action: func(c *cli.Context) error {
+					b, err := newBramble(wd, "")
+					if err != nil {
+						return err
+					}
+					return b.project.UpdateDependencies(c.Args().Slice()...)
+				},
+			},
+			{
+				Name:  "downgrade",
+				Usage: "Downgrade a dependency to an older version",
+				UsageText: `bramble downgrade module@version
+
+Downgrade moves a dependency to an older version with the same major version.
+Dependencies that require a newer version of it are downgraded too, or removed
+if none of their versions are compatible.
+`,
+				Action: func(c *cli.Context) error {
+					parts := strings.Split(c.Args().First(), "@")
+					if c.Args().Len() != 1 || len(parts) != 2 {
+						return errors.New("bramble downgrade takes one argument: \"module@version\"")
+					}
+					b, err := newBramble(wd, "")
+					if err != nil {
+						return err
+					}
+					return b.project.DowngradeDependency(types.Package{Name: parts[0], Version: parts[1]})
+				},
+			},
 			{
 				Name: "server",
 				UsageText: `bramble server
 
 server starts a server instance. The server can act as a build cache and a
-module cache.
+module cache. Prometheus metrics are served at /metrics. The build cache is
+served at /cache, uploads and the usage report at /cache/admin/usage require
+the --cache-token. Publishing uploaded sources requires the --publish-token.
 `,
 				Flags: []cli.Flag{
 					&cli.StringFlag{
@@ -397,24 +676,88 @@ module cache.
 						Value: "localhost",
 						Usage: "the host that the server will listen on",
 					},
+					&cli.StringFlag{
+						Name:  "cache-storage",
+						Value: "",
+						Usage: "where the build cache is stored, a directory or a url like \"s3://bucket/prefix?endpoint=https://minio.local\". Defaults to the bramble store",
+					},
+					&cli.StringFlag{
+						Name:    "cache-token",
+						EnvVars: []string{cacheclient.TokenEnvVar},
+						Usage:   "the token that clients must send to upload to the build cache, uploads are disabled without one",
+					},
+					&cli.StringFlag{
+						Name:    "publish-token",
+						EnvVars: []string{dependency.PublishTokenEnvVar},
+						Usage:   "the token that clients must send to publish uploaded sources or local git repositories, both are disabled without one",
+					},
+					&cli.BoolFlag{
+						Name:  "allow-local-git",
+						Usage: "allow publishing \"file://\" git repositories from the server's disk",
+					},
+					&cli.Int64Flag{
+						Name:  "cache-max-size",
+						Usage: "remove the least recently used outputs when the build cache is larger than this many bytes",
+					},
+					&cli.DurationFlag{
+						Name:  "cache-max-age",
+						Usage: "remove outputs that haven't been used for this long, eg: \"720h\"",
+					},
+					&cli.DurationFlag{
+						Name:  "cache-gc-interval",
+						Value: time.Hour,
+						Usage: "how often to remove objects from the build cache when a max size or age is set",
+					},
 				},
 				Action: func(c *cli.Context) error {
 					listenOn := fmt.Sprintf("%s:%s", c.String("host"), c.String("port"))
 					fmt.Printf("Server listening on: %s\n", listenOn)
 
-					// TODO: add build cache handler to this server
-					store, err := store.NewStore("")
+					s, err := store.NewStore("")
 					if err != nil {
 						return err
 					}
 
+					cacheStorage := s.CacheStorage()
+					if location := c.String("cache-storage"); location != "" {
+						if cacheStorage, err = store.OpenCacheStorage(location); err != nil {
+							return err
+						}
+					}
+
+					retention := store.CacheRetention{
+						MaxSize:     c.Int64("cache-max-size"),
+						MaxAge:      c.Duration("cache-max-age"),
+						GracePeriod: time.Hour,
+					}
+					if retention.MaxSize > 0 || retention.MaxAge > 0 {
+						go collectCacheGarbage(c.Context, cacheStorage, retention, c.Duration("cache-gc-interval"))
+					}
+					go reportCacheUsage(c.Context, cacheStorage, time.Minute)
+
+					// Packages that are published are uploaded to the cache so
+					// that clients can download their outputs.
+					dependencyHandler, err := dependency.ServerHandler(
+						filepath.Join(s.BramblePath, "var/dependencies"),
+						newBuilder(s, store.NewStorageCache(cacheStorage)),
+						dependency.DownloadGitRepo,
+						dependency.ServerOptions{
+							PublishToken:  c.String("publish-token"),
+							AllowLocalGit: c.Bool("allow-local-git"),
+						},
+					)
+					if err != nil {
+						return err
+					}
+					mux := http.NewServeMux()
+					mux.Handle("/cache/", http.StripPrefix("/cache", store.NewCacheServer(cacheStorage, store.CacheServerOptions{
+						Token: c.String("cache-token"),
+					})))
+					mux.Handle("/metrics", metrics.Handler())
+					mux.Handle("/", dependencyHandler)
 					srv := &http.Server{
-						Addr: listenOn,
-						Handler: dependency.ServerHandler(
-							filepath.Join(store.BramblePath, "var/dependencies"),
-							newBuilder(store),
-							dependency.DownloadGithubRepo,
-						),
+						Addr:    listenOn,
+						Handler: mux,
 					}
 					errChan := make(chan error)
 					go func() {
@@ -436,7 +779,10 @@ module cache.
 		},
 	}
 
-	for _, c := range app.Commands {
+	commands := append([]*cli.Command{}, app.Commands...)
+	for i := 0; i < len(commands); i++ {
+		c := commands[i]
+		commands = append(commands, c.Subcommands...)
 		c.CustomHelpTemplate = commandHelpTemplate
 
 		// Wrap the options help to 80 width. Requires knowledge of the longest
@@ -457,12 +803,54 @@ module cache.
 				c.Usage = formatFlag(c.Usage, longest)
 			case *cli.StringSliceFlag:
 				c.Usage = formatFlag(c.Usage, longest)
+			case *cli.Int64Flag:
+				c.Usage = formatFlag(c.Usage, longest)
+			case *cli.DurationFlag:
+				c.Usage = formatFlag(c.Usage, longest)
 			}
 		}
 	}
 	return app
 }
 
+// collectCacheGarbage removes objects from the cache storage on an interval
+// until the context is cancelled.
+func collectCacheGarbage(ctx context.Context, storage store.CacheStorage, retention store.CacheRetention, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		removed, err := store.CollectCacheGarbage(ctx, storage, retention)
+		if err != nil {
+			logger.Print("error collecting cache garbage: ", err)
+		} else if removed.Size > 0 {
+			logger.Printfln("removed %d derivations, %d outputs and %d chunks (%d bytes) from the cache",
+				removed.Derivations.Count, removed.Outputs.Count, removed.Chunks.Count, removed.Size)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// reportCacheUsage updates the cache size metrics on an interval until the
+// context is cancelled.
+func reportCacheUsage(ctx context.Context, storage store.CacheStorage, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := store.ReportCacheUsage(ctx, storage); err != nil {
+			logger.Print("error reporting cache usage: ", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
 // RunCLI runs the cli with os.Args
 func RunCLI() {
 	go func() {
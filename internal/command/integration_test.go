@@ -16,6 +16,7 @@ import (
 	"github.com/maxmcd/bramble/internal/dependency"
 	"github.com/maxmcd/bramble/internal/store"
 	"github.com/maxmcd/bramble/internal/tracing"
+	"github.com/maxmcd/bramble/pkg/fileutil"
 	"github.com/maxmcd/bramble/pkg/fxt"
 	"github.com/maxmcd/bramble/pkg/sandbox"
 	"github.com/maxmcd/bramble/pkg/test"
@@ -139,6 +140,7 @@ func TestDep_handler(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	errChan := make(chan error)
 	test.SetEnv(t, "BRAMBLE_PATH", t.TempDir())
+	test.SetEnv(t, "BRAMBLE_REGISTRY", "http://localhost:2726")
 	go func() {
 		if err := app.RunContext(ctx, []string{"bramble", "server"}); err != nil {
 			errChan <- err
@@ -188,13 +190,19 @@ func TestDep(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	server := httptest.NewServer(dependency.ServerHandler(
+	handler, err := dependency.ServerHandler(
 		filepath.Join(store.BramblePath, "var/dependencies"),
-		newBuilder(store),
+		newBuilder(store, store.LocalCache()),
 		func(url, reference string) (location string, err error) {
-			return filepath.Join(projectDir, url), nil
+			location = t.TempDir()
+			return location, fileutil.CopyDirectory(filepath.Join(projectDir, url), location)
 		},
-	))
+		dependency.ServerOptions{},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(handler)
 
 	type testRun struct {
 		name        string
@@ -283,7 +291,7 @@ func TestStore_CacheServer(t *testing.T) {
 		serverBramblePath := t.TempDir()
 		s, err := store.NewStore(serverBramblePath)
 		require.NoError(t, err)
-		server := httptest.NewServer(s.CacheServer())
+		server := httptest.NewServer(s.CacheServer(store.CacheServerOptions{Token: "token"}))
 		_ = server
 		files, _ := filepath.Glob(clientBramblePath + "/store/*.drv")
 		var drvs []store.Derivation
@@ -298,7 +306,7 @@ func TestStore_CacheServer(t *testing.T) {
 			}
 			drvs = append(drvs, drv)
 		}
-		cc := cacheclient.New(server.URL)
+		cc := cacheclient.New(server.URL).WithToken("token")
 		if err := clientStore.UploadDerivationsToCache(ctx, drvs, cc); err != nil {
 			t.Fatal(err)
 		}
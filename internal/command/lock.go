@@ -0,0 +1,127 @@
+package command
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/maxmcd/bramble/internal/project"
+	"github.com/maxmcd/bramble/internal/store"
+	"github.com/maxmcd/bramble/internal/types"
+	"github.com/pkg/errors"
+)
+
+// lockfileDerivations runs every module in the project, including tests, and
+// returns the hashes of the derivations that have lockfile entries keyed by
+// their lockfile key. Nothing is built, the keys are found in the derivation
+// graph.
+func (b bramble) lockfileDerivations(ctx context.Context) (output project.ExecModuleOutput, hashes map[string]string, err error) {
+	output, err = b.execModule(ctx, []string{b.project.Location() + "/..."}, execModuleOptions{
+		includeTests: true,
+	})
+	if err != nil {
+		return output, nil, err
+	}
+	hashes = map[string]string{}
+	for hash, drv := range output.AllDerivations {
+		if key, found := store.LockfileKey(store.Derivation{
+			Name:       drv.Name,
+			Builder:    drv.Builder,
+			Env:        drv.Env,
+			Network:    drv.Network,
+			OutputHash: drv.OutputHash,
+		}); found {
+			hashes[key] = hash
+		}
+	}
+	return output, hashes, nil
+}
+
+func sortedLockfileKeys(hashes map[string]string) (keys []string) {
+	for key := range hashes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// readOnlyLockfile checks hashes against the lockfile without adding entries
+type readOnlyLockfile struct {
+	types.LockfileWriter
+}
+
+func (readOnlyLockfile) AddEntry(k, v string) error { return nil }
+
+// verifyLockfile fetches every url in the lockfile again and confirms that the
+// content still matches the locked hash. Only the derivations with lockfile
+// entries and their dependencies are built, fetches are only hashed so neither
+// the store nor the lockfile are changed. Every entry is checked and every
+// mismatch is reported.
+func (b bramble) verifyLockfile(ctx context.Context, w io.Writer) (err error) {
+	output, hashes, err := b.lockfileDerivations(ctx)
+	if err != nil {
+		return err
+	}
+	builder := b.store.NewBuilder(readOnlyLockfile{b.project.LockfileWriter()})
+	var drifted int
+	for _, key := range sortedLockfileKeys(b.project.URLHashes()) {
+		if hash, found := hashes[key]; found {
+			err = b.verifyLockfileDerivation(ctx, output, hash)
+		} else if drv, found := store.LockfileKeyDerivation(key); found {
+			// Urls fetched by the builtin builder can be checked without a
+			// derivation that references them
+			_, _, err = builder.BuildDerivation(ctx, drv, store.BuildDerivationOptions{
+				Verify: true,
+				Output: io.Discard,
+			})
+		} else {
+			fmt.Fprintf(w, "? %s - not used by any derivation, run \"bramble lock prune\" to remove it\n", key)
+			continue
+		}
+		if err != nil {
+			drifted++
+			fmt.Fprintf(w, "✘ %s - %s\n", key, err)
+			continue
+		}
+		fmt.Fprintf(w, "✔ %s\n", key)
+	}
+	if drifted > 0 {
+		return errors.Errorf("%d lockfile entries don't match their locked hash", drifted)
+	}
+	return nil
+}
+
+// verifyLockfileDerivation builds the derivation with the hash and its
+// dependencies and checks the derivation against the lockfile
+func (b bramble) verifyLockfileDerivation(ctx context.Context, output project.ExecModuleOutput, hash string) (err error) {
+	_, err = b.runBuild(ctx, project.ExecModuleOutput{
+		Output:         map[string]project.Derivation{hash: output.AllDerivations[hash]},
+		AllDerivations: output.AllDerivations,
+	}, runBuildOptions{
+		quiet:  true,
+		verify: true,
+		output: io.Discard,
+	})
+	return err
+}
+
+// pruneLockfile removes lockfile entries that aren't used by any derivation in
+// the project, and the source hashes of dependencies that aren't in the build
+// list.
+func (b bramble) pruneLockfile(ctx context.Context, w io.Writer) (err error) {
+	_, hashes, err := b.lockfileDerivations(ctx)
+	if err != nil {
+		return err
+	}
+	for _, key := range sortedLockfileKeys(b.project.URLHashes()) {
+		if _, found := hashes[key]; !found {
+			b.project.RemoveURLHash(key)
+			fmt.Fprintf(w, "removed %s\n", key)
+		}
+	}
+	for _, entry := range b.project.PruneDependencyHashes() {
+		fmt.Fprintf(w, "removed %s\n", entry)
+	}
+	return b.project.WriteLockfile()
+}
@@ -0,0 +1,78 @@
+package command
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/maxmcd/bramble/pkg/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLockVerifyAndPrune(t *testing.T) {
+	var lock sync.Mutex
+	content := map[string]string{"/a.txt": "a", "/b.txt": "b"}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		_, _ = w.Write([]byte(content[r.URL.Path]))
+	}))
+	defer server.Close()
+
+	fetches := fmt.Sprintf("def a():\n    return std.fetch_url(%q, unpack=False)\n\n"+
+		"def b():\n    return std.fetch_url(%q, unpack=False)\n\n", server.URL+"/a.txt", server.URL+"/b.txt")
+	// verify and prune don't build the project, so a derivation that can't be
+	// built doesn't stop them
+	dir := stdProject(t, fetches+"def broken():\n    return derivation(\"broken\", \"/missing\")\n")
+	require.NoError(t, cliApp(dir).Run([]string{"bramble", "build", "./:a", "./:b"}))
+
+	verify := func() (string, error) {
+		b, err := newBramble(dir, "")
+		require.NoError(t, err)
+		var out bytes.Buffer
+		err = b.verifyLockfile(context.Background(), &out)
+		return out.String(), err
+	}
+	out, err := verify()
+	require.NoError(t, err)
+	require.Equal(t, 2, strings.Count(out, "✔"))
+
+	// Every entry that drifted is reported
+	lock.Lock()
+	content["/a.txt"], content["/b.txt"] = "changed", "changed"
+	lock.Unlock()
+	out, err = verify()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "2 lockfile entries")
+	require.Equal(t, 2, strings.Count(out, "✘"))
+
+	// Entries of derivations and dependencies that aren't in the project are
+	// pruned
+	lockfile := filepath.Join(dir, "bramble.lock")
+	f, err := os.OpenFile(lockfile, os.O_APPEND|os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	_, err = f.WriteString("\n[PackageHashes]\n  \"x.y/z@1.0.0\" = \"hash\"\n" +
+		"\n[GitDependencies]\n  [GitDependencies.\"x.y/git\"]\n    Git = \"https://x.y/git\"\n")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	test.WriteFile(t, filepath.Join(dir, "default.bramble"), "load(\"github.com/maxmcd/bramble/lib/std\")\n\n"+
+		fmt.Sprintf("def a():\n    return std.fetch_url(%q, unpack=False)\n", server.URL+"/a.txt"))
+
+	b, err := newBramble(dir, "")
+	require.NoError(t, err)
+	var pruned bytes.Buffer
+	require.NoError(t, b.pruneLockfile(context.Background(), &pruned))
+	require.Equal(t, fmt.Sprintf("removed fetch_url %s/b.txt unpack=false\nremoved x.y/git (git)\nremoved x.y/z@1.0.0\n", server.URL), pruned.String())
+	locked, err := os.ReadFile(lockfile)
+	require.NoError(t, err)
+	require.Contains(t, string(locked), server.URL+"/a.txt")
+	require.NotContains(t, string(locked), server.URL+"/b.txt")
+	require.NotContains(t, string(locked), "x.y")
+}
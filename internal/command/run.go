@@ -5,6 +5,7 @@ import (
 	"errors"
 	"os"
 
+	"github.com/maxmcd/bramble/internal/offline"
 	project "github.com/maxmcd/bramble/internal/project"
 	"github.com/maxmcd/bramble/internal/store"
 )
@@ -73,6 +74,9 @@ func (b bramble) run(ctx context.Context, args []string, ro runOptions) (err err
 			args = append([]string{run.Cmd}, run.Args...)
 		}
 	}
+	if len(ro.paths) == 0 && b.project.Ephemeral() {
+		ro.paths = []string{b.project.WD()}
+	}
 	if len(ro.paths) == 0 {
 		ro.paths = []string{b.project.Location()}
 	}
@@ -80,6 +84,11 @@ func (b bramble) run(ctx context.Context, args []string, ro runOptions) (err err
 	if len(args) == 0 {
 		return errors.New("can't run a derivation without any arguments")
 	}
+	if ro.network {
+		if err := offline.Check("can't run %s with network access", args[0]); err != nil {
+			return err
+		}
+	}
 	return b.store.RunDerivation(ctx, outputDerivations[0], store.RunDerivationOptions{
 		Stdin: os.Stdin,
 		Args:  args,
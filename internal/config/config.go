@@ -5,7 +5,6 @@ import (
 	"io"
 	"os"
 	"path/filepath"
-	"reflect"
 	"sort"
 	"strings"
 	"sync"
@@ -23,12 +22,32 @@ import (
 type Config struct {
 	Package      Package `toml:"package"`
 	Dependencies map[string]Dependency
+	Registries   []Registry `toml:"registries"`
+	Workspace    Workspace  `toml:"workspace"`
+}
+
+// Workspace lists the projects that are built together with this one. Members
+// are directories relative to the project that contain a bramble.toml, loads
+// of a member's modules use its local source instead of a published version.
+type Workspace struct {
+	Members []string `toml:"members"`
 }
 
 func (cfg Config) Render(w io.Writer) {
 	fmt.Fprintln(w, "[package]")
 	fxt.Fprintfln(w, "name = %q", cfg.Package.Name)
 	fxt.Fprintfln(w, "version = %q", cfg.Package.Version)
+	if len(cfg.Package.ReadOnlyPaths) > 0 {
+		fxt.Fprintfln(w, "read_only_paths = %s", quotedList(cfg.Package.ReadOnlyPaths))
+	}
+	if len(cfg.Package.HiddenPaths) > 0 {
+		fxt.Fprintfln(w, "hidden_paths = %s", quotedList(cfg.Package.HiddenPaths))
+	}
+	if len(cfg.Workspace.Members) > 0 {
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "[workspace]")
+		fxt.Fprintfln(w, "members = %s", quotedList(cfg.Workspace.Members))
+	}
 	fmt.Fprintln(w)
 	fmt.Fprintln(w, "[dependencies]")
 	var keys []string
@@ -38,12 +57,34 @@ func (cfg Config) Render(w io.Writer) {
 	sort.Strings(keys)
 	for _, key := range keys {
 		dep := cfg.Dependencies[key]
-		if dep.Path == "" {
+		switch {
+		case dep.Git != "":
+			fxt.Fprintfln(w, "%q = {git=%q, rev=%q}", key, dep.Git, dep.Rev)
+		case dep.Path == "":
 			fxt.Fprintfln(w, "%q = %q", key, dep.Version)
-		} else {
+		default:
 			fxt.Fprintfln(w, "%q = {version=%q, path=%q}", key, dep.Version, dep.Path)
 		}
 	}
+	for _, registry := range cfg.Registries {
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "[[registries]]")
+		fxt.Fprintfln(w, "url = %q", registry.URL)
+		if len(registry.Prefixes) > 0 {
+			fxt.Fprintfln(w, "prefixes = %s", quotedList(registry.Prefixes))
+		}
+		if registry.Cache {
+			fmt.Fprintln(w, "cache = true")
+		}
+	}
+}
+
+func quotedList(values []string) string {
+	var quoted []string
+	for _, v := range values {
+		quoted = append(quoted, fmt.Sprintf("%q", v))
+	}
+	return "[" + strings.Join(quoted, ", ") + "]"
 }
 
 // LoadValueToDependency takes the string from a `load()` statement and returns
@@ -56,7 +97,7 @@ func (cfg Config) LoadValueToDependency(val string) string {
 	}
 
 	for dep := range cfg.Dependencies {
-		if strings.HasPrefix(val, dep) && len(dep) > len(longest) {
+		if (val == dep || strings.HasPrefix(val, dep+"/")) && len(dep) > len(longest) {
 			longest = dep
 		}
 	}
@@ -65,7 +106,17 @@ func (cfg Config) LoadValueToDependency(val string) string {
 
 type Dependency struct {
 	Version string
-	Path    string
+
+	// Path is a directory, relative to the project, that the dependency's
+	// source is loaded from instead of the registry. The bramble.toml in the
+	// directory provides the dependency's own requirements.
+	Path string
+
+	// Git is the url of a repository that the dependency is fetched from
+	// instead of the registry, it's checked out at Rev. Git dependencies are
+	// pinned to a commit in the lockfile and aren't part of version selection.
+	Git string
+	Rev string
 }
 
 func (c *Dependency) UnmarshalTOML(data interface{}) error {
@@ -79,6 +130,12 @@ func (c *Dependency) UnmarshalTOML(data interface{}) error {
 		if s, ok := v["path"].(string); ok {
 			c.Path = s
 		}
+		if s, ok := v["git"].(string); ok {
+			c.Git = s
+		}
+		if s, ok := v["rev"].(string); ok {
+			c.Rev = s
+		}
 	default:
 		return errors.New("unexpected data type")
 	}
@@ -184,31 +241,92 @@ func WriteLockfile(lockFile *LockFile, dir string) (err error) {
 	defer func() { _ = f.Close() }()
 
 	lf := LockFile{
-		URLHashes: map[string]string{},
+		URLHashes:       map[string]string{},
+		PackageHashes:   map[string]string{},
+		GitDependencies: map[string]GitLock{},
 	}
 	if _, err := toml.DecodeReader(f, &lf); err != nil {
 		return err
 	}
-	if reflect.DeepEqual(lockFile.URLHashes, lf.URLHashes) {
-		return nil
-	}
 
-	_ = f.Truncate(0)
-	_, _ = f.Seek(0, 0)
+	changed := false
+	for url := range lockFile.removed {
+		if _, ok := lf.URLHashes[url]; ok {
+			delete(lf.URLHashes, url)
+			changed = true
+		}
+	}
+	for pkg := range lockFile.removedPackages {
+		if _, ok := lf.PackageHashes[pkg]; ok {
+			delete(lf.PackageHashes, pkg)
+			changed = true
+		}
+	}
+	for name := range lockFile.removedGitDependencies {
+		if _, ok := lf.GitDependencies[name]; ok {
+			delete(lf.GitDependencies, name)
+			changed = true
+		}
+	}
 	for url, hash := range lockFile.URLHashes {
-		if v, ok := lf.URLHashes[url]; ok && v != hash {
+		v, ok := lf.URLHashes[url]
+		if ok && v != hash {
 			return errors.Errorf("found existing hash for %q with value %q not %q, not sure how to proceed", url, v, hash)
 		}
-		lf.URLHashes[url] = hash
+		if !ok {
+			lf.URLHashes[url] = hash
+			changed = true
+		}
+	}
+	for pkg, hash := range lockFile.PackageHashes {
+		v, ok := lf.PackageHashes[pkg]
+		if ok && v != hash {
+			return errors.Errorf("found existing hash for package %s with value %q not %q, not sure how to proceed", pkg, v, hash)
+		}
+		if !ok {
+			lf.PackageHashes[pkg] = hash
+			changed = true
+		}
+	}
+	for name, gl := range lockFile.GitDependencies {
+		if v, ok := lf.GitDependencies[name]; !ok || v != gl {
+			lf.GitDependencies[name] = gl
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
 	}
 
+	_ = f.Truncate(0)
+	_, _ = f.Seek(0, 0)
 	return toml.NewEncoder(f).Encode(&lf)
 }
 
 type LockFile struct {
 	URLHashes map[string]string
-	changed   bool
-	lock      sync.RWMutex
+	// PackageHashes are the content hashes of the source of each registry
+	// dependency, keyed by "name@version"
+	PackageHashes   map[string]string  `toml:",omitempty"`
+	GitDependencies map[string]GitLock `toml:",omitempty"`
+	changed         bool
+	// removed are the URLHashes entries that are removed from the lockfile on
+	// disk when it's written
+	removed map[string]struct{}
+	// removedPackages and removedGitDependencies are the PackageHashes and
+	// GitDependencies entries that are removed when it's written
+	removedPackages        map[string]struct{}
+	removedGitDependencies map[string]struct{}
+	lock                   sync.RWMutex
+}
+
+// GitLock is the commit and source content hash that a git dependency's
+// repository and revision resolved to.
+type GitLock struct {
+	Git    string
+	Rev    string
+	Commit string
+	Hash   string
 }
 
 var _ types.LockfileWriter = new(LockFile)
@@ -227,14 +345,105 @@ func (l *LockFile) AddEntry(k, v string) error {
 			l.URLHashes = map[string]string{}
 		}
 		l.URLHashes[k] = v
+		delete(l.removed, k)
 		l.changed = true
 	}
 	return nil
 }
 
+// RemoveEntry removes a url hash from the lockfile
+func (l *LockFile) RemoveEntry(k string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	delete(l.URLHashes, k)
+	if l.removed == nil {
+		l.removed = map[string]struct{}{}
+	}
+	l.removed[k] = struct{}{}
+	l.changed = true
+}
+
 func (l *LockFile) LookupEntry(k string) (v string, found bool) {
 	l.lock.RLock()
 	defer l.lock.RUnlock()
 	v, found = l.URLHashes[k]
 	return v, found
 }
+
+// AddPackageHash records the content hash of a package's source. An error is
+// returned if the package already has a different hash.
+func (l *LockFile) AddPackageHash(pkg, hash string) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	oldHash, found := l.PackageHashes[pkg]
+	if found && oldHash != hash {
+		return errors.Errorf(
+			"Existing lockfile entry found for package %s, old hash %q does not equal new hash %q",
+			pkg, oldHash, hash)
+	}
+	if !found {
+		if l.PackageHashes == nil {
+			l.PackageHashes = map[string]string{}
+		}
+		l.PackageHashes[pkg] = hash
+		delete(l.removedPackages, pkg)
+		l.changed = true
+	}
+	return nil
+}
+
+// LookupPackageHash returns the recorded content hash of a package's source.
+func (l *LockFile) LookupPackageHash(pkg string) (hash string, found bool) {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	hash, found = l.PackageHashes[pkg]
+	return hash, found
+}
+
+// RemovePackageHash removes the content hash of a package's source
+func (l *LockFile) RemovePackageHash(pkg string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	delete(l.PackageHashes, pkg)
+	if l.removedPackages == nil {
+		l.removedPackages = map[string]struct{}{}
+	}
+	l.removedPackages[pkg] = struct{}{}
+	l.changed = true
+}
+
+// LookupGitDependency returns the locked commit and hash of a git dependency.
+func (l *LockFile) LookupGitDependency(name string) (gl GitLock, found bool) {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	gl, found = l.GitDependencies[name]
+	return gl, found
+}
+
+// SetGitDependency records the commit and hash that a git dependency resolved
+// to, replacing any existing entry.
+func (l *LockFile) SetGitDependency(name string, gl GitLock) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.GitDependencies[name] == gl {
+		return
+	}
+	if l.GitDependencies == nil {
+		l.GitDependencies = map[string]GitLock{}
+	}
+	l.GitDependencies[name] = gl
+	delete(l.removedGitDependencies, name)
+	l.changed = true
+}
+
+// RemoveGitDependency removes the locked commit and hash of a git dependency
+func (l *LockFile) RemoveGitDependency(name string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	delete(l.GitDependencies, name)
+	if l.removedGitDependencies == nil {
+		l.removedGitDependencies = map[string]struct{}{}
+	}
+	l.removedGitDependencies[name] = struct{}{}
+	l.changed = true
+}
@@ -1,6 +1,9 @@
 package config
 
 import (
+	"bytes"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -56,3 +59,100 @@ func TestConfig_LoadValueToDependency(t *testing.T) {
 		})
 	}
 }
+
+func TestConfig_GitDependency(t *testing.T) {
+	cfg, err := ParseConfig(bytes.NewBufferString(`
+[package]
+name = "x.y/z"
+version = "0.0.1"
+
+[dependencies]
+"x.y/a" = "1.0.0"
+"x.y/git" = {git = "https://x.y/git.git", rev = "main"}
+`))
+	require.NoError(t, err)
+	require.Equal(t, Dependency{Git: "https://x.y/git.git", Rev: "main"}, cfg.Dependencies["x.y/git"])
+
+	var buf bytes.Buffer
+	cfg.Render(&buf)
+	rendered, err := ParseConfig(&buf)
+	require.NoError(t, err)
+	require.Equal(t, cfg, rendered)
+}
+
+func TestWriteLockfile_GitDependencies(t *testing.T) {
+	dir := t.TempDir()
+	gl := GitLock{Git: "https://x.y/git.git", Rev: "main", Commit: "abc", Hash: "def"}
+
+	lf := &LockFile{}
+	require.NoError(t, lf.AddEntry("https://x.y/file", "hash"))
+	lf.SetGitDependency("x.y/git", gl)
+	require.NoError(t, WriteLockfile(lf, dir))
+
+	_, read, err := ReadConfigs(writeConfig(t, dir))
+	require.NoError(t, err)
+	got, found := read.LookupGitDependency("x.y/git")
+	require.True(t, found)
+	require.Equal(t, gl, got)
+
+	// A new commit for the same revision replaces the entry
+	gl.Commit = "ghi"
+	read.SetGitDependency("x.y/git", gl)
+	require.NoError(t, WriteLockfile(read, dir))
+	_, read, err = ReadConfigs(dir)
+	require.NoError(t, err)
+	require.Equal(t, gl, read.GitDependencies["x.y/git"])
+	require.Equal(t, "hash", read.URLHashes["https://x.y/file"])
+}
+
+func TestWriteLockfile_PackageHashes(t *testing.T) {
+	dir := writeConfig(t, t.TempDir())
+
+	lf := &LockFile{}
+	require.NoError(t, lf.AddPackageHash("x.y/a@1.0.0", "abc"))
+	require.NoError(t, lf.AddPackageHash("x.y/a@1.0.0", "abc"))
+	require.Error(t, lf.AddPackageHash("x.y/a@1.0.0", "def"))
+	require.NoError(t, WriteLockfile(lf, dir))
+
+	_, read, err := ReadConfigs(dir)
+	require.NoError(t, err)
+	hash, found := read.LookupPackageHash("x.y/a@1.0.0")
+	require.True(t, found)
+	require.Equal(t, "abc", hash)
+
+	// Hashes on disk are never silently replaced
+	conflict := &LockFile{}
+	require.NoError(t, conflict.AddPackageHash("x.y/a@1.0.0", "def"))
+	require.Error(t, WriteLockfile(conflict, dir))
+}
+
+func TestWriteLockfile_RemoveEntry(t *testing.T) {
+	dir := writeConfig(t, t.TempDir())
+
+	lf := &LockFile{}
+	require.NoError(t, lf.AddEntry("fetch_url a", "abc"))
+	require.NoError(t, lf.AddEntry("fetch_url b", "def"))
+	require.NoError(t, WriteLockfile(lf, dir))
+
+	// Removed entries are dropped from the lockfile on disk
+	lf = &LockFile{}
+	lf.RemoveEntry("fetch_url a")
+	require.NoError(t, WriteLockfile(lf, dir))
+	_, read, err := ReadConfigs(dir)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"fetch_url b": "def"}, read.URLHashes)
+
+	// Adding an entry again undoes the removal
+	lf.RemoveEntry("fetch_url b")
+	require.NoError(t, lf.AddEntry("fetch_url b", "def"))
+	require.NoError(t, WriteLockfile(lf, dir))
+	_, read, err = ReadConfigs(dir)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"fetch_url b": "def"}, read.URLHashes)
+}
+
+func writeConfig(t *testing.T, dir string) string {
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "bramble.toml"),
+		[]byte("[package]\nname = \"x.y/z\"\nversion = \"0.0.1\"\n"), 0644))
+	return dir
+}
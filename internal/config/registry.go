@@ -0,0 +1,130 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/pkg/errors"
+)
+
+// DefaultRegistry is the package registry that is used when no registries are
+// configured.
+const DefaultRegistry = "https://bramble-server.fly.dev"
+
+// Registry is a package server that dependencies are fetched from.
+type Registry struct {
+	URL string `toml:"url"`
+
+	// Prefixes limits the registry to packages with one of these prefixes. A
+	// package that matches a prefix is only fetched from the registries that
+	// list it, and never from registries without prefixes.
+	Prefixes []string `toml:"prefixes"`
+
+	// Cache substitutes build outputs from the cache that the registry serves
+	// at <url>/cache. The registry then decides the outputs of every
+	// derivation it has built, so it's only enabled for trusted registries.
+	Cache bool `toml:"cache"`
+}
+
+// Matches returns true if the registry has a prefix that matches the package
+// name.
+func (r Registry) Matches(pkg string) bool {
+	for _, prefix := range r.Prefixes {
+		prefix = strings.TrimSuffix(prefix, "/")
+		if pkg == prefix || strings.HasPrefix(pkg, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// RegistriesFor returns the registries that serve a package, in order.
+// Registries with a prefix that matches the package are used exclusively so
+// that private package names are never requested from public registries.
+func RegistriesFor(registries []Registry, pkg string) (out []Registry) {
+	for _, r := range registries {
+		if r.Matches(pkg) {
+			out = append(out, r)
+		}
+	}
+	if len(out) > 0 {
+		return out
+	}
+	for _, r := range registries {
+		if len(r.Prefixes) == 0 {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// UserConfig is the configuration in the user's bramble config file.
+type UserConfig struct {
+	Registries []Registry `toml:"registries"`
+}
+
+// UserConfigLocation returns the location of the user's config file, which is
+// bramble/config.toml in the user config directory.
+func UserConfigLocation() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", errors.Wrap(err, "error finding the user config directory")
+	}
+	return filepath.Join(dir, "bramble", "config.toml"), nil
+}
+
+// ReadUserConfig reads the user's config file, if there is one.
+func ReadUserConfig() (cfg UserConfig, err error) {
+	location, err := UserConfigLocation()
+	if err != nil {
+		return cfg, err
+	}
+	if _, err := toml.DecodeFile(location, &cfg); err != nil {
+		if os.IsNotExist(err) {
+			return cfg, nil
+		}
+		return cfg, errors.Wrapf(err, "error decoding %q", location)
+	}
+	return cfg, nil
+}
+
+// ParseRegistries parses a space or comma separated list of registries. Each
+// registry is a url, or a package prefix and url separated by "=", like
+// "example.com/internal=https://bramble.example.com".
+func ParseRegistries(value string) (registries []Registry, err error) {
+	for _, field := range strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n'
+	}) {
+		registry := Registry{URL: field}
+		if i := strings.Index(field, "="); i != -1 && !strings.Contains(field[:i], "://") {
+			registry = Registry{URL: field[i+1:], Prefixes: []string{field[:i]}}
+		}
+		if !strings.HasPrefix(registry.URL, "http://") && !strings.HasPrefix(registry.URL, "https://") {
+			return nil, errors.Errorf("registry %q must be an http or https url", field)
+		}
+		registries = append(registries, registry)
+	}
+	return registries, nil
+}
+
+// Registries returns the registries that packages are fetched from, in the
+// order they should be tried. The BRAMBLE_REGISTRY environment variable
+// replaces all other configuration. Otherwise the project's registries are
+// followed by the registries in the user's config file, and DefaultRegistry
+// is used if neither configure any.
+func Registries(project []Registry) (registries []Registry, err error) {
+	if value := os.Getenv("BRAMBLE_REGISTRY"); value != "" {
+		return ParseRegistries(value)
+	}
+	user, err := ReadUserConfig()
+	if err != nil {
+		return nil, err
+	}
+	registries = append(append(registries, project...), user.Registries...)
+	if len(registries) == 0 {
+		registries = []Registry{{URL: DefaultRegistry}}
+	}
+	return registries, nil
+}
@@ -0,0 +1,90 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/maxmcd/bramble/pkg/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRegistries(t *testing.T) {
+	registries, err := ParseRegistries("example.com/internal=https://internal.example.com, https://mirror.example.com https://bramble.example.com")
+	require.NoError(t, err)
+	require.Equal(t, []Registry{
+		{URL: "https://internal.example.com", Prefixes: []string{"example.com/internal"}},
+		{URL: "https://mirror.example.com"},
+		{URL: "https://bramble.example.com"},
+	}, registries)
+
+	_, err = ParseRegistries("example.com")
+	require.Error(t, err)
+}
+
+func TestRegistriesFor(t *testing.T) {
+	registries := []Registry{
+		{URL: "https://mirror.example.com"},
+		{URL: "https://internal.example.com", Prefixes: []string{"example.com/internal"}},
+		{URL: "https://bramble.example.com"},
+	}
+	for pkg, want := range map[string][]string{
+		"example.com/internal":     {"https://internal.example.com"},
+		"example.com/internal/foo": {"https://internal.example.com"},
+		"example.com/internalfoo":  {"https://mirror.example.com", "https://bramble.example.com"},
+		"github.com/maxmcd/foo":    {"https://mirror.example.com", "https://bramble.example.com"},
+	} {
+		var urls []string
+		for _, r := range RegistriesFor(registries, pkg) {
+			urls = append(urls, r.URL)
+		}
+		require.Equal(t, want, urls, pkg)
+	}
+}
+
+func TestRegistries(t *testing.T) {
+	configHome := t.TempDir()
+	test.SetEnv(t, "XDG_CONFIG_HOME", configHome)
+	test.SetEnv(t, "BRAMBLE_REGISTRY", "")
+
+	registries, err := Registries(nil)
+	require.NoError(t, err)
+	require.Equal(t, []Registry{{URL: DefaultRegistry}}, registries)
+
+	require.NoError(t, os.MkdirAll(filepath.Join(configHome, "bramble"), 0755))
+	test.WriteFile(t, filepath.Join(configHome, "bramble", "config.toml"), `
+[[registries]]
+url = "https://internal.example.com"
+prefixes = ["example.com/internal"]
+`)
+	project := []Registry{{URL: "https://project.example.com"}}
+	registries, err = Registries(project)
+	require.NoError(t, err)
+	require.Equal(t, []Registry{
+		{URL: "https://project.example.com"},
+		{URL: "https://internal.example.com", Prefixes: []string{"example.com/internal"}},
+	}, registries)
+
+	test.SetEnv(t, "BRAMBLE_REGISTRY", "https://ci.example.com")
+	registries, err = Registries(project)
+	require.NoError(t, err)
+	require.Equal(t, []Registry{{URL: "https://ci.example.com"}}, registries)
+}
+
+func TestConfig_RenderRegistries(t *testing.T) {
+	cfg := Config{
+		Package:      Package{Name: "x.y/z", Version: "0.0.1"},
+		Dependencies: map[string]Dependency{},
+		Registries: []Registry{
+			{URL: "https://internal.example.com", Prefixes: []string{"example.com/internal", "example.com/private"}},
+			{URL: "https://bramble.example.com", Cache: true},
+		},
+		Workspace: Workspace{Members: []string{"lib", "app"}},
+	}
+	var sb strings.Builder
+	cfg.Render(&sb)
+	rendered, err := ParseConfig(strings.NewReader(sb.String()))
+	require.NoError(t, err)
+	require.Equal(t, cfg, rendered)
+}
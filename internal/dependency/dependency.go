@@ -1,25 +1,30 @@
 package dependency
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
-	"time"
+	"sync"
 
-	"github.com/davecgh/go-spew/spew"
 	"github.com/maxmcd/bramble/internal/config"
+	"github.com/maxmcd/bramble/internal/offline"
 	"github.com/maxmcd/bramble/internal/types"
 	"github.com/maxmcd/bramble/pkg/chunkedarchive"
 	"github.com/maxmcd/bramble/pkg/fileutil"
+	"github.com/maxmcd/bramble/pkg/gitutil"
+	"github.com/maxmcd/bramble/pkg/hasher"
 	"github.com/maxmcd/bramble/pkg/httpx"
+	"github.com/maxmcd/bramble/pkg/reptar"
 	"github.com/maxmcd/bramble/v/cmd/go/mvs"
 	"github.com/pkg/errors"
 	"golang.org/x/mod/semver"
@@ -28,14 +33,63 @@ import (
 type Manager struct {
 	dir dir
 
-	dependencyClient *dependencyClient
+	registries []config.Registry
+
+	// pathOverrides are the local directories of packages that are used
+	// instead of their published versions
+	pathOverrides map[string]string
+
+	// sourceHashes caches the content hash of each dependency source path
+	sourceHashes sync.Map
 }
 
-func NewManager(dependencyDir string, packageHost string) *Manager {
+// NewManager returns a Manager that stores dependencies in dependencyDir and
+// fetches packages from the registries in order.
+func NewManager(dependencyDir string, registries []config.Registry) *Manager {
 	return &Manager{
-		dir:              dir(dependencyDir),
-		dependencyClient: &dependencyClient{host: packageHost, client: &http.Client{}},
+		dir:        dir(dependencyDir),
+		registries: registries,
+	}
+}
+
+// AddPathOverride uses the project in dir instead of the published versions of
+// the package. The bramble.toml in dir provides the package's requirements.
+func (dm *Manager) AddPathOverride(name, dir string) {
+	if dm.pathOverrides == nil {
+		dm.pathOverrides = map[string]string{}
 	}
+	dm.pathOverrides[name] = dir
+}
+
+// PathOverride returns the directory that is used for a package, if it has been
+// overridden with AddPathOverride.
+func (dm *Manager) PathOverride(name string) (dir string, found bool) {
+	dir, found = dm.pathOverrides[name]
+	return dir, found
+}
+
+// fromRegistries calls fn with each registry that serves the package, in order,
+// until one succeeds. os.ErrNotExist is returned if no registry has the
+// package, otherwise the first error.
+func (dm *Manager) fromRegistries(pkg string, fn func(dc *dependencyClient) error) (err error) {
+	registries := config.RegistriesFor(dm.registries, pkg)
+	if len(registries) == 0 {
+		return errors.Errorf("no registry is configured for package %q", pkg)
+	}
+	var firstErr error
+	for _, r := range registries {
+		err := fn(&dependencyClient{host: r.URL, client: &http.Client{}})
+		if err == nil {
+			return nil
+		}
+		if err != os.ErrNotExist && firstErr == nil {
+			firstErr = errors.Wrapf(err, "error fetching %s from registry %s", pkg, r.URL)
+		}
+	}
+	if firstErr != nil {
+		return firstErr
+	}
+	return os.ErrNotExist
 }
 
 type dir string
@@ -51,50 +105,212 @@ func (dd dir) localPackageVersions(pkg string) ([]string, error) {
 	if err != nil {
 		return nil, err
 	}
-	for i, match := range matches {
-		matches[i] = strings.TrimPrefix(match, path+"@")
+	versions := []string{}
+	for _, match := range matches {
+		version := strings.TrimPrefix(match, path+"@")
+		// Git dependencies are stored by commit, skip them
+		if semver.IsValid("v" + version) {
+			versions = append(versions, version)
+		}
 	}
-	return matches, nil
+	return versions, nil
 }
 
 func (dd dir) localPackageLocation(pkg types.Package) (path string) {
 	return dd.join("src", pkg.String())
 }
 
-func (dm *Manager) PackagePathOrDownload(ctx context.Context, pkg types.Package) (path string, err error) {
+// PackagePathOrDownload returns the location of a package's source and its
+// content hash. The source is downloaded from the registries if it isn't stored
+// locally. If expectedHash isn't empty the source must have that hash, both
+// when it's downloaded and when a local copy is used.
+func (dm *Manager) PackagePathOrDownload(ctx context.Context, pkg types.Package, expectedHash string) (path, hash string, err error) {
 	path = dm.dir.localPackageLocation(pkg)
 	if fileutil.DirExists(path) {
-		return path, nil
+		hash, err = dm.VerifySource(pkg.String(), path, expectedHash)
+		return path, hash, err
 	}
-	body, err := dm.dependencyClient.getPackageSource(ctx, pkg)
-	if err != nil {
+	if err := offline.Check("package %s hasn't been downloaded", pkg); err != nil {
+		return "", "", err
+	}
+	var body io.ReadCloser
+	if err := dm.fromRegistries(pkg.Name, func(dc *dependencyClient) (err error) {
+		body, err = dc.getPackageSource(ctx, pkg)
+		return err
+	}); err != nil {
 		if err == os.ErrNotExist {
-			return "", errors.Errorf("Package %q doesn't exist in the remote cache, do you need to publish it?", pkg)
+			return "", "", errors.Errorf("Package %q doesn't exist in the remote cache, do you need to publish it?", pkg)
 		}
-		return "", err
+		return "", "", err
 	}
 	defer body.Close()
-	if err := os.MkdirAll(path, 0755); err != nil {
-		return "", err
-	}
 	// Copy body to file, we can stream the unarchive if we figure out how to
 	// get the final size earlier and/or seek over http.
 	var name string
 	{
 		f, err := os.CreateTemp("", "")
 		if err != nil {
-			return "", err
+			return "", "", err
 		}
 		name = f.Name()
+		defer os.Remove(name)
 		_, _ = io.Copy(f, body)
 		if err := f.Close(); err != nil {
+			return "", "", err
+		}
+	}
+	// Unarchive next to the destination and only move the source into place
+	// once it's verified
+	location, err := dm.dir.tempDir()
+	if err != nil {
+		return "", "", err
+	}
+	defer os.RemoveAll(location)
+	if err := chunkedarchive.FileUnarchive(name, location); err != nil {
+		return "", "", errors.Wrap(err, "error unwrapping chunked archive")
+	}
+	if hash, err = hashDirectory(location); err != nil {
+		return "", "", err
+	}
+	if err := checkSourceHash(pkg.String(), "downloaded", expectedHash, hash); err != nil {
+		return "", "", err
+	}
+	if err := dm.moveIntoPlace(location, path, hash); err != nil {
+		return "", "", err
+	}
+	return path, hash, nil
+}
+
+// VerifySource returns the content hash of the source of a dependency at path.
+// If expectedHash isn't empty the source must have that hash. Each path is only
+// hashed once.
+func (dm *Manager) VerifySource(name, path, expectedHash string) (hash string, err error) {
+	if v, ok := dm.sourceHashes.Load(path); ok {
+		hash = v.(string)
+	} else {
+		if hash, err = hashDirectory(path); err != nil {
 			return "", err
 		}
+		dm.sourceHashes.Store(path, hash)
+	}
+	return hash, checkSourceHash(name, path, expectedHash, hash)
+}
+
+func checkSourceHash(name, source, expectedHash, hash string) error {
+	if expectedHash == "" || expectedHash == hash {
+		return nil
+	}
+	return errors.Errorf("verifying %s: checksum mismatch\n\tbramble.lock: %s\n\t%s: %s\n\n"+
+		"The source of this dependency doesn't match the hash that was recorded when it was "+
+		"first used. It may have been modified or replaced, remove the local copy to download it again.",
+		name, expectedHash, source, hash)
+}
+
+func (dd dir) tempDir() (location string, err error) {
+	if err := os.MkdirAll(dd.join("src"), 0755); err != nil {
+		return "", err
+	}
+	return os.MkdirTemp(dd.join(), "tmp-")
+}
+
+// moveIntoPlace moves a verified source directory to path
+func (dm *Manager) moveIntoPlace(location, path, hash string) (err error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	// Someone else might have put it there first
+	if err := os.Rename(location, path); err != nil && !fileutil.DirExists(path) {
+		return err
+	}
+	dm.sourceHashes.Store(path, hash)
+	return nil
+}
+
+// GitPackagePathOrDownload returns the location of a dependency that is fetched
+// directly from a git repository instead of a registry. The repository is
+// checked out at dep.Rev and stored without its .git directory at
+// src/<name>@<commit>. If locked is for the same repository and revision the
+// locked commit is used, and a fresh checkout of it must have the locked
+// content hash. The resolved commit and content hash are returned so that they
+// can be written to the lockfile.
+func (dm *Manager) GitPackagePathOrDownload(ctx context.Context, name string, dep config.Dependency, locked config.GitLock) (path string, resolved config.GitLock, err error) {
+	resolved = config.GitLock{Git: dep.Git, Rev: dep.Rev}
+	if locked.Git == dep.Git && locked.Rev == dep.Rev {
+		resolved.Commit = locked.Commit
+	} else if isCommitHash(dep.Rev) {
+		resolved.Commit = dep.Rev
+	}
+	if resolved.Commit != "" {
+		path = dm.dir.localGitPackageLocation(name, resolved.Commit)
+		if fileutil.DirExists(path) {
+			expectedHash := ""
+			if locked.Commit == resolved.Commit {
+				expectedHash = locked.Hash
+			}
+			resolved.Hash, err = dm.VerifySource(name+"@"+resolved.Commit, path, expectedHash)
+			return path, resolved, err
+		}
+	}
+
+	if err := offline.Check("git dependency %s at %q hasn't been downloaded", name, dep.Rev); err != nil {
+		return "", resolved, err
+	}
+	reference := dep.Rev
+	if resolved.Commit != "" {
+		reference = resolved.Commit
+	}
+	// Clone next to the destination so that it can be moved into place
+	location, err := dm.dir.tempDir()
+	if err != nil {
+		return "", resolved, err
+	}
+	defer os.RemoveAll(location)
+	if err := cloneGitRepo(ctx, location, dep.Git, reference); err != nil {
+		return "", resolved, errors.Wrapf(err, "error fetching %s from %s", name, dep.Git)
+	}
+	if resolved.Commit, err = gitutil.Run(ctx, location, nil, "rev-parse", "HEAD"); err != nil {
+		return "", resolved, err
+	}
+	if err := os.RemoveAll(filepath.Join(location, ".git")); err != nil {
+		return "", resolved, err
+	}
+	if resolved.Hash, err = hashDirectory(location); err != nil {
+		return "", resolved, err
+	}
+	if locked.Commit == resolved.Commit {
+		if err := checkSourceHash(name+"@"+resolved.Commit, "downloaded", locked.Hash, resolved.Hash); err != nil {
+			return "", resolved, err
+		}
 	}
-	if err := chunkedarchive.FileUnarchive(name, path); err != nil {
-		return "", errors.Wrap(err, "error unwrapping chunked archive")
+	path = dm.dir.localGitPackageLocation(name, resolved.Commit)
+	if err := dm.moveIntoPlace(location, path, resolved.Hash); err != nil {
+		return "", resolved, err
 	}
-	return path, os.RemoveAll(name)
+	return path, resolved, nil
+}
+
+func (dd dir) localGitPackageLocation(name, commit string) (path string) {
+	return dd.join("src", name+"@"+commit)
+}
+
+func isCommitHash(rev string) bool {
+	if len(rev) != 40 {
+		return false
+	}
+	for _, c := range rev {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return false
+		}
+	}
+	return true
+}
+
+func hashDirectory(location string) (hash string, err error) {
+	h := hasher.New()
+	if err := reptar.Reptar(location, h); err != nil {
+		return "", err
+	}
+	return h.String(), nil
 }
 
 func (dm *Manager) FindPackage(name string) {
@@ -117,6 +333,10 @@ func sortVersions(pkgs []types.Package) {
 
 func configVersions(cfg config.Config) (pkgs []types.Package) {
 	for pkg, dep := range cfg.Dependencies {
+		// Git dependencies are pinned by the lockfile and aren't part of MVS
+		if dep.Git != "" {
+			continue
+		}
 		pkgs = append(pkgs, types.Package{Name: pkg, Version: dep.Version})
 	}
 	sortVersions(pkgs)
@@ -135,63 +355,271 @@ func (dm *Manager) localPackageDependencies(pkg types.Package) (vs []types.Packa
 	return configVersions(cfg), nil
 }
 
+func (dm *Manager) pathOverrideDependencies(name string) (vs []types.Package, err error) {
+	cfg, err := config.ReadConfig(filepath.Join(dm.pathOverrides[name], "bramble.toml"))
+	if err != nil {
+		return nil, err
+	}
+	return configVersions(cfg), nil
+}
+
 func (dm *Manager) CalculateConfigBuildlist(cfg config.Config) (config.Config, error) {
-	versions, err := mvs.BuildList(
-		mvsVersionFromPackage(types.Package{Name: cfg.Package.Name, Version: cfg.Package.Version}),
-		dm.reqs(cfg),
-	)
+	versions, err := mvs.BuildList(configTarget(cfg), dm.reqs(cfg))
+	if err != nil {
+		return config.Config{}, err
+	}
+	return configWithBuildList(cfg, versions), nil
+}
+
+// UpgradeConfig upgrades the dependencies in cfg to the newest versions that
+// have the same major version and returns the new build list as a config. If
+// pkgs are passed only those packages are upgraded.
+func (dm *Manager) UpgradeConfig(cfg config.Config, pkgs ...string) (config.Config, error) {
+	target := configTarget(cfg)
+	reqs := dm.reqs(cfg)
+	if len(pkgs) == 0 {
+		versions, err := mvs.UpgradeAll(target, reqs)
+		if err != nil {
+			return config.Config{}, err
+		}
+		return configWithBuildList(cfg, versions), nil
+	}
+	var upgrades []mvs.Version
+	for _, pkg := range pkgs {
+		dep, found := cfg.Dependencies[pkg]
+		if !found || dep.Git != "" {
+			return config.Config{}, errors.Errorf("%q is not a registry dependency of this project", pkg)
+		}
+		latest, err := reqs.Upgrade(mvsVersionFromPackage(types.Package{Name: pkg, Version: dep.Version}))
+		if err != nil {
+			return config.Config{}, err
+		}
+		upgrades = append(upgrades, latest)
+	}
+	versions, err := mvs.Upgrade(target, reqs, upgrades...)
+	if err != nil {
+		return config.Config{}, err
+	}
+	return configWithBuildList(cfg, versions), nil
+}
+
+// DowngradeConfig downgrades a dependency in cfg to pkg.Version. Dependencies
+// that require a newer version of the package are downgraded as well, or
+// removed if none of their versions are compatible.
+func (dm *Manager) DowngradeConfig(cfg config.Config, pkg types.Package) (config.Config, error) {
+	dep, found := cfg.Dependencies[pkg.Name]
+	if !found || dep.Git != "" {
+		return config.Config{}, errors.Errorf("%q is not a registry dependency of this project", pkg.Name)
+	}
+	if !semver.IsValid("v" + pkg.Version) {
+		return config.Config{}, errors.Errorf("%q is not a valid version", pkg.Version)
+	}
+	if semver.Major("v"+pkg.Version) != semver.Major("v"+dep.Version) {
+		return config.Config{}, errors.Errorf(
+			"can't downgrade %s from %s to a different major version %s", pkg.Name, dep.Version, pkg.Version)
+	}
+	versions, err := mvs.Downgrade(configTarget(cfg), dm.reqs(cfg), mvsVersionFromPackage(pkg))
 	if err != nil {
 		return config.Config{}, err
 	}
+	// Downgrade only returns the requirements of the target, recalculate the
+	// build list from them
+	return dm.CalculateConfigBuildlist(configWithBuildList(cfg, versions))
+}
+
+// Requirement is an edge in the module requirement graph, From requires To.
+type Requirement struct {
+	From types.Package
+	To   types.Package
+}
+
+// RequirementGraph returns every requirement that is reachable from cfg's
+// package, in breadth first order, along with the selected build list.
+func (dm *Manager) RequirementGraph(cfg config.Config) (graph []Requirement, buildList []types.Package, err error) {
+	target := configTarget(cfg)
+	reqs := dm.reqs(cfg)
+	versions, err := mvs.BuildList(target, reqs)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, v := range versions[1:] {
+		buildList = append(buildList, packageFromMVSVersion(v))
+	}
+	seen := map[mvs.Version]bool{target: true}
+	queue := []mvs.Version{target}
+	for len(queue) > 0 {
+		m := queue[0]
+		queue = queue[1:]
+		required, err := reqs.Required(m)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, r := range required {
+			graph = append(graph, Requirement{From: packageFromMVSVersion(m), To: packageFromMVSVersion(r)})
+			if !seen[r] {
+				seen[r] = true
+				queue = append(queue, r)
+			}
+		}
+	}
+	return graph, buildList, nil
+}
 
+// RequirementChain returns the shortest chain of requirements from cfg's
+// package to the selected version of the named package.
+func (dm *Manager) RequirementChain(cfg config.Config, name string) (chain []types.Package, err error) {
+	graph, buildList, err := dm.RequirementGraph(cfg)
+	if err != nil {
+		return nil, err
+	}
+	var selected *types.Package
+	for i := range buildList {
+		if buildList[i].Name == name {
+			selected = &buildList[i]
+		}
+	}
+	if selected == nil {
+		return nil, errors.Errorf("%q is not in the build list of this project", name)
+	}
+	// Edges are in breadth first order, so the first edge that reaches a
+	// package is on a shortest path to it
+	target := types.Package{Name: cfg.Package.Name, Version: cfg.Package.Version}
+	parents := map[types.Package]types.Package{}
+	for _, r := range graph {
+		if _, found := parents[r.To]; !found && r.To != target {
+			parents[r.To] = r.From
+		}
+	}
+	for pkg := *selected; pkg != target; pkg = parents[pkg] {
+		chain = append([]types.Package{pkg}, chain...)
+	}
+	return append([]types.Package{target}, chain...), nil
+}
+
+func configTarget(cfg config.Config) mvs.Version {
+	return mvsVersionFromPackage(types.Package{Name: cfg.Package.Name, Version: cfg.Package.Version})
+}
+
+// configWithBuildList replaces the registry dependencies in cfg with the build
+// list, path overrides in cfg are kept at their selected version
+func configWithBuildList(cfg config.Config, versions []mvs.Version) config.Config {
+	deps := cfg.Dependencies
 	cfg.Dependencies = make(map[string]config.Dependency)
+	for name, dep := range deps {
+		if dep.Git != "" {
+			cfg.Dependencies[name] = dep
+		}
+	}
 	for _, version := range versions {
 		v := packageFromMVSVersion(version)
 		if v.Name == cfg.Package.Name {
 			continue
 		}
-		// Support path overrides
-		cfg.Dependencies[v.Name] = config.Dependency{Version: v.Version}
+		cfg.Dependencies[v.Name] = config.Dependency{Version: v.Version, Path: deps[v.Name].Path}
 	}
-	return cfg, nil
+	return cfg
 }
 
-func (dm *Manager) remotePackageDependencies(ctx context.Context, m types.Package) (vs []types.Package, err error) {
-	cfg, err := dm.dependencyClient.getPackageConfig(ctx, m)
+// LatestVersion returns the newest version of a package that is available
+// locally or in the registry.
+func (dm *Manager) LatestVersion(ctx context.Context, name string) (version string, err error) {
+	vs, err := dm.packageVersions(ctx, name)
 	if err != nil {
+		return "", err
+	}
+	for _, v := range vs {
+		if version == "" || semver.Compare("v"+v, "v"+version) > 0 {
+			version = v
+		}
+	}
+	if version == "" {
+		return "", errors.Errorf("no versions of package %q are published", name)
+	}
+	return version, nil
+}
+
+// packageVersions returns the versions of a package that are available locally
+// and in the registry.
+func (dm *Manager) packageVersions(ctx context.Context, name string) (vs []string, err error) {
+	if vs, err = dm.dir.localPackageVersions(name); err != nil {
+		return nil, err
+	}
+	// Only versions that have already been downloaded can be used offline
+	if offline.Enabled() || len(config.RegistriesFor(dm.registries, name)) == 0 {
+		return vs, nil
+	}
+	var remote []string
+	if err := dm.fromRegistries(name, func(dc *dependencyClient) (err error) {
+		remote, err = dc.getPackageVersions(ctx, name)
+		return err
+	}); err != nil && err != os.ErrNotExist {
+		return nil, err
+	}
+	return append(vs, remote...), nil
+}
+
+func (dm *Manager) remotePackageDependencies(ctx context.Context, m types.Package) (vs []types.Package, err error) {
+	var cfg config.Config
+	if err := dm.fromRegistries(m.Name, func(dc *dependencyClient) (err error) {
+		cfg, err = dc.getPackageConfig(ctx, m)
+		return err
+	}); err != nil {
+		if err == os.ErrNotExist {
+			err = errors.Errorf("request to server could not find package %s", m)
+		}
 		return nil, err
 	}
 	return configVersions(cfg), nil
 }
 
-func PostJob(url, pkg, reference string) (err error) {
+// PostJob asks the server at url to publish a package and writes the job's
+// logs to logs until it finishes. If the job fails its error is returned.
+func PostJob(ctx context.Context, url, pkg, reference string, logs io.Writer) (err error) {
 	jr := JobRequest{Package: pkg, Reference: reference}
-	dc := &dependencyClient{client: &http.Client{}, host: url}
-	id, err := dc.postJob(context.Background(), jr)
+	dc := newPublishClient(url)
+	id, err := dc.postJob(ctx, jr)
 	if err != nil {
 		return err
 	}
-	dur := (time.Millisecond * 100)
-	count := 0
-	for {
-		if count > 5 {
-			// Many jobs finish quickly, but if they don't, we can check less
-			// often
-			dur = time.Second
-		}
-		job, err := dc.getJob(context.Background(), id)
-		spew.Dump(job)
-		if err != nil {
-			return err
-		}
-		if job.Error != "" {
-			return errors.Wrap(errors.New(job.ErrWithStack), "got error posting job")
-		}
-		if !job.End.IsZero() {
-			break
-		}
-		count++
-		time.Sleep(dur)
+	return dc.waitForJob(ctx, id, pkg, logs)
+}
+
+// newPublishClient returns a client that sends the token in
+// BRAMBLE_PUBLISH_TOKEN with publish jobs.
+func newPublishClient(url string) *dependencyClient {
+	return &dependencyClient{
+		client: &http.Client{Transport: httpx.TokenTransport(os.Getenv(PublishTokenEnvVar), http.DefaultTransport)},
+		host:   url,
+	}
+}
+
+// PublishLocal uploads the project in dir to the server at url to be built and
+// published. The job's logs are written to logs until it finishes.
+func PublishLocal(ctx context.Context, url, dir string, logs io.Writer) (err error) {
+	if !fileutil.FileExists(filepath.Join(dir, "bramble.toml")) {
+		return errors.Errorf("%q is not a bramble project, it doesn't have a bramble.toml", dir)
+	}
+	dc := newPublishClient(url)
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(chunkedarchive.StreamArchive(pw, dir))
+	}()
+	var id string
+	err = dc.request(ctx, http.MethodPost, "/job/upload", "application/octet-stream", pr, &id)
+	_ = pr.Close()
+	if err != nil {
+		return err
+	}
+	return dc.waitForJob(ctx, id, dir, logs)
+}
+
+func (dc *dependencyClient) waitForJob(ctx context.Context, id, name string, logs io.Writer) (err error) {
+	job, err := dc.followJob(ctx, id, logs)
+	if err != nil {
+		return err
+	}
+	if job.Error != "" {
+		return errors.Errorf("publishing %s failed: %s", name, job.Error)
 	}
 	return nil
 }
@@ -213,10 +641,9 @@ func (r dependencyManagerReqs) Required(m mvs.Version) (versions []mvs.Version,
 
 	switch {
 	case r.cfg.Package.Name == p.Name && r.cfg.Package.Version == p.Version:
-		for pkg, cd := range r.cfg.Dependencies {
-			pkgs = append(pkgs, types.Package{Name: pkg, Version: cd.Version})
-			sortVersions(pkgs)
-		}
+		pkgs = configVersions(r.cfg)
+	case r.deps.pathOverrides[p.Name] != "":
+		pkgs, err = r.deps.pathOverrideDependencies(p.Name)
 	case r.deps.existsLocally(p):
 		pkgs, err = r.deps.localPackageDependencies(p)
 	default:
@@ -242,14 +669,64 @@ func (r dependencyManagerReqs) Max(v1, v2 string) (o string) {
 	}
 }
 
+// compatibleVersions returns the versions of m's package that have the same
+// major version as m, in the mvs version format.
+func (r dependencyManagerReqs) compatibleVersions(m mvs.Version) (vs []string, err error) {
+	loc := strings.LastIndex(m.Name, "@")
+	name, major := m.Name[:loc], m.Name[loc+1:]
+	versions, err := r.deps.packageVersions(context.Background(), name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error listing versions of %s", name)
+	}
+	for _, version := range versions {
+		if !semver.IsValid("v" + version) {
+			continue
+		}
+		parts := strings.SplitN(version, ".", 2)
+		if parts[0] == major && len(parts) == 2 {
+			vs = append(vs, parts[1])
+		}
+	}
+	return vs, nil
+}
+
+// Upgrade returns the newest version of m's package with the same major
+// version, or m if there isn't a newer one. Path overrides aren't upgraded.
 func (r dependencyManagerReqs) Upgrade(m mvs.Version) (v mvs.Version, err error) {
-	panic("")
-	return
+	if _, found := r.deps.PathOverride(packageFromMVSVersion(m).Name); found {
+		return m, nil
+	}
+	vs, err := r.compatibleVersions(m)
+	if err != nil {
+		return v, err
+	}
+	v = m
+	for _, version := range vs {
+		if v.Version == "none" || r.Max(v.Version, version) == version {
+			v.Version = version
+		}
+	}
+	return v, nil
 }
 
+// Previous returns the version of m's package before m with the same major
+// version, or "none" if there isn't one.
 func (r dependencyManagerReqs) Previous(m mvs.Version) (v mvs.Version, err error) {
-	panic("")
-	return
+	vs, err := r.compatibleVersions(m)
+	if err != nil {
+		return v, err
+	}
+	v = mvs.Version{Name: m.Name, Version: "none"}
+	for _, version := range vs {
+		if r.Max(version, m.Version) == version {
+			// Not older than m
+			continue
+		}
+		if v.Version == "none" || r.Max(v.Version, version) == version {
+			v.Version = version
+		}
+	}
+	return v, nil
 }
 
 type dependencyClient struct {
@@ -262,6 +739,9 @@ func (dc *dependencyClient) request(ctx context.Context, method, path, contentTy
 		strings.TrimSuffix(dc.host, "/"),
 		strings.TrimPrefix(path, "/"),
 	)
+	if err := offline.Check("can't reach %s", dc.host); err != nil {
+		return err
+	}
 	return httpx.Request(ctx, dc.client, method, url, contentType, body, resp)
 }
 
@@ -287,10 +767,49 @@ func (dc *dependencyClient) getJob(ctx context.Context, id string) (job Job, err
 		&job)
 }
 
+// followJob reads the server-sent events from the job's log stream, writing log
+// lines to logs, and returns the job once it has finished.
+func (dc *dependencyClient) followJob(ctx context.Context, id string, logs io.Writer) (job Job, err error) {
+	var body io.ReadCloser
+	if err := dc.request(ctx,
+		http.MethodGet,
+		"/job/"+id+"/logs",
+		"",
+		nil,
+		&body); err != nil {
+		return job, err
+	}
+	defer body.Close()
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	event, data := "", []string{}
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			switch event {
+			case "log":
+				fmt.Fprintln(logs, strings.Join(data, "\n"))
+			case "end":
+				return job, json.Unmarshal([]byte(strings.Join(data, "\n")), &job)
+			}
+			event, data = "", nil
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return job, errors.Wrap(err, "error reading job logs")
+	}
+	return job, errors.Errorf("job %s log stream ended before the job finished", id)
+}
+
 func (dc *dependencyClient) getPackageVersions(ctx context.Context, name string) (vs []string, err error) {
 	return vs, dc.request(ctx,
 		http.MethodGet,
-		"/package/"+name,
+		"/package/versions/"+name,
 		"",
 		nil,
 		&vs)
@@ -306,10 +825,12 @@ func possiblePackageVariants(name string) (variants []string) {
 	return
 }
 
-func (dc *dependencyClient) findPackageFromModuleName(ctx context.Context, name string) (n string, vs []string, err error) {
+func (dm *Manager) findRemotePackageFromModuleName(ctx context.Context, name string) (n string, vs []string, err error) {
 	for _, n := range possiblePackageVariants(name) {
-		vs, err := dc.getPackageVersions(ctx, n)
-		if err != nil {
+		if err := dm.fromRegistries(n, func(dc *dependencyClient) (err error) {
+			vs, err = dc.getPackageVersions(ctx, n)
+			return err
+		}); err != nil {
 			if err == os.ErrNotExist {
 				continue
 			}
@@ -340,7 +861,7 @@ func (dm *Manager) FindPackageFromModuleName(ctx context.Context, module string)
 		return "", nil, err
 	}
 	if err == os.ErrNotExist {
-		name, vs, err = dm.dependencyClient.findPackageFromModuleName(ctx, module)
+		name, vs, err = dm.findRemotePackageFromModuleName(ctx, module)
 	}
 	if err == os.ErrNotExist {
 		return "", nil, errors.Errorf("can't find package for module %q", module)
@@ -354,9 +875,6 @@ func (dc *dependencyClient) getPackageSource(ctx context.Context, pkg types.Pack
 		"/package/source/"+pkg.String(),
 		"",
 		nil, &body); err != nil {
-		if err == os.ErrNotExist {
-			err = errors.Errorf("request to server could not find package %s", pkg)
-		}
 		return nil, err
 	}
 	return body, nil
@@ -370,9 +888,6 @@ func (dc *dependencyClient) getPackageConfig(ctx context.Context, pkg types.Pack
 		"/package/config/"+pkg.String(),
 		"",
 		nil, w); err != nil {
-		if err == os.ErrNotExist {
-			err = errors.Errorf("request to server could not find package %s", pkg)
-		}
 		return cfg, err
 	}
 	return config.ParseConfig(&buf)
@@ -389,7 +904,6 @@ func addDependencyMetadata(dependencyDir, pkg, version, src string, mapping map[
 	// If the metadata is here we already have a record of the output mapping.
 	// If we checked the src directory it might just be there as a dependency of
 	// another nomad project
-	fmt.Println(metadataDest)
 	if fileutil.PathExists(metadataDest) {
 		return errors.Errorf("version %s of package %q is already present on this server", version, pkg)
 	}
@@ -419,34 +933,91 @@ func addDependencyMetadata(dependencyDir, pkg, version, src string, mapping map[
 	return nil
 }
 
-func serverHandler(dependencyDir string, newBuilder types.NewBuilder, downloadGithubRepo func(url string, reference string) (location string, err error)) http.Handler {
+func serverHandler(dependencyDir string, newBuilder types.NewBuilder, downloadGitRepo func(url string, reference string) (location string, err error), opts ServerOptions) (http.Handler, error) {
 	dependencyDirectory := dir(dependencyDir)
 
+	jq, err := newJobQueue(dependencyDirectory.join("jobs"), jobWorkers, func(job *Job, logs io.Writer) error {
+		return buildJob(job, logs, dependencyDir, newBuilder, downloadGitRepo)
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "error loading publish jobs")
+	}
+
 	router := httpx.New()
+	router.GET("/jobs", func(c httpx.Context) error {
+		limit := 100
+		if l := c.Request.URL.Query().Get("limit"); l != "" {
+			var err error
+			if limit, err = strconv.Atoi(l); err != nil {
+				return httpx.ErrUnprocessableEntity(errors.Wrap(err, "invalid limit"))
+			}
+		}
+		jobs := []Job{}
+		for _, job := range jq.List(limit) {
+			jobs = append(jobs, job.public())
+		}
+		return c.JSON(jobs)
+	})
 	router.GET("/job/:id", func(c httpx.Context) error {
 		job := jq.Lookup(c.Params.ByName("id"))
 		if job == nil {
 			return httpx.ErrNotFound(errors.New("no job found with that id"))
 		}
-		return json.NewEncoder(c.ResponseWriter).Encode(job)
+		return json.NewEncoder(c.ResponseWriter).Encode(job.public())
+	})
+	router.GET("/job/:id/logs", func(c httpx.Context) error {
+		id := c.Params.ByName("id")
+		if jq.Lookup(id) == nil {
+			return httpx.ErrNotFound(errors.New("no job found with that id"))
+		}
+		return streamJobLogs(c, jq, id)
+	})
+	router.POST("/job/upload", func(c httpx.Context) error {
+		if err := httpx.CheckToken(c.Request, opts.PublishToken); err != nil {
+			return err
+		}
+		source, err := receiveUpload(dependencyDirectory.join("jobs", "uploads"), c.Request.Body)
+		if err != nil {
+			return err
+		}
+		cfg, err := config.ReadConfig(filepath.Join(source, "bramble.toml"))
+		if err != nil {
+			_ = os.RemoveAll(source)
+			return httpx.ErrUnprocessableEntity(
+				errors.Wrap(err, "uploaded project must have a bramble.toml at its root"))
+		}
+		job := &Job{
+			Package: cfg.Package.Name,
+			Source:  source,
+		}
+		if err := jq.AddJob(job); err != nil {
+			_ = os.RemoveAll(source)
+			return err
+		}
+		fmt.Fprint(c.ResponseWriter, job.ID)
+		return nil
 	})
 	router.POST("/job", func(c httpx.Context) error {
 		jobRequest := JobRequest{}
 		if err := json.NewDecoder(c.Request.Body).Decode(&jobRequest); err != nil {
 			return httpx.ErrUnprocessableEntity(err)
 		}
+		if err := validateJobRequest(jobRequest, opts.AllowLocalGit); err != nil {
+			return httpx.ErrUnprocessableEntity(err)
+		}
+		if isLocalGitURL(jobRequest.Package) {
+			if err := httpx.CheckToken(c.Request, opts.PublishToken); err != nil {
+				return err
+			}
+		}
 		job := &Job{
 			Package:   jobRequest.Package,
 			Reference: jobRequest.Reference,
 		}
-		jq.AddJob(job)
+		if err := jq.AddJob(job); err != nil {
+			return err
+		}
 		fmt.Fprint(c.ResponseWriter, job.ID)
-
-		// Run job
-		go func() {
-			jq.End(job.ID, buildJob(job, dependencyDir, newBuilder, downloadGithubRepo))
-		}()
-
 		return nil
 	})
 	// router.GET("/package/outputs/:platform/:name/:version", func(c httpx.Context) error {
@@ -472,6 +1043,9 @@ func serverHandler(dependencyDir string, newBuilder types.NewBuilder, downloadGi
 		if err != nil {
 			return err
 		}
+		if len(matches) == 0 {
+			return httpx.ErrNotFound(errors.Errorf("package %q not found", strings.TrimPrefix(name, "/")))
+		}
 		return json.NewEncoder(c.ResponseWriter).Encode(matches)
 	})
 	router.GET("/package/source/*name_version", func(c httpx.Context) error {
@@ -484,7 +1058,6 @@ func serverHandler(dependencyDir string, newBuilder types.NewBuilder, downloadGi
 	})
 	router.GET("/package/config/*name_version", func(c httpx.Context) error {
 		name := c.Params.ByName("name_version")
-		fmt.Println("MNAME_SERVION", name)
 		path := filepath.Join(dependencyDir, "src", name, "bramble.toml")
 		if !fileutil.FileExists(path) {
 			return httpx.ErrNotFound(errors.New("can't find package"))
@@ -500,25 +1073,139 @@ func serverHandler(dependencyDir string, newBuilder types.NewBuilder, downloadGi
 		return nil
 	})
 
-	return router
+	return router, nil
 }
 
-func buildJob(job *Job, dependencyDir string, newBuilder types.NewBuilder, downloadGithubRepo func(url string, reference string) (location string, err error)) (err error) {
-	loc, err := downloadGithubRepo(job.Package, job.Reference)
+// maxUploadSize is the largest source archive that can be uploaded with a job.
+const maxUploadSize = 512 << 20
+
+// receiveUpload writes a chunked archive of sources to a new directory in dir.
+func receiveUpload(dir string, body io.Reader) (location string, err error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	f, err := os.CreateTemp(dir, "*.archive")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	n, err := io.Copy(f, io.LimitReader(body, maxUploadSize+1))
+	if err == nil {
+		err = f.Close()
+	} else {
+		_ = f.Close()
+	}
 	if err != nil {
-		return errors.Wrap(err, "error downloading git repo")
+		return "", err
+	}
+	if n > maxUploadSize {
+		return "", httpx.ErrUnprocessableEntity(errors.Errorf("uploads can't be larger than %d bytes", maxUploadSize))
+	}
+	if location, err = os.MkdirTemp(dir, ""); err != nil {
+		return "", err
+	}
+	if err := chunkedarchive.FileUnarchive(f.Name(), location); err != nil {
+		_ = os.RemoveAll(location)
+		return "", httpx.ErrUnprocessableEntity(errors.Wrap(err, "error unarchiving upload"))
+	}
+	return location, nil
+}
+
+// isGitURL returns true if the package is a git url rather than a package name
+// that is hosted on github.
+func isGitURL(pkg string) bool {
+	return strings.Contains(pkg, "://") || strings.HasPrefix(pkg, "git@")
+}
+
+// isLocalGitURL returns true if the package is a repository on the server's
+// disk.
+func isLocalGitURL(pkg string) bool {
+	return strings.HasPrefix(pkg, "file://")
+}
+
+// gitURLPackageName returns the package name that a git url must publish, the
+// host and path of the url without ".git", like the url that is cloned for a
+// github package.
+func gitURLPackageName(gitURL string) (name string, err error) {
+	host, path := "", ""
+	if strings.HasPrefix(gitURL, "git@") {
+		parts := strings.SplitN(strings.TrimPrefix(gitURL, "git@"), ":", 2)
+		if len(parts) == 2 {
+			host, path = parts[0], parts[1]
+		}
+	} else if u, err := url.Parse(gitURL); err == nil {
+		host, path = u.Hostname(), u.Path
+	}
+	path = strings.TrimSuffix(strings.Trim(path, "/"), ".git")
+	if host == "" || path == "" {
+		return "", errors.Errorf("can't find a package name in git url %q", gitURL)
+	}
+	return host + "/" + path, nil
+}
+
+// validateJobRequest rejects jobs that could clone a repository from the
+// server's own disk or pass options to git. Git urls must use https, http or
+// ssh, local "file://" repositories are only allowed if allowLocalGit is true.
+func validateJobRequest(jr JobRequest, allowLocalGit bool) error {
+	if strings.HasPrefix(jr.Package, "-") || strings.HasPrefix(jr.Reference, "-") {
+		return errors.Errorf("package %q and reference %q can't start with \"-\"", jr.Package, jr.Reference)
+	}
+	if !isGitURL(jr.Package) || (allowLocalGit && isLocalGitURL(jr.Package)) {
+		return nil
+	}
+	for _, prefix := range []string{"https://", "http://", "ssh://", "git@"} {
+		if strings.HasPrefix(jr.Package, prefix) {
+			return nil
+		}
+	}
+	if allowLocalGit {
+		return errors.Errorf("git url %q must use https, http, ssh or file", jr.Package)
+	}
+	return errors.Errorf("git url %q must use https, http or ssh", jr.Package)
+}
+
+func buildJob(job *Job, logs io.Writer, dependencyDir string, newBuilder types.NewBuilder, downloadGitRepo func(url string, reference string) (location string, err error)) (err error) {
+	loc := job.Source
+	if loc == "" {
+		fmt.Fprintf(logs, "Downloading %s %s\n", job.Package, job.Reference)
+		if loc, err = downloadGitRepo(job.Package, job.Reference); err != nil {
+			return errors.Wrap(err, "error downloading git repo")
+		}
+		defer os.RemoveAll(loc)
 	}
 	builder, err := newBuilder(loc)
 	if err != nil {
 		return
 	}
 	packages := builder.Packages()
+
+	// Package names must match the location they were fetched from. Uploads
+	// and local repositories don't have a location that can be published, so
+	// the project at the root names them. The server only accepts them from
+	// publishers with the publish token.
+	base := job.Package
+	switch {
+	case job.Source != "" || isLocalGitURL(job.Package):
+		base = ""
+		for path, pkg := range packages {
+			if filepath.Clean(path) == filepath.Clean(loc) {
+				base = pkg.Name
+			}
+		}
+		if base == "" {
+			return errors.Errorf("%s must have a bramble.toml at its root", job.Package)
+		}
+	case isGitURL(job.Package):
+		if base, err = gitURLPackageName(job.Package); err != nil {
+			return err
+		}
+	}
 	for path, pkg := range packages {
 		rel, err := filepath.Rel(loc, path)
 		if err != nil {
 			panic(loc + " - " + path)
 		}
-		expectedPackageName := strings.TrimSuffix(job.Package+"/"+strings.Trim(strings.TrimPrefix(rel, "."), "/"), "/")
+		expectedPackageName := strings.TrimSuffix(base+"/"+strings.Trim(strings.TrimPrefix(rel, "."), "/"), "/")
 		if expectedPackageName != pkg.Name {
 			return errors.Errorf("package name %q does not match the location the project was fetched from: %q",
 				pkg.Name,
@@ -527,7 +1214,11 @@ func buildJob(job *Job, dependencyDir string, newBuilder types.NewBuilder, downl
 	}
 	toRun := []func() error{}
 	for path, pkg := range packages {
-		resp, err := builder.Build(context.Background(), path, nil, types.BuildOptions{Check: true})
+		fmt.Fprintf(logs, "Building %s\n", pkg)
+		resp, err := builder.Build(context.Background(), path, nil, types.BuildOptions{
+			Check:  true,
+			Output: logs,
+		})
 		if err != nil {
 			return err
 		}
@@ -551,32 +1242,53 @@ func buildJob(job *Job, dependencyDir string, newBuilder types.NewBuilder, downl
 	return nil
 }
 
-func ServerHandler(dependencyDir string, newBuilder types.NewBuilder, dgr types.DownloadGithubRepo) http.Handler {
-	return serverHandler(dependencyDir, newBuilder, dgr)
+// PublishTokenEnvVar is the environment variable that holds the token that is
+// sent to servers when publishing
+const PublishTokenEnvVar = "BRAMBLE_PUBLISH_TOKEN"
+
+// ServerOptions configure the package server.
+type ServerOptions struct {
+	// PublishToken is required to publish uploaded sources and local git
+	// repositories, because their projects choose their own package names.
+	// Both are disabled without a token.
+	PublishToken string
+	// AllowLocalGit allows publishing "file://" git repositories from the
+	// server's disk.
+	AllowLocalGit bool
+}
+
+// ServerHandler serves packages and runs publish jobs. Jobs are kept in the
+// "jobs" subdirectory of dependencyDir.
+func ServerHandler(dependencyDir string, newBuilder types.NewBuilder, dgr types.DownloadGitRepo, opts ServerOptions) (http.Handler, error) {
+	return serverHandler(dependencyDir, newBuilder, dgr, opts)
 }
 
-func DownloadGithubRepo(url string, reference string) (location string, err error) {
-	url = "https://" + url + ".git"
+// DownloadGitRepo clones a repository and checks out the reference. Package
+// names are cloned from github, git urls are cloned as they are.
+func DownloadGitRepo(url string, reference string) (location string, err error) {
 	location, err = os.MkdirTemp("", "")
 	if err != nil {
 		return
 	}
+	if err = cloneGitRepo(context.Background(), location, url, reference); err != nil {
+		_ = os.RemoveAll(location)
+		return "", err
+	}
+	return location, nil
+}
 
-	// TODO: replace all this with calls to bramble
-	script := fmt.Sprintf(`
-	set -ex
-	git clone %s %s
-	cd %s`, url, location, location)
-	if reference != "" {
-		script += fmt.Sprintf("\ngit checkout %s", reference)
+func cloneGitRepo(ctx context.Context, location, url, reference string) (err error) {
+	if err := offline.Check("can't clone %s", url); err != nil {
+		return err
 	}
-	// script += "\nrm -rf ./.git"
-	cmd := exec.Command("bash", "-c", script)
-	var buf bytes.Buffer
-	cmd.Stderr = io.MultiWriter(os.Stderr, &buf)
-	cmd.Stdout = os.Stdout
-	if err := cmd.Run(); err != nil {
-		return "", errors.Wrap(err, buf.String())
+	if err := gitutil.CheckURLAndReference(url, reference); err != nil {
+		return err
 	}
-	return
+	if !isGitURL(url) {
+		url = "https://" + url + ".git"
+	}
+	if _, err = gitutil.Run(ctx, location, nil, "clone", "--quiet", "--", url, "."); err == nil && reference != "" {
+		_, err = gitutil.Run(ctx, location, nil, "checkout", "--quiet", reference, "--")
+	}
+	return err
 }
@@ -1,21 +1,28 @@
 package dependency
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"math/rand"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
 
 	"github.com/maxmcd/bramble/internal/config"
+	"github.com/maxmcd/bramble/internal/offline"
 	"github.com/maxmcd/bramble/internal/types"
 	"github.com/maxmcd/bramble/pkg/fxt"
+	"github.com/maxmcd/bramble/pkg/test"
 	"github.com/maxmcd/bramble/v/cmd/go/mvs"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"golang.org/x/mod/semver"
@@ -143,6 +150,90 @@ func TestDMReqsUpgrade(t *testing.T) {
 	})
 }
 
+func TestDMUpgradeConfig(t *testing.T) {
+	deps := func(cfg config.Config) map[string]string {
+		out := map[string]string{}
+		for name, dep := range cfg.Dependencies {
+			out[name] = dep.Version
+		}
+		return out
+	}
+	cfg, dm := blogScenario(t)
+
+	// https://research.swtch.com/vgo-mvs, Upgrade All
+	upgraded, err := dm.UpgradeConfig(cfg)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		"B": "1.2.0", "C": "1.3.0", "D": "1.4.0", "E": "1.3.0", "F": "1.1.0", "G": "1.1.0",
+	}, deps(upgraded))
+
+	// Upgrade One
+	upgraded, err = dm.UpgradeConfig(cfg, "C")
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		"B": "1.2.0", "C": "1.3.0", "D": "1.4.0", "E": "1.2.0", "F": "1.1.0", "G": "1.1.0",
+	}, deps(upgraded))
+
+	_, err = dm.UpgradeConfig(cfg, "nope")
+	require.Error(t, err)
+}
+
+func TestDMDowngradeConfig(t *testing.T) {
+	cfg, dm := blogScenario(t)
+	cfg, err := dm.CalculateConfigBuildlist(cfg)
+	require.NoError(t, err)
+
+	// https://research.swtch.com/vgo-mvs, Downgrade
+	downgraded, err := dm.DowngradeConfig(cfg, types.Package{Name: "D", Version: "1.2.0"})
+	require.NoError(t, err)
+	require.Equal(t, map[string]config.Dependency{
+		"B": {Version: "1.1.0"},
+		"C": {Version: "1.1.0"},
+		"D": {Version: "1.2.0"},
+		"E": {Version: "1.2.0"},
+	}, downgraded.Dependencies)
+
+	_, err = dm.DowngradeConfig(cfg, types.Package{Name: "D", Version: "2.0.0"})
+	require.Error(t, err)
+}
+
+func TestDMRequirementGraph(t *testing.T) {
+	cfg, dm := blogScenario(t)
+	graph, buildList, err := dm.RequirementGraph(cfg)
+	require.NoError(t, err)
+
+	var edges []string
+	for _, r := range graph {
+		edges = append(edges, r.From.String()+" "+r.To.String())
+	}
+	require.Equal(t, []string{
+		"A@1.1.0 B@1.2.0",
+		"A@1.1.0 C@1.2.0",
+		"B@1.2.0 D@1.3.0",
+		"C@1.2.0 D@1.4.0",
+		"D@1.3.0 E@1.2.0",
+		"D@1.4.0 E@1.2.0",
+	}, edges)
+	require.Equal(t, []types.Package{
+		{Name: "B", Version: "1.2.0"},
+		{Name: "C", Version: "1.2.0"},
+		{Name: "D", Version: "1.4.0"},
+		{Name: "E", Version: "1.2.0"},
+	}, buildList)
+
+	// D@1.4.0 is selected because of C, not B
+	chain, err := dm.RequirementChain(cfg, "D")
+	require.NoError(t, err)
+	require.Equal(t, []types.Package{
+		{Name: "A", Version: "1.1.0"},
+		{Name: "C", Version: "1.2.0"},
+		{Name: "D", Version: "1.4.0"},
+	}, chain)
+
+	_, err = dm.RequirementChain(cfg, "F")
+	require.Error(t, err)
+}
+
 func (dm *Manager) deleteHalfDeps(t *testing.T) {
 	list, err := filepath.Glob(dm.dir.join("src", "*"))
 	if err != nil {
@@ -169,12 +260,11 @@ func TestDMReqsRemote(t *testing.T) {
 			// partially present subset
 			localDM.deleteHalfDeps(t)
 
-			server := httptest.NewServer(ServerHandler(string(remoteDM.dir), nil, nil))
+			handler, err := ServerHandler(string(remoteDM.dir), nil, nil, ServerOptions{})
+			require.NoError(t, err)
+			server := httptest.NewServer(handler)
 
-			localDM.dependencyClient = &dependencyClient{
-				client: &http.Client{},
-				host:   server.URL,
-			}
+			localDM.registries = []config.Registry{{URL: server.URL}}
 
 			vs, err := mvs.BuildList(mvs.Version{Name: "A@1", Version: "1.0"}, localDM.reqs(cfg))
 			if err != nil {
@@ -197,14 +287,13 @@ func TestDMPathOrDownload(t *testing.T) {
 	remoteCFG, remoteDM := blogScenario(t)
 	_, localDM := testDepMgr(t) // no deps
 
-	server := httptest.NewServer(ServerHandler(string(remoteDM.dir), nil, nil))
+	handler, err := ServerHandler(string(remoteDM.dir), nil, nil, ServerOptions{})
+	require.NoError(t, err)
+	server := httptest.NewServer(handler)
 
-	localDM.dependencyClient = &dependencyClient{
-		client: &http.Client{},
-		host:   server.URL,
-	}
+	localDM.registries = []config.Registry{{URL: server.URL}}
 
-	path, err := localDM.PackagePathOrDownload(context.Background(), types.Package{"A", "1.1.0"})
+	path, _, err := localDM.PackagePathOrDownload(context.Background(), types.Package{"A", "1.1.0"}, "")
 	if err != nil {
 		fxt.Printpvln(err)
 		t.Fatal(err)
@@ -219,6 +308,82 @@ func TestDMPathOrDownload(t *testing.T) {
 	require.Equal(t, cfg, remoteCFG)
 }
 
+func TestDMPathOrDownload_checksum(t *testing.T) {
+	_, remoteDM := blogScenario(t)
+	handler, err := ServerHandler(string(remoteDM.dir), nil, nil, ServerOptions{})
+	require.NoError(t, err)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	ctx := context.Background()
+	pkg := types.Package{Name: "A", Version: "1.1.0"}
+
+	newDM := func() *Manager {
+		_, dm := testDepMgr(t)
+		dm.registries = []config.Registry{{URL: server.URL}}
+		return dm
+	}
+
+	// A download that doesn't match the lockfile is rejected and not kept
+	dm := newDM()
+	_, _, err = dm.PackagePathOrDownload(ctx, pkg, "notthehash")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "checksum mismatch")
+	_, err = os.Stat(dm.dir.localPackageLocation(pkg))
+	require.True(t, os.IsNotExist(err))
+
+	path, hash, err := dm.PackagePathOrDownload(ctx, pkg, "")
+	require.NoError(t, err)
+	require.NotEmpty(t, hash)
+
+	// Matching hashes are accepted, for downloads and cached copies
+	_, downloaded, err := newDM().PackagePathOrDownload(ctx, pkg, hash)
+	require.NoError(t, err)
+	require.Equal(t, hash, downloaded)
+	_, cached, err := dm.PackagePathOrDownload(ctx, pkg, hash)
+	require.NoError(t, err)
+	require.Equal(t, hash, cached)
+
+	// A cached copy that has been modified is rejected
+	dm = newDM()
+	path, _, err = dm.PackagePathOrDownload(ctx, pkg, hash)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(path, "extra.bramble"), nil, 0644))
+	// Sources are only hashed once per Manager
+	dm = NewManager(string(dm.dir), dm.registries)
+	_, _, err = dm.PackagePathOrDownload(ctx, pkg, hash)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "checksum mismatch")
+}
+
+func TestDMOffline(t *testing.T) {
+	_, remoteDM := blogScenario(t)
+	handler, err := ServerHandler(string(remoteDM.dir), nil, nil, ServerOptions{})
+	require.NoError(t, err)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	ctx := context.Background()
+
+	_, localDM := testDepMgr(t)
+	localDM.registries = []config.Registry{{URL: server.URL}}
+	test.SetEnv(t, "BRAMBLE_OFFLINE", "1")
+
+	_, _, err = localDM.PackagePathOrDownload(ctx, types.Package{Name: "A", Version: "1.1.0"}, "")
+	require.True(t, offline.Is(err), err)
+	_, _, err = localDM.FindPackageFromModuleName(ctx, "B")
+	require.True(t, offline.Is(err), err)
+
+	// Packages that were downloaded are still available
+	test.SetEnv(t, "BRAMBLE_OFFLINE", "")
+	_, _, err = localDM.PackagePathOrDownload(ctx, types.Package{Name: "A", Version: "1.1.0"}, "")
+	require.NoError(t, err)
+	test.SetEnv(t, "BRAMBLE_OFFLINE", "1")
+	_, _, err = localDM.PackagePathOrDownload(ctx, types.Package{Name: "A", Version: "1.1.0"}, "")
+	require.NoError(t, err)
+	vs, err := localDM.packageVersions(ctx, "A")
+	require.NoError(t, err)
+	require.Equal(t, []string{"1.1.0"}, vs)
+}
+
 func TestVersion_mvsVersionFromPackage(t *testing.T) {
 	tests := []struct {
 		name string
@@ -339,13 +504,15 @@ func TestPushJob(t *testing.T) {
 		},
 	}
 
-	server := httptest.NewServer(
-		serverHandler(t.TempDir(), tb.NewBuilder, tb.testGithubDownloader),
-	)
+	handler, err := serverHandler(t.TempDir(), tb.NewBuilder, tb.testGithubDownloader, ServerOptions{})
+	require.NoError(t, err)
+	server := httptest.NewServer(handler)
 
-	if err := PostJob(server.URL, "x.y/z", ""); err != nil {
+	var logs bytes.Buffer
+	if err := PostJob(context.Background(), server.URL, "x.y/z", "", &logs); err != nil {
 		t.Fatal(err)
 	}
+	require.Contains(t, logs.String(), "Building x.y/z@2.0.0")
 	dc := &dependencyClient{
 		host:   server.URL,
 		client: &http.Client{},
@@ -368,3 +535,304 @@ func TestPushJob(t *testing.T) {
 		}
 	}
 }
+
+func TestPushJobError(t *testing.T) {
+	handler, err := serverHandler(t.TempDir(), nil, func(url, reference string) (string, error) {
+		return "", errors.New("repository not found")
+	}, ServerOptions{})
+	require.NoError(t, err)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	var logs bytes.Buffer
+	err = PostJob(context.Background(), server.URL, "x.y/z", "main", &logs)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "repository not found")
+	require.Contains(t, logs.String(), "Downloading x.y/z main")
+
+	// The job list doesn't include stack traces
+	jobs := requireJobList(t, server.URL)
+	require.Len(t, jobs, 1)
+	require.Contains(t, jobs[0].Error, "repository not found")
+	require.Empty(t, jobs[0].ErrWithStack)
+}
+
+// requireJobList returns the jobs listed by the server and checks that the
+// server doesn't expose their stacks or source locations
+func requireJobList(t *testing.T, url string) (jobs []Job) {
+	resp, err := http.Get(url + "/jobs")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NotContains(t, string(b), "ErrWithStack")
+	require.NotContains(t, string(b), "Source")
+	require.NoError(t, json.Unmarshal(b, &jobs))
+	return jobs
+}
+
+func publishTestBuilder(t *testing.T) testBuilder {
+	return testBuilder{
+		t: t,
+		packages: map[string]types.Package{
+			"":    {Name: "x.y/z", Version: "2.0.0"},
+			"./a": {Name: "x.y/z/a", Version: "1.2.0"},
+		},
+	}
+}
+
+func requirePublished(t *testing.T, url string, pkgs map[string]types.Package) {
+	dc := &dependencyClient{host: url, client: &http.Client{}}
+	for _, m := range pkgs {
+		cfg, err := dc.getPackageConfig(context.Background(), m)
+		require.NoError(t, err)
+		require.Equal(t, m.Name, cfg.Package.Name)
+	}
+}
+
+func TestPublishLocal(t *testing.T) {
+	tb := publishTestBuilder(t)
+	dependencyDir := t.TempDir()
+	handler, err := serverHandler(dependencyDir, tb.NewBuilder, nil, ServerOptions{PublishToken: "token"})
+	require.NoError(t, err)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	project, err := tb.testGithubDownloader("", "")
+	require.NoError(t, err)
+	var logs bytes.Buffer
+	// Uploads choose their own name so they need the publish token
+	err = PublishLocal(context.Background(), server.URL, project, &logs)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "401")
+
+	test.SetEnv(t, PublishTokenEnvVar, "token")
+	require.NoError(t, PublishLocal(context.Background(), server.URL, project, &logs))
+	require.Contains(t, logs.String(), "Building x.y/z@2.0.0")
+	requirePublished(t, server.URL, tb.packages)
+	require.Len(t, requireJobList(t, server.URL), 1)
+
+	// Uploaded sources are removed once the job is done
+	uploads, err := os.ReadDir(filepath.Join(dependencyDir, "jobs", "uploads"))
+	require.NoError(t, err)
+	require.Len(t, uploads, 0)
+
+	require.Error(t, PublishLocal(context.Background(), server.URL, t.TempDir(), &logs))
+}
+
+func TestPublishGitURL(t *testing.T) {
+	tb := publishTestBuilder(t)
+	repo, err := tb.testGithubDownloader("", "")
+	require.NoError(t, err)
+	gitCommit(t, repo)
+	git(t, repo, "tag", "v2.0.0")
+
+	// The server clones every https url from the local repository instead
+	var clones []string
+	handler, err := serverHandler(t.TempDir(), tb.NewBuilder, func(url, reference string) (location string, err error) {
+		location, err = DownloadGitRepo("file://"+repo, reference)
+		clones = append(clones, location)
+		return location, err
+	}, ServerOptions{})
+	require.NoError(t, err)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	var logs bytes.Buffer
+	err = PostJob(context.Background(), server.URL, "https://x.y/z", "nope", &logs)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "git checkout")
+
+	// The package name in the repository has to match the url
+	err = PostJob(context.Background(), server.URL, "https://x.y/other", "v2.0.0", &logs)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "does not match")
+
+	require.NoError(t, PostJob(context.Background(), server.URL, "https://x.y/z", "v2.0.0", &logs))
+	requirePublished(t, server.URL, tb.packages)
+	// Clones are removed once the job is done
+	for _, clone := range clones {
+		require.NoDirExists(t, clone)
+	}
+
+	// Remote jobs can't read repositories from the server's disk or pass
+	// options to git
+	for _, jr := range []JobRequest{
+		{Package: "file://" + repo, Reference: "v2.0.0"},
+		{Package: "git://example.com/repo", Reference: "v2.0.0"},
+		{Package: "https://x.y/z", Reference: "--upload-pack=touch /tmp/pwned;git-upload-pack"},
+	} {
+		err := PostJob(context.Background(), server.URL, jr.Package, jr.Reference, &logs)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "422")
+	}
+	require.Len(t, clones, 3)
+}
+
+func TestPublishLocalGitURL(t *testing.T) {
+	tb := publishTestBuilder(t)
+	repo, err := tb.testGithubDownloader("", "")
+	require.NoError(t, err)
+	gitCommit(t, repo)
+	git(t, repo, "tag", "v2.0.0")
+
+	newServer := func(opts ServerOptions) *httptest.Server {
+		handler, err := serverHandler(t.TempDir(), tb.NewBuilder, DownloadGitRepo, opts)
+		require.NoError(t, err)
+		return httptest.NewServer(handler)
+	}
+	var logs bytes.Buffer
+
+	// Local repositories are rejected unless the server allows them
+	server := newServer(ServerOptions{PublishToken: "token"})
+	defer server.Close()
+	test.SetEnv(t, PublishTokenEnvVar, "token")
+	err = PostJob(context.Background(), server.URL, "file://"+repo, "v2.0.0", &logs)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "422")
+
+	server = newServer(ServerOptions{PublishToken: "token", AllowLocalGit: true})
+	defer server.Close()
+	require.NoError(t, PostJob(context.Background(), server.URL, "file://"+repo, "v2.0.0", &logs))
+	requirePublished(t, server.URL, tb.packages)
+
+	// Local repositories choose their own name so they need the publish token
+	test.SetEnv(t, PublishTokenEnvVar, "")
+	err = PostJob(context.Background(), server.URL, "file://"+repo, "v2.0.0", &logs)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "401")
+}
+
+func TestGitURLPackageName(t *testing.T) {
+	for _, tt := range []struct {
+		url  string
+		name string
+	}{
+		{"https://github.com/maxmcd/bramble", "github.com/maxmcd/bramble"},
+		{"https://github.com/maxmcd/bramble.git", "github.com/maxmcd/bramble"},
+		{"ssh://git@example.com:22/a/b/", "example.com/a/b"},
+		{"git@github.com:maxmcd/bramble.git", "github.com/maxmcd/bramble"},
+		{"https://example.com", ""},
+	} {
+		t.Run(tt.url, func(t *testing.T) {
+			name, err := gitURLPackageName(tt.url)
+			if tt.name == "" {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.name, name)
+		})
+	}
+}
+
+func TestCloneGitRepo_options(t *testing.T) {
+	repo := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(repo, "a"), []byte("a"), 0644))
+	gitCommit(t, repo)
+	marker := filepath.Join(t.TempDir(), "pwned")
+	for _, reference := range []string{"--orphan=" + marker, "--upload-pack=touch " + marker} {
+		require.Error(t, cloneGitRepo(context.Background(), t.TempDir(), "file://"+repo, reference))
+	}
+	require.Error(t, cloneGitRepo(context.Background(), t.TempDir(), "--upload-pack=touch "+marker, ""))
+	require.NoFileExists(t, marker)
+}
+
+func git(t *testing.T, dir string, args ...string) string {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	require.NoError(t, err, string(out))
+	return strings.TrimSpace(string(out))
+}
+
+// gitCommit commits everything in the repository and returns the commit hash
+func gitCommit(t *testing.T, repo string) string {
+	if _, err := os.Stat(filepath.Join(repo, ".git")); err != nil {
+		git(t, repo, "init", "--quiet")
+	}
+	git(t, repo, "add", ".")
+	git(t, repo, "-c", "user.name=bramble", "-c", "user.email=bramble@example.com",
+		"commit", "--quiet", "-m", "commit")
+	return git(t, repo, "rev-parse", "HEAD")
+}
+
+func TestGitPackagePathOrDownload(t *testing.T) {
+	repo := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(repo, "default.bramble"), []byte("def a():\n    pass\n"), 0644))
+	first := gitCommit(t, repo)
+	require.NoError(t, os.WriteFile(filepath.Join(repo, "default.bramble"), []byte("def b():\n    pass\n"), 0644))
+	second := gitCommit(t, repo)
+
+	ctx := context.Background()
+	dm := &Manager{dir: dir(t.TempDir())}
+	dep := config.Dependency{Git: "file://" + repo, Rev: first}
+	path, locked, err := dm.GitPackagePathOrDownload(ctx, "x.y/git", dep, config.GitLock{})
+	require.NoError(t, err)
+	require.Equal(t, dm.dir.join("src", "x.y/git@"+first), path)
+	require.Equal(t, first, locked.Commit)
+	require.NotEmpty(t, locked.Hash)
+	require.NoDirExists(t, filepath.Join(path, ".git"))
+	b, err := os.ReadFile(filepath.Join(path, "default.bramble"))
+	require.NoError(t, err)
+	require.Contains(t, string(b), "def a()")
+
+	// Branches are resolved to a commit, and the locked commit is used after
+	// the branch moves on
+	dep.Rev = "HEAD"
+	_, headLock, err := dm.GitPackagePathOrDownload(ctx, "x.y/git", dep, config.GitLock{})
+	require.NoError(t, err)
+	require.Equal(t, second, headLock.Commit)
+	headLock.Commit = first
+	headLock.Hash = locked.Hash
+	path, _, err = dm.GitPackagePathOrDownload(ctx, "x.y/git", dep, headLock)
+	require.NoError(t, err)
+	require.Equal(t, dm.dir.join("src", "x.y/git@"+first), path)
+
+	// Commits aren't listed as registry versions
+	vs, err := dm.dir.localPackageVersions("x.y/git")
+	require.NoError(t, err)
+	require.Len(t, vs, 0)
+
+	// A fresh checkout must match the locked hash
+	dm = &Manager{dir: dir(t.TempDir())}
+	locked.Hash = "nope"
+	_, _, err = dm.GitPackagePathOrDownload(ctx, "x.y/git", config.Dependency{Git: "file://" + repo, Rev: first}, locked)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "bramble.lock")
+}
+
+func TestDMRegistries(t *testing.T) {
+	_, remoteDM := blogScenario(t)
+	_, emptyDM := testDepMgr(t)
+	ctx := context.Background()
+
+	var servers []string
+	for _, dm := range []*Manager{emptyDM, remoteDM} {
+		handler, err := ServerHandler(string(dm.dir), nil, nil, ServerOptions{})
+		require.NoError(t, err)
+		server := httptest.NewServer(handler)
+		defer server.Close()
+		servers = append(servers, server.URL)
+	}
+	empty, remote := servers[0], servers[1]
+
+	// Registries are tried in order until one has the package
+	_, localDM := testDepMgr(t)
+	localDM.registries = []config.Registry{{URL: empty}, {URL: remote}}
+	_, _, err := localDM.PackagePathOrDownload(ctx, types.Package{Name: "A", Version: "1.1.0"}, "")
+	require.NoError(t, err)
+	name, vs, err := localDM.FindPackageFromModuleName(ctx, "B")
+	require.NoError(t, err)
+	require.Equal(t, "B", name)
+	require.ElementsMatch(t, []string{"1.1.0", "1.2.0"}, vs)
+
+	// Packages that match a prefix are only fetched from that registry
+	_, localDM = testDepMgr(t)
+	localDM.registries = []config.Registry{{URL: empty, Prefixes: []string{"A"}}, {URL: remote}}
+	_, _, err = localDM.PackagePathOrDownload(ctx, types.Package{Name: "A", Version: "1.1.0"}, "")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "do you need to publish it?")
+	_, _, err = localDM.PackagePathOrDownload(ctx, types.Package{Name: "B", Version: "1.1.0"}, "")
+	require.NoError(t, err)
+}
@@ -1,20 +1,76 @@
 package dependency
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
-	"math/rand"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
 	"sync"
 	"time"
+
+	"github.com/maxmcd/bramble/internal/logger"
+	"github.com/maxmcd/bramble/pkg/httpx"
+	"github.com/maxmcd/bramble/pkg/metrics"
+	"github.com/pkg/errors"
+)
+
+var (
+	jobsQueued = metrics.NewGauge(
+		"bramble_publish_jobs_queued",
+		"Number of publish jobs waiting for a worker.")
+	jobsRunning = metrics.NewGauge(
+		"bramble_publish_jobs_running",
+		"Number of publish jobs that are running.")
+	jobsTotal = metrics.NewCounter(
+		"bramble_publish_jobs_total",
+		"Publish jobs that have finished, by result.",
+		"result")
+	jobDuration = metrics.NewHistogram(
+		"bramble_publish_job_duration_seconds",
+		"Time taken by publish jobs.",
+		[]float64{1, 5, 15, 30, 60, 120, 300, 600, 1800, 3600},
+		"result")
 )
 
+const (
+	// jobWorkers is the number of publish jobs that are run at once, other
+	// jobs wait in the queue
+	jobWorkers = 2
+	// maxFinishedJobs is the number of finished jobs that are kept
+	maxFinishedJobs = 1000
+)
+
+// errJobInterrupted is the error recorded for jobs that were running when the
+// server stopped.
+var errJobInterrupted = errors.New("job was interrupted by a server restart")
+
 type Job struct {
 	ID           string
+	Created      time.Time
 	Start        time.Time
 	End          time.Time
 	Error        string
-	ErrWithStack string
+	ErrWithStack string `json:",omitempty"`
 	Package      string
 	Reference    string
+	// Source is a directory of sources that were uploaded with the job. If it
+	// is set it is built instead of downloading Package.
+	Source string `json:",omitempty"`
+}
+
+// public returns a copy of the job without the error stack and the location of
+// its sources on the server, it's what the http endpoints return.
+func (job Job) public() Job {
+	job.ErrWithStack = ""
+	job.Source = ""
+	return job
 }
 
 type JobRequest struct {
@@ -25,39 +81,287 @@ type JobRequest struct {
 	Reference string
 }
 
+// jobQueue runs publish jobs with a fixed number of workers. Every change to a
+// job is written to a json file in dir so that jobs survive a restart, and the
+// output of each job is written to a log file next to it. When the queue is
+// loaded jobs that hadn't started are queued again and jobs that were running
+// are marked as failed.
 type jobQueue struct {
-	jobs map[string]*Job
+	dir string
+	run func(job *Job, logs io.Writer) error
+
+	lock    sync.Mutex
+	jobs    map[string]*Job
+	pending []string
+	notify  chan struct{}
+	// updated is closed and replaced whenever a job changes or writes logs
+	updated chan struct{}
+}
+
+func newJobQueue(dir string, workers int, run func(job *Job, logs io.Writer) error) (*jobQueue, error) {
+	jq := &jobQueue{
+		dir:     dir,
+		run:     run,
+		jobs:    map[string]*Job{},
+		notify:  make(chan struct{}, 1),
+		updated: make(chan struct{}),
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	if err := jq.load(); err != nil {
+		return nil, err
+	}
+	for i := 0; i < workers; i++ {
+		go jq.worker()
+	}
+	return jq, nil
+}
+
+func (jq *jobQueue) load() error {
+	entries, err := os.ReadDir(jq.dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(jq.dir, entry.Name()))
+		if err != nil {
+			return err
+		}
+		var job Job
+		if err := json.Unmarshal(b, &job); err != nil {
+			logger.Print("skipping unreadable job ", entry.Name(), ": ", err)
+			continue
+		}
+		jq.jobs[job.ID] = &job
+		switch {
+		case !job.End.IsZero():
+		case job.Start.IsZero():
+			jq.pending = append(jq.pending, job.ID)
+		default:
+			jq.finish(&job, errJobInterrupted)
+			removeJobSource(job)
+		}
+	}
+	// Run resumed jobs in the order they were created
+	sort.Slice(jq.pending, func(i, j int) bool {
+		return jq.jobs[jq.pending[i]].Created.Before(jq.jobs[jq.pending[j]].Created)
+	})
+	jobsQueued.With().Add(float64(len(jq.pending)))
+	if len(jq.pending) > 0 {
+		jq.wake()
+	}
+	return nil
+}
+
+func (jq *jobQueue) wake() {
+	select {
+	case jq.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (jq *jobQueue) worker() {
+	for range jq.notify {
+		for {
+			job := jq.next()
+			if job == nil {
+				break
+			}
+			err := jq.runJob(job)
+			jq.lock.Lock()
+			jq.finish(jq.jobs[job.ID], err)
+			jq.lock.Unlock()
+			removeJobSource(*job)
+		}
+	}
+}
+
+func (jq *jobQueue) runJob(job *Job) (err error) {
+	f, err := os.Create(jq.logPath(job.ID))
+	if err != nil {
+		return errors.Wrap(err, "error creating job log")
+	}
+	defer f.Close()
+	return jq.run(job, &jobLog{f: f, jq: jq})
+}
+
+func (jq *jobQueue) logPath(id string) string {
+	return filepath.Join(jq.dir, id+".log")
+}
+
+// broadcast wakes everyone waiting for a job update, the lock must be held.
+func (jq *jobQueue) broadcast() {
+	close(jq.updated)
+	jq.updated = make(chan struct{})
+}
+
+// jobLog writes job output to the log file and notifies followers.
+type jobLog struct {
 	lock sync.Mutex
+	f    *os.File
+	jq   *jobQueue
 }
 
-func (jq *jobQueue) AddJob(job *Job) {
-	jq.lock.Lock()
-	defer jq.lock.Unlock()
+func (jl *jobLog) Write(b []byte) (n int, err error) {
+	jl.lock.Lock()
+	n, err = jl.f.Write(b)
+	jl.lock.Unlock()
+	jl.jq.lock.Lock()
+	jl.jq.broadcast()
+	jl.jq.lock.Unlock()
+	return n, err
+}
 
+// FollowLogs calls fn with the job's logs as they are written until the job
+// finishes, and then returns the finished job.
+func (jq *jobQueue) FollowLogs(ctx context.Context, id string, fn func([]byte) error) (job Job, err error) {
+	var f *os.File
+	defer func() {
+		if f != nil {
+			f.Close()
+		}
+	}()
+	buf := make([]byte, 32*1024)
 	for {
-		// unique id
-		job.ID = fmt.Sprint(rand.Int())
-		if _, found := jq.jobs[job.ID]; !found {
-			break
+		jq.lock.Lock()
+		current, found := jq.jobs[id]
+		if found {
+			job = *current
+		}
+		updated := jq.updated
+		jq.lock.Unlock()
+		if !found {
+			return job, os.ErrNotExist
+		}
+		if f == nil && !job.Start.IsZero() {
+			if f, err = os.Open(jq.logPath(id)); err != nil && !os.IsNotExist(err) {
+				return job, err
+			}
+		}
+		// Read everything that has been written. If the job had finished
+		// before we started reading then this is all of the logs.
+		for f != nil {
+			n, err := f.Read(buf)
+			if n > 0 {
+				if err := fn(buf[:n]); err != nil {
+					return job, err
+				}
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return job, err
+			}
+		}
+		if !job.End.IsZero() {
+			return job, nil
+		}
+		select {
+		case <-ctx.Done():
+			return job, ctx.Err()
+		case <-updated:
 		}
 	}
-	job.Start = time.Now()
-	// Remove stale jobs from in-memory
-	if len(jq.jobs) > 100 {
-		jq.kickOldest()
-	}
-	jq.jobs[job.ID] = job
 }
 
-func (jq *jobQueue) End(id string, err error) {
+// next starts the next pending job and returns a copy of it, or nil if no
+// jobs are pending.
+func (jq *jobQueue) next() *Job {
 	jq.lock.Lock()
 	defer jq.lock.Unlock()
+	if len(jq.pending) == 0 {
+		return nil
+	}
+	id := jq.pending[0]
+	jq.pending = jq.pending[1:]
+	if len(jq.pending) > 0 {
+		// Let another worker pick up the rest
+		jq.wake()
+	}
 	job := jq.jobs[id]
+	job.Start = time.Now()
+	jq.save(job)
+	jq.broadcast()
+	jobsQueued.With().Add(-1)
+	jobsRunning.With().Add(1)
+	v := *job
+	return &v
+}
+
+// finish records the result of a job, the lock must be held.
+func (jq *jobQueue) finish(job *Job, err error) {
+	result := "success"
 	if err != nil {
 		job.Error = err.Error()
 		job.ErrWithStack = fmt.Sprintf("%+v", err)
+		result = "failure"
 	}
 	job.End = time.Now()
+	jq.save(job)
+	jq.broadcast()
+	if err != errJobInterrupted {
+		jobsRunning.With().Add(-1)
+		jobDuration.With(result).Observe(job.End.Sub(job.Start).Seconds())
+	}
+	jobsTotal.With(result).Inc()
+}
+
+// removeJobSource removes the uploaded sources of a finished job. It's called
+// without the lock so that other jobs can be looked up during the removal.
+func removeJobSource(job Job) {
+	if job.Source == "" {
+		return
+	}
+	if err := os.RemoveAll(job.Source); err != nil {
+		logger.Print("error removing job sources ", job.ID, ": ", err)
+	}
+}
+
+// save writes the job to disk, the lock must be held. Errors are logged so
+// that a full disk doesn't stop jobs from running.
+func (jq *jobQueue) save(job *Job) {
+	b, err := json.Marshal(job)
+	if err == nil {
+		path := filepath.Join(jq.dir, job.ID+".json")
+		if err = os.WriteFile(path+".tmp", b, 0644); err == nil {
+			err = os.Rename(path+".tmp", path)
+		}
+	}
+	if err != nil {
+		logger.Print("error saving job ", job.ID, ": ", err)
+	}
+}
+
+// newJobID returns a random job id. Ids can't be guessed, so only the client
+// that created a job can read its logs.
+func newJobID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrap(err, "error generating a job id")
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (jq *jobQueue) AddJob(job *Job) (err error) {
+	if job.ID, err = newJobID(); err != nil {
+		return err
+	}
+	jq.lock.Lock()
+	defer jq.lock.Unlock()
+
+	job.Created = time.Now()
+	jq.removeOldJobs()
+	jq.jobs[job.ID] = job
+	jq.pending = append(jq.pending, job.ID)
+	jq.save(job)
+	jobsQueued.With().Add(1)
+	jq.wake()
+	return nil
 }
 
 func (jq *jobQueue) Lookup(id string) *Job {
@@ -72,20 +376,101 @@ func (jq *jobQueue) Lookup(id string) *Job {
 	return nil
 }
 
-func (jq *jobQueue) kickOldest() {
-	oldest := time.Now()
-	id := ""
-	for i, j := range jq.jobs {
-		if j.End.IsZero() {
-			// Skip running jobs
-			continue
+// List returns copies of the most recently created jobs, newest first.
+func (jq *jobQueue) List(limit int) (jobs []Job) {
+	jq.lock.Lock()
+	defer jq.lock.Unlock()
+	for _, job := range jq.jobs {
+		jobs = append(jobs, *job)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].Created.After(jobs[j].Created) })
+	if limit > 0 && len(jobs) > limit {
+		jobs = jobs[:limit]
+	}
+	return jobs
+}
+
+// removeOldJobs deletes the oldest finished jobs when there are too many, the
+// lock must be held.
+func (jq *jobQueue) removeOldJobs() {
+	finished := []*Job{}
+	for _, job := range jq.jobs {
+		if !job.End.IsZero() {
+			finished = append(finished, job)
 		}
-		if j.Start.Before(oldest) {
-			oldest = j.Start
-			id = i
+	}
+	if len(finished) < maxFinishedJobs {
+		return
+	}
+	sort.Slice(finished, func(i, j int) bool { return finished[i].Created.Before(finished[j].Created) })
+	for _, job := range finished[:len(finished)-maxFinishedJobs+1] {
+		delete(jq.jobs, job.ID)
+		for _, path := range []string{filepath.Join(jq.dir, job.ID+".json"), jq.logPath(job.ID)} {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				logger.Print("error removing job ", job.ID, ": ", err)
+			}
 		}
 	}
-	delete(jq.jobs, id)
 }
 
-var jq = &jobQueue{jobs: map[string]*Job{}}
+// streamJobLogs sends the job's logs as server-sent events. Each line of output
+// is a "log" event and once the job finishes an "end" event is sent with the
+// job as json.
+func streamJobLogs(c httpx.Context, jq *jobQueue, id string) error {
+	rw := c.ResponseWriter
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+	flush := func() {
+		if f, ok := rw.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+	writeEvent := func(event string, data []byte) error {
+		_, err := fmt.Fprintf(rw, "event: %s\ndata: %s\n\n", event, data)
+		return err
+	}
+	writeLine := func(line []byte) error {
+		// Carriage returns would end the data line early
+		for _, part := range bytes.Split(bytes.TrimSuffix(line, []byte("\r")), []byte("\r")) {
+			if err := writeEvent("log", part); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	flush()
+
+	var partial []byte
+	job, err := jq.FollowLogs(c.Request.Context(), id, func(b []byte) error {
+		partial = append(partial, b...)
+		for {
+			i := bytes.IndexByte(partial, '\n')
+			if i < 0 {
+				break
+			}
+			if err := writeLine(partial[:i]); err != nil {
+				return err
+			}
+			partial = partial[i+1:]
+		}
+		flush()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(partial) > 0 {
+		if err := writeLine(partial); err != nil {
+			return err
+		}
+	}
+	b, err := json.Marshal(job.public())
+	if err != nil {
+		return err
+	}
+	if err := writeEvent("end", b); err != nil {
+		return err
+	}
+	flush()
+	return nil
+}
@@ -0,0 +1,140 @@
+package dependency
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func waitForJob(t *testing.T, jq *jobQueue, id string) Job {
+	for i := 0; i < 500; i++ {
+		if job := jq.Lookup(id); !job.End.IsZero() {
+			return *job
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Fatalf("job %s didn't finish", id)
+	return Job{}
+}
+
+func TestJobQueueWorkers(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan string, 10)
+	jq, err := newJobQueue(t.TempDir(), 1, func(job *Job, logs io.Writer) error {
+		started <- job.ID
+		<-release
+		return nil
+	})
+	require.NoError(t, err)
+
+	jobs := []*Job{{Package: "a"}, {Package: "b"}, {Package: "c"}}
+	for _, job := range jobs {
+		require.NoError(t, jq.AddJob(job))
+	}
+	require.Equal(t, jobs[0].ID, <-started)
+	select {
+	case id := <-started:
+		t.Fatalf("job %s started while the only worker was busy", id)
+	case <-time.After(time.Millisecond * 50):
+	}
+	require.True(t, jq.Lookup(jobs[1].ID).Start.IsZero())
+
+	close(release)
+	ids := map[string]bool{}
+	for _, job := range jobs {
+		require.Empty(t, waitForJob(t, jq, job.ID).Error)
+		// Ids are random so that they can't be guessed
+		require.Regexp(t, "^[0-9a-f]{32}$", job.ID)
+		ids[job.ID] = true
+	}
+	require.Len(t, ids, len(jobs))
+
+	list := jq.List(2)
+	require.Len(t, list, 2)
+	require.Equal(t, jobs[2].ID, list[0].ID)
+}
+
+func TestJobQueueRestart(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	for _, job := range []Job{
+		{ID: "queued", Package: "a", Created: now},
+		{ID: "running", Package: "b", Created: now, Start: now},
+		{ID: "done", Package: "c", Created: now, Start: now, End: now},
+	} {
+		b, err := json.Marshal(job)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(dir, job.ID+".json"), b, 0644))
+	}
+
+	ran := make(chan string, 10)
+	jq, err := newJobQueue(dir, 2, func(job *Job, logs io.Writer) error {
+		ran <- job.ID
+		return nil
+	})
+	require.NoError(t, err)
+
+	require.Empty(t, waitForJob(t, jq, "queued").Error)
+	require.Equal(t, "queued", <-ran)
+	require.Equal(t, errJobInterrupted.Error(), jq.Lookup("running").Error)
+	require.Equal(t, now.Unix(), jq.Lookup("done").End.Unix())
+	require.Len(t, ran, 0)
+
+	// The results are persisted
+	b, err := os.ReadFile(filepath.Join(dir, "running.json"))
+	require.NoError(t, err)
+	var job Job
+	require.NoError(t, json.Unmarshal(b, &job))
+	require.Equal(t, errJobInterrupted.Error(), job.Error)
+}
+
+func TestJobQueueFollowLogs(t *testing.T) {
+	release := make(chan struct{})
+	jq, err := newJobQueue(t.TempDir(), 1, func(job *Job, logs io.Writer) error {
+		fmt.Fprintln(logs, "first")
+		<-release
+		fmt.Fprint(logs, "second")
+		return fmt.Errorf("failed")
+	})
+	require.NoError(t, err)
+	job := &Job{Package: "a"}
+	require.NoError(t, jq.AddJob(job))
+
+	var logs bytes.Buffer
+	done := make(chan struct{})
+	var followed Job
+	go func() {
+		defer close(done)
+		followed, err = jq.FollowLogs(context.Background(), job.ID, func(b []byte) error {
+			_, _ = logs.Write(b)
+			if logs.String() == "first\n" {
+				close(release)
+			}
+			return nil
+		})
+	}()
+	<-done
+	require.NoError(t, err)
+	require.Equal(t, "first\nsecond", logs.String())
+	require.Equal(t, "failed", followed.Error)
+
+	// Following a finished job returns all of its logs
+	logs.Reset()
+	_, err = jq.FollowLogs(context.Background(), job.ID, func(b []byte) error {
+		_, _ = logs.Write(b)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, "first\nsecond", logs.String())
+
+	_, err = jq.FollowLogs(context.Background(), "missing", nil)
+	require.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,47 @@
+// Package offline tracks whether bramble is running in offline mode. When
+// offline, anything that would access the network fails with ErrOffline so that
+// builds can only use what is already in the store, the downloaded dependencies
+// and the lockfile.
+package offline
+
+import (
+	"os"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// ErrOffline is returned, wrapped, by anything that needs the network while in
+// offline mode.
+var ErrOffline = errors.New("network access is disabled in offline mode")
+
+var enabled int32
+
+// Enable turns on offline mode for the rest of the process.
+func Enable() {
+	atomic.StoreInt32(&enabled, 1)
+}
+
+// Enabled returns true if Enable has been called or if the BRAMBLE_OFFLINE
+// environment variable is set to a true value.
+func Enabled() bool {
+	if atomic.LoadInt32(&enabled) == 1 {
+		return true
+	}
+	v, _ := strconv.ParseBool(os.Getenv("BRAMBLE_OFFLINE"))
+	return v
+}
+
+// Check returns an error describing the action if offline mode is enabled.
+func Check(format string, args ...interface{}) error {
+	if !Enabled() {
+		return nil
+	}
+	return errors.Wrapf(ErrOffline, format, args...)
+}
+
+// Is reports whether err was caused by offline mode.
+func Is(err error) bool {
+	return errors.Cause(err) == ErrOffline
+}
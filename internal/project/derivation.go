@@ -19,6 +19,7 @@ import (
 var (
 	derivationTemplate                      = "{{ %s:%s }}"
 	derivationTemplateRegexp *regexp.Regexp = regexp.MustCompile(`\{\{ ([0-9a-z]{32}):(.+?) \}\}`)
+	outputHashRegexp                        = regexp.MustCompile(`^[0-9a-z]{32}$`)
 )
 
 func init() {
@@ -56,7 +57,11 @@ type Derivation struct {
 
 	Name    string
 	Network bool `json:",omitempty"`
-	Outputs []string
+	// OutputHash is the expected hash of the output of a derivation that
+	// uses the network. If it's empty the hash is recorded in the lockfile
+	// under the derivation name on the first build and checked after that.
+	OutputHash string `json:",omitempty"`
+	Outputs    []string
 
 	Platform string
 
@@ -222,12 +227,12 @@ func (rt *runtime) newDerivationFromArgs(args starlark.Tuple, kwargs []starlark.
 		Outputs: []string{"out"},
 	}
 	var (
-		name        starlark.String
-		builder     starlark.String
-		argsParam   *starlark.List
-		env         *starlark.Dict
-		outputs     *starlark.List
-		internalKey starlark.Int
+		name       starlark.String
+		builder    starlark.String
+		argsParam  *starlark.List
+		env        *starlark.Dict
+		outputs    *starlark.List
+		outputHash starlark.String
 	)
 	if err = starlark.UnpackArgs("derivation", args, kwargs,
 		"name", &name,
@@ -238,7 +243,7 @@ func (rt *runtime) newDerivationFromArgs(args starlark.Tuple, kwargs []starlark.
 		"outputs?", &outputs,
 		"target?", &drv.Platform,
 		"network?", &drv.Network,
-		"_internal_key?", &internalKey,
+		"output_hash?", &outputHash,
 	); err != nil {
 		return
 	}
@@ -248,10 +253,6 @@ func (rt *runtime) newDerivationFromArgs(args starlark.Tuple, kwargs []starlark.
 	if drv.Platform == drv.Target {
 		drv.Target = ""
 	}
-	if (rt.internalKey != internalKey.BigInt().Int64()) && drv.Network {
-		return drv, errors.New("derivations aren't allowed to use the network")
-	}
-
 	drv.Name = name.GoString()
 	if len(drv.Name) == 0 {
 		return drv, errors.New("derivation must have a name")
@@ -287,6 +288,16 @@ func (rt *runtime) newDerivationFromArgs(args starlark.Tuple, kwargs []starlark.
 		drv.Outputs = outputsList
 	}
 
+	// Derivations that use the network are fixed-output derivations, their
+	// output is checked against the output hash or the lockfile
+	drv.OutputHash = outputHash.GoString()
+	if drv.OutputHash != "" && !outputHashRegexp.MatchString(drv.OutputHash) {
+		return drv, errors.Errorf("output_hash %q doesn't look like the hash of a store path", drv.OutputHash)
+	}
+	if (drv.Network || drv.OutputHash != "") && (len(drv.Outputs) != 1 || drv.Outputs[0] != "out") {
+		return drv, errors.New("derivations with a fixed output can only have the default output \"out\"")
+	}
+
 	// TODO: valide that the builder is either a built-in or looks like a real
 	// builder?
 	drv.Builder = builder.GoString()
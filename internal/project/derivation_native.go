@@ -15,8 +15,7 @@ var derivationModule string
 // idempotent.
 func (rt *runtime) loadNativeDerivation(derivation starlark.Value) (starlark.Value, error) {
 	predeclared := starlark.StringDict{
-		"_derivation":  derivation,
-		"internal_key": starlark.MakeInt64(rt.internalKey),
+		"_derivation": derivation,
 	}
 
 	thread := new(starlark.Thread)
@@ -21,10 +21,16 @@ foo()
 		},
 		{script: tofn(`derivation("hi","hi", outputs=["hi", "ho"])`)},
 		{script: tofn(`derivation("hi","hi", outputs=[{}])`), errContains: "cast type"},
-		{script: tofn(`derivation("hi","hi", network=True)`), errContains: "use the network"},
+		{script: tofn(`derivation("hi","hi", network=True)`)},
+		{script: tofn(`derivation("hi","hi", network=True, output_hash="uw5ichj6dhcccmcts6p7jq6etzlh5baf")`)},
+		{script: tofn(`derivation("hi","hi", network=True, output_hash="sha256")`), errContains: "doesn't look like"},
+		{script: tofn(`derivation("hi","hi", network=True, output_hash="uw5ichj6dhcccmcts6p7jq6etzlh5baf", outputs=["hi", "ho"])`), errContains: "default output"},
 		{script: tofn(`derivation("","hi")`), errContains: "must have a name"},
 		{script: tofn(`derivation("hi","hi", outputs=[])`), errContains: "at least 1 value"},
 		{script: tofn("derivation()"), errContains: "missing"},
+		{script: tofn(`derivation("a", "fetch_url", env={"url": "a"}, outputs=["hi"])`), errContains: "doesn't support outputs"},
+		{script: tofn(`derivation("a", "fetch_git", env={"url": "a"}, network=True, args=[])`), errContains: "doesn't support args, network"},
+		{script: tofn(`derivation("a", "fetch_url", env={"url": "a"})`)},
 		{
 			script: `
 def foo():
@@ -0,0 +1,93 @@
+package project
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+
+	"github.com/maxmcd/bramble/internal/config"
+	"github.com/pkg/errors"
+)
+
+// EphemeralPackage is the package name of ephemeral projects
+const EphemeralPackage = "bramble.ephemeral"
+
+// NewEphemeralProject creates a project in dir that has no dependencies. It's
+// used to build published packages outside of a project, wd is used as the
+// working directory but nothing is written to it.
+func NewEphemeralProject(wd, dir string) (p *Project, err error) {
+	absWD, err := filepath.Abs(wd)
+	if err != nil {
+		return nil, errors.Wrapf(err, "can't convert relative working directory path %q to absolute path", wd)
+	}
+	p = &Project{
+		config: config.Config{
+			Package:      config.Package{Name: EphemeralPackage, Version: "0.0.0"},
+			Dependencies: map[string]config.Dependency{},
+		},
+		location:  dir,
+		wd:        absWD,
+		lockFile:  &config.LockFile{},
+		ephemeral: true,
+	}
+	return p, p.writeConfig(p.config)
+}
+
+// Ephemeral returns true if the project was created with NewEphemeralProject
+func (p *Project) Ephemeral() bool {
+	return p.ephemeral
+}
+
+// RequireModules adds the packages of module arguments like
+// "github.com/maxmcd/busybox@0.0.1:busybox" to an ephemeral project along with
+// their build list. Packages without a version are added at their newest
+// version. The arguments are returned without their versions.
+func (p *Project) RequireModules(ctx context.Context, args []string) (out []string, err error) {
+	if !p.ephemeral {
+		return nil, errors.New("modules can only be required by an ephemeral project")
+	}
+	cfg := p.config
+	cfg.Dependencies = map[string]config.Dependency{}
+	requested := map[string]config.Dependency{}
+	for _, arg := range args {
+		module, function := arg, ""
+		if i := strings.LastIndex(arg, ":"); i != -1 {
+			module, function = arg[:i], arg[i:]
+		}
+		if strings.HasPrefix(module, ".") || strings.HasSuffix(module, "/...") {
+			return nil, errors.Errorf("can't build %q outside of a project, only published modules can be built", arg)
+		}
+		version := ""
+		if i := strings.LastIndex(module, "@"); i != -1 {
+			module, version = module[:i], module[i+1:]
+		}
+		name, _, err := p.dm.FindPackageFromModuleName(ctx, module)
+		if err != nil {
+			return nil, err
+		}
+		if version == "" {
+			if version, err = p.dm.LatestVersion(ctx, name); err != nil {
+				return nil, err
+			}
+		}
+		if existing, found := cfg.Dependencies[name]; found && existing.Version != version {
+			return nil, errors.Errorf("package %s is required at both %s and %s", name, existing.Version, version)
+		}
+		cfg.Dependencies[name] = config.Dependency{Version: version}
+		requested[name] = cfg.Dependencies[name]
+		out = append(out, module+function)
+	}
+	if cfg, err = p.dm.CalculateConfigBuildlist(cfg); err != nil {
+		return nil, err
+	}
+	// Each required version must be selected, a newer version could otherwise
+	// be picked because another package requires it
+	for name, dep := range requested {
+		if selected := cfg.Dependencies[name].Version; selected != dep.Version {
+			return nil, errors.Errorf("package %s@%s was requested but %s is required by another package",
+				name, dep.Version, selected)
+		}
+	}
+	p.config = cfg
+	return out, p.writeConfig(cfg)
+}
@@ -0,0 +1,65 @@
+package project
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/maxmcd/bramble/internal/config"
+	"github.com/maxmcd/bramble/internal/dependency"
+	"github.com/maxmcd/bramble/pkg/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProject_RequireModules(t *testing.T) {
+	dependencyDir := t.TempDir()
+	for _, pkg := range []struct {
+		name, version string
+		deps          map[string]config.Dependency
+	}{
+		{"x.y/a", "1.0.0", map[string]config.Dependency{"x.y/b": {Version: "1.0.0"}}},
+		{"x.y/a", "1.1.0", nil},
+		{"x.y/b", "1.0.0", nil},
+	} {
+		src := filepath.Join(dependencyDir, "src", pkg.name+"@"+pkg.version)
+		writeTestConfig(t, src, pkg.name, pkg.version, pkg.deps)
+		require.NoError(t, os.MkdirAll(filepath.Join(src, "lib"), 0755))
+		test.WriteFile(t, filepath.Join(src, "lib", "default.bramble"), "def fn():\n    pass\n")
+	}
+	ctx := context.Background()
+	wd := t.TempDir()
+	newProject := func() *Project {
+		p, err := NewEphemeralProject(wd, t.TempDir())
+		require.NoError(t, err)
+		p.AddModuleFetcher(dependency.NewManager(dependencyDir, nil))
+		return p
+	}
+
+	p := newProject()
+	args, err := p.RequireModules(ctx, []string{"x.y/a/lib@1.0.0:fn"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"x.y/a/lib:fn"}, args)
+	assert.Equal(t, map[string]config.Dependency{
+		"x.y/a": {Version: "1.0.0"},
+		"x.y/b": {Version: "1.0.0"},
+	}, p.Config().Dependencies)
+	module, err := p.ParseModuleFuncArgument(ctx, args[0], false)
+	require.NoError(t, err)
+	assert.Equal(t, Module{Name: "x.y/a/lib", Function: "fn"}, module)
+
+	// The newest version is used without a version
+	p = newProject()
+	_, err = p.RequireModules(ctx, []string{"x.y/a/lib:fn"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]config.Dependency{"x.y/a": {Version: "1.1.0"}}, p.Config().Dependencies)
+
+	_, err = newProject().RequireModules(ctx, []string{"./..."})
+	require.Error(t, err)
+
+	// Nothing is written to the working directory
+	entries, err := os.ReadDir(wd)
+	require.NoError(t, err)
+	assert.Len(t, entries, 0)
+}
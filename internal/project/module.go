@@ -75,7 +75,9 @@ func (p *Project) ArgumentsToModules(ctx context.Context, args []string, allowEx
 	for _, arg := range args {
 		if idx := strings.Index(arg, "/..."); idx != -1 {
 			arg = arg[:idx]
-			if strings.HasPrefix(arg, p.config.Package.Name) {
+			if name, location, found := p.workspaceMember(arg); found {
+				arg = filepath.Join(location, strings.TrimPrefix(arg, name))
+			} else if strings.HasPrefix(arg, p.config.Package.Name) {
 				arg = "." + strings.TrimPrefix(arg, p.config.Package.Name)
 			}
 			ms, err := p.FindAllModules(arg)
@@ -122,30 +124,96 @@ func (p *Project) scanForLoadNames() (moduleNames []string, err error) {
 
 // TODO: function that takes load() argument values and references the config and pulls down the needed version
 func (p *Project) findOrDownloadModulePath(ctx context.Context, module string) (path string, err error) {
+	if name, location, found := p.pathOverride(module); found {
+		return filepath.Join(location, module[len(name):]), nil
+	}
 	if strings.HasPrefix(module, p.config.Package.Name) {
 		path = module[len(p.config.Package.Name):]
 		path = filepath.Join(p.location, path)
 		return path, nil
 	}
-	cd, found := p.config.Dependencies[module]
-	if !found {
+	dep := p.config.LoadValueToDependency(module)
+	if dep == "" {
 		return "", errors.Errorf("%q is not a dependency of this project, do you need to add it?", module)
 	}
-	if cd.Path != "" {
-		// TODO: Does this actually work
-		// TODO: cd.Path must be relative?
-		return filepath.Join(p.location, cd.Path), nil
+	if path, err = p.findOrDownloadPackagePath(ctx, dep); err != nil {
+		return "", err
+	}
+	return filepath.Join(path, module[len(dep):]), nil
+}
+
+// findOrDownloadPackagePath returns the location of a dependency's source
+func (p *Project) findOrDownloadPackagePath(ctx context.Context, module string) (path string, err error) {
+	cd := p.config.Dependencies[module]
+	if path, found := p.vendoredModulePath(module, cd); found {
+		return path, p.verifyVendoredModule(module, cd, path)
+	}
+	if cd.Git != "" {
+		locked, _ := p.lockFile.LookupGitDependency(module)
+		path, locked, err = p.dm.GitPackagePathOrDownload(ctx, module, cd, locked)
+		if err != nil {
+			return "", err
+		}
+		p.lockFile.SetGitDependency(module, locked)
+		return path, nil
+	}
+	pkg := types.Package{Name: module, Version: cd.Version}
+	expectedHash, _ := p.lockFile.LookupPackageHash(pkg.String())
+	path, hash, err := p.dm.PackagePathOrDownload(ctx, pkg, expectedHash)
+	if err != nil {
+		return "", err
 	}
-	path, err = p.dm.PackagePathOrDownload(ctx, types.Package{Name: module, Version: cd.Version})
-	return path, err
+	return path, p.lockFile.AddPackageHash(pkg.String(), hash)
+}
+
+// verifyVendoredModule checks that a vendored dependency matches the hash in
+// the lockfile, or records its hash if there isn't one.
+func (p *Project) verifyVendoredModule(module string, cd config.Dependency, path string) (err error) {
+	if cd.Git != "" {
+		// vendoredModulePath only finds git dependencies that are locked
+		locked, _ := p.lockFile.LookupGitDependency(module)
+		_, err := p.dm.VerifySource(module+"@"+locked.Commit, path, locked.Hash)
+		return err
+	}
+	pkg := types.Package{Name: module, Version: cd.Version}.String()
+	expectedHash, _ := p.lockFile.LookupPackageHash(pkg)
+	hash, err := p.dm.VerifySource(pkg, path, expectedHash)
+	if err != nil {
+		return err
+	}
+	return p.lockFile.AddPackageHash(pkg, hash)
+}
+
+// vendoredModuleName returns the name of the dependency's directory in
+// VendorDirectory, git dependencies are named with their locked commit.
+func (p *Project) vendoredModuleName(module string, cd config.Dependency) (name string, found bool) {
+	if cd.Git == "" {
+		return module + "@" + cd.Version, true
+	}
+	locked, found := p.lockFile.LookupGitDependency(module)
+	if !found || locked.Git != cd.Git || locked.Rev != cd.Rev {
+		return "", false
+	}
+	return module + "@" + locked.Commit, true
+}
+
+func (p *Project) vendoredModulePath(module string, cd config.Dependency) (path string, found bool) {
+	name, found := p.vendoredModuleName(module, cd)
+	if !found {
+		return "", false
+	}
+	path = filepath.Join(p.location, VendorDirectory, name)
+	return path, fileutil.DirExists(path)
 }
 
 func (p *Project) moduleInProject(module string) bool {
 	if strings.HasPrefix(module, p.config.Package.Name) {
 		return true
 	}
-	_, found := p.config.Dependencies[module]
-	return found
+	if _, _, found := p.pathOverride(module); found {
+		return true
+	}
+	return p.config.LoadValueToDependency(module) != ""
 }
 
 func (p *Project) filepathToModuleName(path string) (module string, err error) {
@@ -155,9 +223,10 @@ func (p *Project) filepathToModuleName(path string) (module string, err error) {
 	if !fileutil.FileExists(path) {
 		return "", errors.Wrap(os.ErrNotExist, path)
 	}
-	rel, err := filepath.Rel(p.location, path)
+	name, location := p.packageForPath(path)
+	rel, err := filepath.Rel(location, path)
 	if err != nil {
-		return "", errors.Wrapf(err, "%q is not relative to the project directory %q", path, p.location)
+		return "", errors.Wrapf(err, "%q is not relative to the project directory %q", path, location)
 	}
 	if strings.HasSuffix(path, "default"+BrambleExtension) {
 		rel = strings.TrimSuffix(rel, "default"+BrambleExtension)
@@ -165,7 +234,7 @@ func (p *Project) filepathToModuleName(path string) (module string, err error) {
 		rel = strings.TrimSuffix(rel, BrambleExtension)
 	}
 	rel = strings.TrimSuffix(rel, "/")
-	return p.config.Package.Name + "/" + rel, nil
+	return name + "/" + rel, nil
 }
 
 func (p *Project) ParseModuleFuncArgument(ctx context.Context, name string, allowExternal bool) (module Module, err error) {
@@ -194,14 +263,17 @@ func (p *Project) ParseModuleFuncArgument(ctx context.Context, name string, allo
 		}
 		return module, nil
 	} else if allowExternal {
-		name, versions, err := p.dm.FindPackageFromModuleName(ctx, module.Name)
+		name, _, err := p.dm.FindPackageFromModuleName(ctx, module.Name)
+		if err != nil {
+			return Module{}, err
+		}
+		version, err := p.dm.LatestVersion(ctx, name)
 		if err != nil {
 			return Module{}, err
 		}
-		// TODO: pick newest version
-		p.config.Dependencies[name] = config.Dependency{Version: versions[0]}
+		p.config.Dependencies[name] = config.Dependency{Version: version}
 		if err := p.writeConfig(p.config); err != nil {
-			return Module{}, errors.Wrapf(err, "error saving config with new package: %s", types.Package{Name: name, Version: versions[0]})
+			return Module{}, errors.Wrapf(err, "error saving config with new package: %s", types.Package{Name: name, Version: version})
 		}
 		module.Name = name
 		return module, nil
@@ -3,9 +3,11 @@ package project
 
 import (
 	"context"
+	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/maxmcd/bramble/internal/config"
@@ -15,10 +17,15 @@ import (
 	"github.com/maxmcd/bramble/pkg/fileutil"
 	"github.com/maxmcd/bramble/pkg/fxt"
 	"github.com/pkg/errors"
+	"golang.org/x/mod/semver"
 )
 
 const BrambleExtension = ".bramble"
 
+// VendorDirectory is the directory in a project that dependencies are vendored
+// into with "bramble mod vendor".
+const VendorDirectory = "bramble_vendor"
+
 var (
 	ErrNotInProject = errors.New("couldn't find a bramble.toml file in this directory or any parent")
 	tracer          = tracing.Tracer("project")
@@ -34,6 +41,14 @@ type Project struct {
 
 	lockFile *config.LockFile
 
+	// members are the locations of the projects in this project's workspace,
+	// keyed by package name
+	members map[string]string
+
+	// ephemeral projects are created in a temporary directory to build
+	// packages outside of a project
+	ephemeral bool
+
 	dm *dependency.Manager
 }
 
@@ -52,8 +67,13 @@ func NewProject(wd string) (p *Project, err error) {
 		location: location,
 		wd:       absWD,
 	}
-	p.config, p.lockFile, err = config.ReadConfigs(location)
-	return p, err
+	if p.config, p.lockFile, err = config.ReadConfigs(location); err != nil {
+		return p, err
+	}
+	if p.members, err = findWorkspace(location); err != nil {
+		return p, err
+	}
+	return p, p.resolvePathDependencies()
 }
 
 func findConfig(wd string) (found bool, location string) {
@@ -77,6 +97,9 @@ func (p *Project) LockfileWriter() types.LockfileWriter {
 
 func (p *Project) AddModuleFetcher(dm *dependency.Manager) {
 	p.dm = dm
+	for name, location := range p.pathOverrides() {
+		dm.AddPathOverride(name, location)
+	}
 }
 
 func (p *Project) Location() string {
@@ -118,6 +141,38 @@ func (p *Project) URLHashes() map[string]string {
 	return p.lockFile.URLHashes
 }
 
+// RemoveURLHash removes a url hash from the lockfile, the lockfile on disk is
+// updated by WriteLockfile
+func (p *Project) RemoveURLHash(key string) {
+	p.lockFile.RemoveEntry(key)
+}
+
+// PruneDependencyHashes removes the lockfile entries of dependencies that
+// aren't in the build list, the lockfile on disk is updated by WriteLockfile.
+// The removed entries are returned as "name@version" or "name (git)".
+func (p *Project) PruneDependencyHashes() (removed []string) {
+	packages := map[string]bool{}
+	for name, cd := range p.config.Dependencies {
+		if cd.Git == "" {
+			packages[types.Package{Name: name, Version: cd.Version}.String()] = true
+		}
+	}
+	for pkg := range p.lockFile.PackageHashes {
+		if !packages[pkg] {
+			p.lockFile.RemovePackageHash(pkg)
+			removed = append(removed, pkg)
+		}
+	}
+	for name := range p.lockFile.GitDependencies {
+		if cd, found := p.config.Dependencies[name]; !found || cd.Git == "" {
+			p.lockFile.RemoveGitDependency(name)
+			removed = append(removed, name+" (git)")
+		}
+	}
+	sort.Strings(removed)
+	return removed
+}
+
 func (p *Project) WriteLockfile() error {
 	return config.WriteLockfile(p.lockFile, p.location)
 }
@@ -128,7 +183,9 @@ func (p *Project) findAllBramblefiles(path string) (files []string, err error) {
 		return nil, err
 	}
 	if err := fileutil.PathWithinDir(p.location, path); err != nil {
-		return nil, err
+		if _, location := p.packageForPath(path); location == p.location {
+			return nil, err
+		}
 	}
 	return files, filepath.WalkDir(
 		path,
@@ -136,7 +193,9 @@ func (p *Project) findAllBramblefiles(path string) (files []string, err error) {
 			if err != nil {
 				return err
 			}
-			if path != p.location && d.IsDir() && fileutil.FileExists(filepath.Join(path, "bramble.toml")) {
+			// Nested projects are skipped unless they're in the workspace
+			if path != p.location && d.IsDir() && !p.isMember(path) &&
+				fileutil.FileExists(filepath.Join(path, "bramble.toml")) {
 				return fs.SkipDir
 			}
 
@@ -149,28 +208,131 @@ func (p *Project) findAllBramblefiles(path string) (files []string, err error) {
 	)
 }
 
-func (p *Project) CalculateDependencies() (err error) {
+// Tidy makes the dependencies in bramble.toml match the load() statements in
+// the project. Loads that don't match a dependency are resolved to a package
+// and added at its newest version, dependencies that nothing loads are removed
+// and the build list is recalculated.
+func (p *Project) Tidy(ctx context.Context) (err error) {
 	names, err := p.scanForLoadNames()
 	if err != nil {
 		return errors.Wrap(err, "error scanning for load statements")
 	}
+	cfg := p.config
+	cfg.Dependencies = map[string]config.Dependency{}
+	for _, name := range names {
+		if pkg, location, found := p.pathOverride(name); found {
+			if cd, found := p.config.Dependencies[pkg]; found {
+				cfg.Dependencies[pkg] = cd
+			} else if cfg.Dependencies[pkg], err = p.workspaceDependency(location); err != nil {
+				return err
+			}
+			continue
+		}
+		if strings.HasPrefix(name, p.config.Package.Name) {
+			continue
+		}
+		if dep := p.config.LoadValueToDependency(name); dep != "" {
+			cfg.Dependencies[dep] = p.config.Dependencies[dep]
+			continue
+		}
+		pkg, _, err := p.dm.FindPackageFromModuleName(ctx, name)
+		if err != nil {
+			return err
+		}
+		if _, found := cfg.Dependencies[pkg]; found {
+			continue
+		}
+		version, err := p.dm.LatestVersion(ctx, pkg)
+		if err != nil {
+			return err
+		}
+		cfg.Dependencies[pkg] = config.Dependency{Version: version}
+	}
+	if cfg, err = p.dm.CalculateConfigBuildlist(cfg); err != nil {
+		return err
+	}
 
-	if len(names) == 0 {
-		return nil
+	// Keep dependencies that were upgraded past the version that the build list
+	// requires at their upgraded version
+	raised := false
+	for name, dep := range cfg.Dependencies {
+		old, found := p.config.Dependencies[name]
+		if found && old.Git == "" && dep.Git == "" &&
+			semver.Compare("v"+old.Version, "v"+dep.Version) > 0 {
+			cfg.Dependencies[name] = old
+			raised = true
+		}
 	}
-	external := []string{}
-	for _, name := range names {
-		if v := p.config.LoadValueToDependency(name); v == "" {
-			external = append(external, name)
+	if raised {
+		if cfg, err = p.dm.CalculateConfigBuildlist(cfg); err != nil {
+			return err
 		}
 	}
-	if len(external) == 0 {
-		return nil
+	return p.replaceConfig(cfg)
+}
+
+// Vendor copies the source of every dependency into the project's
+// VendorDirectory, replacing anything that was vendored before. Vendored
+// dependencies are used instead of fetching them. Path dependencies and
+// workspace members aren't vendored.
+func (p *Project) Vendor(ctx context.Context) (err error) {
+	tmp, err := os.MkdirTemp(p.location, "."+VendorDirectory+"-")
+	if err != nil {
+		return err
 	}
+	defer os.RemoveAll(tmp)
+	overrides := p.pathOverrides()
+	for module, cd := range p.config.Dependencies {
+		if _, found := overrides[module]; found {
+			continue
+		}
+		path, err := p.findOrDownloadModulePath(ctx, module)
+		if err != nil {
+			return err
+		}
+		name, _ := p.vendoredModuleName(module, cd)
+		dest := filepath.Join(tmp, name)
+		if err := os.MkdirAll(dest, 0755); err != nil {
+			return err
+		}
+		if err := fileutil.CopyDirectory(path, dest); err != nil {
+			return errors.Wrapf(err, "error vendoring %s", name)
+		}
+	}
+	vendor := filepath.Join(p.location, VendorDirectory)
+	if err := os.RemoveAll(vendor); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, vendor); err != nil {
+		return err
+	}
+	return p.WriteLockfile()
+}
 
-	fxt.Printqln(external)
+// PrintRequirementGraph prints every requirement in the project's module
+// graph, one "module@version requirement@version" pair per line.
+func (p *Project) PrintRequirementGraph(w io.Writer) (err error) {
+	graph, _, err := p.dm.RequirementGraph(p.config)
+	if err != nil {
+		return err
+	}
+	for _, r := range graph {
+		fxt.Fprintfln(w, "%s %s", r.From, r.To)
+	}
+	return nil
+}
 
-	// TODO: lots of magic to navigate here, do it sometime
+// PrintRequirementChain prints the shortest chain of requirements from the
+// project to the selected version of a dependency.
+func (p *Project) PrintRequirementChain(w io.Writer, name string) (err error) {
+	chain, err := p.dm.RequirementChain(p.config, name)
+	if err != nil {
+		return err
+	}
+	fxt.Fprintfln(w, "# %s", chain[len(chain)-1])
+	for _, pkg := range chain {
+		fxt.Fprintfln(w, "%s", pkg)
+	}
 	return nil
 }
 
@@ -192,6 +354,61 @@ func (p *Project) AddDependency(v types.Package) (err error) {
 	return p.writeConfig(cfg)
 }
 
+// UpdateDependencies upgrades dependencies to the newest versions with the same
+// major version and rewrites bramble.toml. All dependencies are upgraded if no
+// packages are passed.
+func (p *Project) UpdateDependencies(pkgs ...string) (err error) {
+	cfg, err := p.dm.UpgradeConfig(p.config, pkgs...)
+	if err != nil {
+		return err
+	}
+	return p.replaceConfig(cfg)
+}
+
+// DowngradeDependency downgrades a dependency, and any dependencies that
+// require a newer version of it, and rewrites bramble.toml.
+func (p *Project) DowngradeDependency(pkg types.Package) (err error) {
+	cfg, err := p.dm.DowngradeConfig(p.config, pkg)
+	if err != nil {
+		return err
+	}
+	return p.replaceConfig(cfg)
+}
+
+func (p *Project) replaceConfig(cfg config.Config) (err error) {
+	printDependencyChanges(os.Stdout, p.config.Dependencies, cfg.Dependencies)
+	p.config = cfg
+	return p.writeConfig(cfg)
+}
+
+func printDependencyChanges(w io.Writer, old, new map[string]config.Dependency) {
+	var names []string
+	for name := range old {
+		names = append(names, name)
+	}
+	for name := range new {
+		if _, found := old[name]; !found {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		o, inOld := old[name]
+		n, inNew := new[name]
+		switch {
+		case !inNew:
+			fxt.Fprintfln(w, "removed %s %s", name, o.Version)
+		case !inOld:
+			fxt.Fprintfln(w, "added %s %s", name, n.Version)
+		case o.Version == n.Version:
+		case semver.Compare("v"+o.Version, "v"+n.Version) < 0:
+			fxt.Fprintfln(w, "upgraded %s %s => %s", name, o.Version, n.Version)
+		default:
+			fxt.Fprintfln(w, "downgraded %s %s => %s", name, o.Version, n.Version)
+		}
+	}
+}
+
 func (p *Project) writeConfig(cfg config.Config) (err error) {
 	f, err := os.Create(filepath.Join(p.location, "bramble.toml"))
 	if err != nil {
@@ -1,8 +1,16 @@
 package project
 
 import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
+	"github.com/maxmcd/bramble/internal/config"
+	"github.com/maxmcd/bramble/internal/dependency"
+	"github.com/maxmcd/bramble/pkg/test"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -26,3 +34,101 @@ func TestNewProject(t *testing.T) {
 		}
 	}
 }
+
+func Test_printDependencyChanges(t *testing.T) {
+	var buf bytes.Buffer
+	printDependencyChanges(&buf, map[string]config.Dependency{
+		"a": {Version: "1.0.0"},
+		"b": {Version: "1.2.0"},
+		"c": {Version: "1.0.0"},
+		"d": {Version: "1.0.0"},
+	}, map[string]config.Dependency{
+		"a": {Version: "1.1.0"},
+		"b": {Version: "1.1.0"},
+		"c": {Version: "1.0.0"},
+		"e": {Version: "1.0.0"},
+	})
+	assert.Equal(t, `upgraded a 1.0.0 => 1.1.0
+downgraded b 1.2.0 => 1.1.0
+removed d 1.0.0
+added e 1.0.0
+`, buf.String())
+}
+
+func writeTestConfig(t *testing.T, dir, name, version string, deps map[string]config.Dependency) {
+	require.NoError(t, os.MkdirAll(dir, 0755))
+	var sb strings.Builder
+	config.Config{
+		Package:      config.Package{Name: name, Version: version},
+		Dependencies: deps,
+	}.Render(&sb)
+	test.WriteFile(t, filepath.Join(dir, "bramble.toml"), sb.String())
+}
+
+func TestProject_Tidy(t *testing.T) {
+	dependencyDir := t.TempDir()
+	for _, pkg := range []struct {
+		name, version string
+		deps          map[string]config.Dependency
+	}{
+		{"x.y/a", "1.0.0", map[string]config.Dependency{"x.y/c": {Version: "1.0.0"}}},
+		{"x.y/b", "1.0.0", nil},
+		{"x.y/b", "1.1.0", nil},
+		{"x.y/c", "1.0.0", nil},
+		{"x.y/c", "1.2.0", nil},
+		{"x.y/unused", "1.0.0", nil},
+	} {
+		writeTestConfig(t, filepath.Join(dependencyDir, "src", pkg.name+"@"+pkg.version), pkg.name, pkg.version, pkg.deps)
+	}
+
+	projectDir := t.TempDir()
+	writeTestConfig(t, projectDir, "x.y/project", "0.0.1", map[string]config.Dependency{
+		"x.y/a":      {Version: "1.0.0"},
+		"x.y/c":      {Version: "1.2.0"},
+		"x.y/unused": {Version: "1.0.0"},
+	})
+	test.WriteFile(t, filepath.Join(projectDir, "default.bramble"),
+		"load(\"x.y/a/lib\")\nload(\"x.y/b\")\nload(\"x.y/project/sub\")\n")
+
+	p := newTestProject(t, projectDir)
+	p.AddModuleFetcher(dependency.NewManager(dependencyDir, nil))
+	require.NoError(t, p.Tidy(context.Background()))
+
+	cfg, err := config.ReadConfig(filepath.Join(projectDir, "bramble.toml"))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]config.Dependency{
+		"x.y/a": {Version: "1.0.0"},
+		"x.y/b": {Version: "1.1.0"},
+		// Upgraded past the version x.y/a requires
+		"x.y/c": {Version: "1.2.0"},
+	}, cfg.Dependencies)
+}
+
+func TestProject_Vendor(t *testing.T) {
+	dependencyDir := t.TempDir()
+	src := filepath.Join(dependencyDir, "src", "x.y/a@1.0.0")
+	writeTestConfig(t, src, "x.y/a", "1.0.0", nil)
+	test.WriteFile(t, filepath.Join(src, "default.bramble"), "def a():\n    pass\n")
+
+	projectDir := t.TempDir()
+	writeTestConfig(t, projectDir, "x.y/project", "0.0.1", map[string]config.Dependency{
+		"x.y/a": {Version: "1.0.0"},
+	})
+	p := newTestProject(t, projectDir)
+	p.AddModuleFetcher(dependency.NewManager(dependencyDir, nil))
+	require.NoError(t, p.Vendor(context.Background()))
+	vendored := filepath.Join(projectDir, VendorDirectory, "x.y/a@1.0.0")
+	require.FileExists(t, filepath.Join(vendored, "default.bramble"))
+
+	// Vendored dependencies are used without fetching anything
+	p = newTestProject(t, projectDir)
+	p.AddModuleFetcher(dependency.NewManager(t.TempDir(), nil))
+	path, err := p.findOrDownloadModulePath(context.Background(), "x.y/a")
+	require.NoError(t, err)
+	require.Equal(t, vendored, path)
+
+	// Vendored projects aren't part of the project's modules
+	modules, err := p.FindAllModules(".")
+	require.NoError(t, err)
+	require.Len(t, modules, 0)
+}
@@ -2,7 +2,6 @@ package project
 
 import (
 	"context"
-	"math/rand"
 	"os"
 	"path/filepath"
 	stdruntime "runtime"
@@ -19,7 +18,6 @@ func (p *Project) newRuntime(target string) *runtime {
 	rt := &runtime{project: p}
 	rt.allDerivations = map[string]Derivation{}
 	rt.cache = map[string]*entry{}
-	rt.internalKey = rand.Int63()
 	// TODO: sys will be needed by this, what else?
 	derivation, err := rt.loadNativeDerivation(starlark.NewBuiltin("_derivation", rt.derivationFunction))
 	if err != nil {
@@ -54,8 +52,7 @@ func (rt *runtime) newThread(ctx context.Context, name string) *starlark.Thread
 }
 
 type runtime struct {
-	project     *Project
-	internalKey int64
+	project *Project
 
 	allDerivations map[string]Derivation
 	tests          []Test
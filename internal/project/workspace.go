@@ -0,0 +1,161 @@
+package project
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/maxmcd/bramble/internal/config"
+	"github.com/maxmcd/bramble/pkg/fileutil"
+	"github.com/pkg/errors"
+)
+
+// findWorkspace searches location and its parents for a bramble.toml with a
+// [workspace] table. If location is the workspace root or one of its members
+// the location of every project in the workspace is returned, keyed by package
+// name.
+func findWorkspace(location string) (members map[string]string, err error) {
+	dir := location
+	for {
+		if cfg, err := config.ReadConfig(filepath.Join(dir, "bramble.toml")); err == nil &&
+			len(cfg.Workspace.Members) > 0 {
+			return workspaceMembers(dir, cfg, location)
+		}
+		if dir == filepath.Join(dir, "..") {
+			return nil, nil
+		}
+		dir = filepath.Join(dir, "..")
+	}
+}
+
+func workspaceMembers(root string, cfg config.Config, location string) (members map[string]string, err error) {
+	members = map[string]string{cfg.Package.Name: root}
+	for _, member := range cfg.Workspace.Members {
+		path := filepath.Join(root, member)
+		if err := fileutil.PathWithinDir(root, path); err != nil {
+			return nil, errors.Wrapf(err, "workspace member %q must be within the workspace", member)
+		}
+		memberCfg, err := config.ReadConfig(filepath.Join(path, "bramble.toml"))
+		if err != nil {
+			return nil, errors.Wrapf(err, "error reading workspace member %q", member)
+		}
+		if existing, found := members[memberCfg.Package.Name]; found {
+			return nil, errors.Errorf("workspace members %q and %q are both package %q",
+				existing, path, memberCfg.Package.Name)
+		}
+		members[memberCfg.Package.Name] = path
+	}
+	for _, path := range members {
+		if path == location {
+			return members, nil
+		}
+	}
+	// location is within the workspace directory but isn't a member
+	return nil, nil
+}
+
+// moduleHasPrefix returns true if the module is the package or one of its
+// modules
+func moduleHasPrefix(module, pkg string) bool {
+	return module == pkg || strings.HasPrefix(module, pkg+"/")
+}
+
+// pathDependencyDir returns the absolute location of a path dependency
+func (p *Project) pathDependencyDir(cd config.Dependency) string {
+	if filepath.IsAbs(cd.Path) {
+		return filepath.Clean(cd.Path)
+	}
+	return filepath.Join(p.location, cd.Path)
+}
+
+// pathOverrides returns the location of every package that is loaded from a
+// local directory instead of the registry. Path dependencies take precedence
+// over workspace members.
+func (p *Project) pathOverrides() map[string]string {
+	overrides := map[string]string{}
+	for name, location := range p.members {
+		if name != p.config.Package.Name {
+			overrides[name] = location
+		}
+	}
+	for name, cd := range p.config.Dependencies {
+		if cd.Path != "" {
+			overrides[name] = p.pathDependencyDir(cd)
+		}
+	}
+	return overrides
+}
+
+// pathOverride returns the package and location of the path override that
+// contains the module, if there is one.
+func (p *Project) pathOverride(module string) (name, location string, found bool) {
+	for pkg, dir := range p.pathOverrides() {
+		if moduleHasPrefix(module, pkg) && len(pkg) > len(name) {
+			name, location, found = pkg, dir, true
+		}
+	}
+	return name, location, found
+}
+
+// resolvePathDependencies sets the version of path dependencies that don't have
+// one to the version in their bramble.toml.
+func (p *Project) resolvePathDependencies() (err error) {
+	for name, cd := range p.config.Dependencies {
+		if cd.Path == "" || cd.Version != "" {
+			continue
+		}
+		if cd.Version, err = p.pathVersion(p.pathDependencyDir(cd)); err != nil {
+			return errors.Wrapf(err, "error reading path dependency %q", name)
+		}
+		p.config.Dependencies[name] = cd
+	}
+	return nil
+}
+
+// workspaceDependency returns a path dependency on the workspace member at
+// location
+func (p *Project) workspaceDependency(location string) (cd config.Dependency, err error) {
+	if cd.Path, err = filepath.Rel(p.location, location); err != nil {
+		return cd, err
+	}
+	cd.Version, err = p.pathVersion(location)
+	return cd, err
+}
+
+func (p *Project) pathVersion(location string) (version string, err error) {
+	cfg, err := config.ReadConfig(filepath.Join(location, "bramble.toml"))
+	return cfg.Package.Version, err
+}
+
+// workspaceMember returns the package and location of the workspace member
+// that contains the module
+func (p *Project) workspaceMember(module string) (name, location string, found bool) {
+	for pkg, dir := range p.members {
+		if moduleHasPrefix(module, pkg) && len(pkg) > len(name) {
+			name, location, found = pkg, dir, true
+		}
+	}
+	return name, location, found
+}
+
+// isMember returns true if dir is the location of a project in the workspace
+func (p *Project) isMember(dir string) bool {
+	for _, location := range p.members {
+		if location == dir {
+			return true
+		}
+	}
+	return false
+}
+
+// packageForPath returns the package and location of the project that a file
+// belongs to. Files in workspace members that are nested within this project
+// belong to the member.
+func (p *Project) packageForPath(path string) (name, location string) {
+	name, location = p.config.Package.Name, p.location
+	for pkg, dir := range p.members {
+		if len(dir) > len(location) && fileutil.PathWithinDir(dir, path) == nil {
+			name, location = pkg, dir
+		}
+	}
+	return name, location
+}
@@ -0,0 +1,109 @@
+package project
+
+import (
+	"context"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/maxmcd/bramble/internal/config"
+	"github.com/maxmcd/bramble/internal/dependency"
+	"github.com/maxmcd/bramble/pkg/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestWorkspace creates a workspace with a library that depends on a
+// registry package and an app that loads the library.
+func writeTestWorkspace(t *testing.T) (dependencyDir, root string) {
+	dependencyDir = t.TempDir()
+	writeTestConfig(t, filepath.Join(dependencyDir, "src", "x.y/c@1.0.0"), "x.y/c", "1.0.0", nil)
+
+	root = t.TempDir()
+	var sb strings.Builder
+	config.Config{
+		Package:   config.Package{Name: "x.y/ws", Version: "0.0.1"},
+		Workspace: config.Workspace{Members: []string{"lib", "app"}},
+	}.Render(&sb)
+	test.WriteFile(t, filepath.Join(root, "bramble.toml"), sb.String())
+	test.WriteFile(t, filepath.Join(root, "default.bramble"), "def ws():\n    pass\n")
+
+	writeTestConfig(t, filepath.Join(root, "lib"), "x.y/lib", "0.1.0", map[string]config.Dependency{
+		"x.y/c": {Version: "1.0.0"},
+	})
+	test.WriteFile(t, filepath.Join(root, "lib", "default.bramble"), "def lib():\n    pass\n")
+	test.WriteFile(t, filepath.Join(root, "lib", "sub.bramble"), "def sub():\n    pass\n")
+
+	writeTestConfig(t, filepath.Join(root, "app"), "x.y/app", "0.2.0", nil)
+	test.WriteFile(t, filepath.Join(root, "app", "default.bramble"), "load(\"x.y/lib/sub\")\n")
+	return dependencyDir, root
+}
+
+func TestWorkspace_modules(t *testing.T) {
+	dependencyDir, root := writeTestWorkspace(t)
+	p := newTestProject(t, root)
+	p.AddModuleFetcher(dependency.NewManager(dependencyDir, nil))
+
+	modules, err := p.ArgumentsToModules(context.Background(), []string{"./..."}, false)
+	require.NoError(t, err)
+	var names []string
+	for _, m := range modules {
+		names = append(names, m.Name)
+	}
+	sort.Strings(names)
+	assert.Equal(t, []string{"x.y/app", "x.y/lib", "x.y/lib/sub", "x.y/ws"}, names)
+
+	modules, err = p.ArgumentsToModules(context.Background(), []string{"x.y/lib/..."}, false)
+	require.NoError(t, err)
+	assert.Len(t, modules, 2)
+}
+
+func TestWorkspace_memberLoads(t *testing.T) {
+	dependencyDir, root := writeTestWorkspace(t)
+	p := newTestProject(t, filepath.Join(root, "app"))
+	p.AddModuleFetcher(dependency.NewManager(dependencyDir, nil))
+
+	// Loads of other members use their local source
+	path, err := p.moduleToPath("x.y/lib/sub")
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(root, "lib", "sub.bramble"), path)
+
+	// The member's requirements are read from its local bramble.toml
+	require.NoError(t, p.Tidy(context.Background()))
+	cfg, err := config.ReadConfig(filepath.Join(root, "app", "bramble.toml"))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]config.Dependency{
+		"x.y/c":   {Version: "1.0.0"},
+		"x.y/lib": {Version: "0.1.0", Path: "../lib"},
+	}, cfg.Dependencies)
+}
+
+func TestProject_pathDependency(t *testing.T) {
+	dependencyDir, root := writeTestWorkspace(t)
+	// A project outside of the workspace can use a member with a path
+	// dependency
+	projectDir := t.TempDir()
+	rel, err := filepath.Rel(projectDir, filepath.Join(root, "lib"))
+	require.NoError(t, err)
+	writeTestConfig(t, projectDir, "x.y/project", "0.0.1", map[string]config.Dependency{
+		"x.y/lib": {Path: rel},
+	})
+
+	p := newTestProject(t, projectDir)
+	require.Nil(t, p.members)
+	dm := dependency.NewManager(dependencyDir, nil)
+	p.AddModuleFetcher(dm)
+	require.Equal(t, "0.1.0", p.config.Dependencies["x.y/lib"].Version)
+
+	cfg, err := dm.CalculateConfigBuildlist(p.config)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]config.Dependency{
+		"x.y/c":   {Version: "1.0.0"},
+		"x.y/lib": {Version: "0.1.0", Path: rel},
+	}, cfg.Dependencies)
+
+	path, err := p.findOrDownloadModulePath(context.Background(), "x.y/lib")
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(root, "lib"), path)
+}
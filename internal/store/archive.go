@@ -0,0 +1,98 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/maxmcd/bramble/pkg/fileutil"
+	"github.com/maxmcd/bramble/v/untar"
+	"github.com/mholt/archiver/v3"
+	"github.com/pkg/errors"
+)
+
+// compressionFormats are the compression formats that tar archives are
+// unpacked from, detected by the magic bytes at the start of the file
+var compressionFormats = []struct {
+	magic        []byte
+	decompressor archiver.Decompressor
+}{
+	{[]byte{0x1f, 0x8b}, archiver.NewGz()},
+	{[]byte{0xfd, '7', 'z', 'X', 'Z', 0x00}, archiver.NewXz()},
+	{[]byte("BZh"), archiver.NewBz2()},
+	{[]byte{0x28, 0xb5, 0x2f, 0xfd}, archiver.NewZstd()},
+}
+
+var zipMagic = []byte("PK\x03\x04")
+
+// isTar checks for the "ustar" magic at the start of a tar header
+func isTar(header []byte) bool {
+	return len(header) >= 262 && bytes.Equal(header[257:262], []byte("ustar"))
+}
+
+// unpackArchive unpacks the file at path into dir if it's a zip file or a tar
+// archive compressed with one of the compressionFormats. unpacked is false if
+// the format of the file isn't recognized.
+func unpackArchive(path, dir string) (unpacked bool, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	defer f.Close()
+	header := make([]byte, 512)
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return false, errors.WithStack(err)
+	}
+	header = header[:n]
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return false, errors.WithStack(err)
+	}
+
+	if bytes.HasPrefix(header, zipMagic) {
+		return true, errors.Wrap(archiver.NewZip().Unarchive(path, dir), "error unpacking zip archive")
+	}
+	if isTar(header) {
+		return true, untar.Untar(f, dir)
+	}
+	for _, format := range compressionFormats {
+		if !bytes.HasPrefix(header, format.magic) {
+			continue
+		}
+		pr, pw := io.Pipe()
+		go func() {
+			pw.CloseWithError(format.decompressor.Decompress(f, pw))
+		}()
+		defer pr.Close()
+		r := bufio.NewReaderSize(pr, 512)
+		if header, _ := r.Peek(262); !isTar(header) {
+			// A compressed file that isn't a tarball is left as-is
+			return false, nil
+		}
+		return true, errors.Wrapf(untar.Untar(r, dir), "error unpacking %s compressed tarball", format.decompressor)
+	}
+	return false, nil
+}
+
+// stripPrefix moves the contents of the directory prefix within src into dst
+func stripPrefix(src, prefix, dst string) (err error) {
+	dir := filepath.Join(src, prefix)
+	if err := fileutil.PathWithinDir(src, dir); err != nil {
+		return errors.Wrapf(err, "strip_prefix %q must be a path within the archive", prefix)
+	}
+	if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+		return errors.Errorf("strip_prefix %q isn't a directory in the archive", prefix)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for _, entry := range entries {
+		if err := os.Rename(filepath.Join(dir, entry.Name()), filepath.Join(dst, entry.Name())); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
@@ -3,7 +3,6 @@ package store
 import (
 	"bufio"
 	"bytes"
-	"compress/gzip"
 	"context"
 	"crypto/tls"
 	"fmt"
@@ -18,13 +17,14 @@ import (
 
 	"github.com/certifi/gocertifi"
 	"github.com/maxmcd/bramble/internal/logger"
+	"github.com/maxmcd/bramble/internal/offline"
 	"github.com/maxmcd/bramble/internal/types"
+	"github.com/maxmcd/bramble/pkg/download"
 	"github.com/maxmcd/bramble/pkg/fileutil"
 	"github.com/maxmcd/bramble/pkg/hasher"
 	"github.com/maxmcd/bramble/pkg/reptar"
 	"github.com/maxmcd/bramble/pkg/sandbox"
 	"github.com/maxmcd/bramble/pkg/textreplace"
-	"github.com/maxmcd/bramble/v/untar"
 	"github.com/mholt/archiver/v3"
 	"github.com/pkg/errors"
 	"go.opentelemetry.io/otel/attribute"
@@ -44,11 +44,23 @@ type Builder struct {
 }
 
 type BuildDerivationOptions struct {
-	// ForceBuild will make sure we build even if the derivation already exists
+	// ForceBuild will make sure we build even if the derivation already exists.
+	// Fetchers download their url again instead of using the download cache.
 	ForceBuild bool
+	// Verify builds the derivation and hashes its outputs without adding them
+	// or the derivation to the store or the download cache. It's used to
+	// confirm that a fetcher still produces its locked output.
+	Verify bool
 
 	Shell   bool
 	Verbose bool
+
+	// Output receives the build output of the derivation. When nil verbose
+	// builds write to stdout and stderr, other builds only keep their output if
+	// the build fails.
+	Output io.Writer
+	// Progress receives the download progress of the built-in fetch builders
+	Progress io.Writer
 }
 
 func (b *Builder) BuildDerivation(ctx context.Context, drv Derivation, opts BuildDerivationOptions) (builtDrv Derivation, didBuild bool, err error) {
@@ -75,14 +87,30 @@ func (b *Builder) BuildDerivation(ctx context.Context, drv Derivation, opts Buil
 
 	filename := drv.Filename()
 	span.SetAttributes(attribute.String("filename", filename))
-	if drvExists && outputsExist && !opts.ForceBuild {
+	if drvExists && outputsExist && !opts.ForceBuild && !opts.Verify {
 		return drv, false, nil
 	}
+	if !opts.ForceBuild && !opts.Verify && !opts.Shell {
+		substituted, found, err := b.store.substituteDerivation(ctx, drv)
+		if err != nil {
+			return drv, false, err
+		}
+		if found {
+			if err := b.checkDerivationHashes(substituted); err != nil {
+				return drv, false, err
+			}
+			_, err = b.store.WriteDerivation(substituted)
+			return substituted, false, err
+		}
+	}
 	// logger.Print("Building derivation", filename)
 	logger.Debugw(drv.PrettyJSON())
 	if drv, err = b.buildDerivation(ctx, drv, opts); err != nil {
 		return drv, false, errors.Wrap(err, "error building "+filename)
 	}
+	if opts.Verify {
+		return drv, true, nil
+	}
 	_, err = b.store.WriteDerivation(drv)
 	// TODO: lock store on write
 	return drv, true, err
@@ -115,9 +143,38 @@ func (b *Builder) buildDerivation(ctx context.Context, drv Derivation, opts Buil
 		return drv, err
 	}
 
-	if opts.Shell && (drv.Builder == "basic_fetch_url" || drv.Builder == "fetch_git") {
+	if opts.Shell && (drv.Builder == "basic_fetch_url" || drv.Builder == "fetch_url" || drv.Builder == "fetch_git") {
 		return drv, errors.New("can't spawn a shell with a builtin builder")
 	}
+	// Fetchers download into a directory in the build dir, the download is
+	// taken from the download cache if it has been fetched before. Forced
+	// builds always download again.
+	url, downloadHashes, err := b.downloadCacheKeys(drv)
+	if err != nil {
+		return drv, err
+	}
+	downloadDir := filepath.Join(buildDir, "bramble_download")
+	var cachedDownload bool
+	if url != "" {
+		if err := os.Mkdir(downloadDir, 0755); err != nil {
+			return drv, errors.WithStack(err)
+		}
+		if path, found := b.store.downloadCache().lookup(url, downloadHashes); found && !opts.ForceBuild && !opts.Verify {
+			if err := fileutil.CopyFile(path, filepath.Join(downloadDir, filepath.Base(url))); err != nil {
+				return drv, err
+			}
+			cachedDownload = true
+		}
+		if drvCopy.Env == nil {
+			drvCopy.Env = map[string]string{}
+		}
+		drvCopy.Env[downloadDirEnvVar] = downloadDir
+	}
+	if drv.Network && !cachedDownload {
+		if err := offline.Check("derivation %s requires network access and hasn't been built", drv.Name); err != nil {
+			return drv, err
+		}
+	}
 
 	defer func() {
 		// If we exit let's try and clean these paths up in case they still exist
@@ -129,8 +186,10 @@ func (b *Builder) buildDerivation(ctx context.Context, drv Derivation, opts Buil
 	}()
 
 	switch drv.Builder {
-	case "basic_fetch_url":
-		err = b.fetchURLBuilder(ctx, drvCopy, outputPaths)
+	case "basic_fetch_url", "fetch_url":
+		err = b.fetchURLBuilder(ctx, drvCopy, outputPaths, opts.Progress)
+	case "fetch_git":
+		err = b.fetchGitBuilder(ctx, drvCopy, outputPaths)
 	default:
 		err = b.regularBuilder(ctx, drvCopy, buildDir, outputPaths, opts)
 	}
@@ -140,44 +199,116 @@ func (b *Builder) buildDerivation(ctx context.Context, drv Derivation, opts Buil
 
 	var outputs map[string]Output
 
-	outputs, err = b.store.hashAndMoveBuildOutputs(ctx, drv, outputPaths, buildDir)
+	outputs, err = b.store.hashAndMoveBuildOutputs(ctx, drv, outputPaths, buildDir, !opts.Verify)
 	err = errors.Wrap(err, "hash and move build outputs") // noop if err is nil
 	if err != nil {
 		return drv, err
 	}
 
 	drv.Outputs, err = outputsToOutput(drv.OutputNames, outputs)
+	if err != nil {
+		return drv, err
+	}
+	if err := b.checkDerivationHashes(drv); err != nil {
+		return drv, err
+	}
+	if path := filepath.Join(downloadDir, filepath.Base(url)); url != "" && !cachedDownload && !opts.Verify && fileutil.FileExists(path) {
+		// The output hash confirms the download, so it can be cached
+		hashes := append(downloadHashes, drv.output("out").Path)
+		if err := b.store.downloadCache().add(url, hashes, path); err != nil {
+			return drv, errors.Wrap(err, "error adding download to the download cache")
+		}
+	}
+	return drv, nil
+}
 
+// LockfileKey returns the key that is used to record the output of a fetcher
+// or fixed-output derivation in the lockfile. found is false if the output of
+// the derivation isn't recorded.
+func LockfileKey(drv Derivation) (key string, found bool) {
 	switch {
-	case drv.Builder == "basic_fetch_url":
-		return drv, b.checkFetchDerivationHashes(drv, "basic_fetch_url "+drv.Env["url"])
-
-	// These two are just a contract with an environment variable. Any
-	// derivation could set these. I think that's ok from a security standpoint,
-	// although could indeed populate the lockfile with junk. Hard to think of
-	// another way to identify the fetcher derivations.
-
-	// TODO: maybe better to have this be a single environment variable and put
-	// the git logic into the derivation itself. Then other derivations could
-	// use this for their own lockfile needs. Would need to be sure it can't be
-	// abused to interact with our expected lockfile values.
-	case drv.Env["confirm_fetch_url"] == "true":
-		return drv, b.checkFetchDerivationHashes(drv, "fetch_url "+drv.Env["url"])
-	case drv.Env["confirm_fetch_git"] == "true":
-		url := "fetch_git " + drv.Env["url"]
-		reference := drv.Env["reference"]
-		if reference != "" {
-			url += "@" + reference
-		}
-		return drv, b.checkFetchDerivationHashes(drv, url)
-	}
-
-	return drv, err
+	case drv.Builder == "basic_fetch_url", drv.Builder == "fetch_url":
+		// Mirrors serve the same file, so the first url identifies the fetch
+		key = drv.Builder + " "
+		if urls := fetchURLs(drv.Env); len(urls) > 0 {
+			key += urls[0]
+		}
+		// The same url can be unpacked into different outputs. The options
+		// are only added when they're set so that existing keys don't change.
+		if drv.Env["unpack"] == "false" {
+			key += " unpack=false"
+		}
+		if prefix := drv.Env["strip_prefix"]; prefix != "" {
+			key += " strip_prefix=" + prefix
+		}
+		return key, true
+	case drv.Builder == "fetch_git":
+		key = "fetch_git " + drv.Env["url"]
+		if reference := drv.Env["reference"]; reference != "" {
+			key += "@" + reference
+		}
+		return key, true
+
+	// A derivation that uses the network without declaring its output hash.
+	// The key is the name so that it stays the same when the build changes,
+	// a changed build has to produce the recorded output or fail.
+	case drv.Network && drv.OutputHash == "":
+		return "fixed_output " + drv.Name, true
+	}
+	return "", false
+}
+
+// LockfileKeyDerivation returns a derivation that fetches the url in a
+// fetch_url lockfile key. found is false if the key isn't a fetch_url key.
+func LockfileKeyDerivation(key string) (drv Derivation, found bool) {
+	parts := strings.Fields(key)
+	if len(parts) < 2 || (parts[0] != "basic_fetch_url" && parts[0] != "fetch_url") {
+		return drv, false
+	}
+	drv = Derivation{
+		Name:        filepath.Base(parts[1]),
+		Builder:     parts[0],
+		Env:         map[string]string{"url": parts[1]},
+		OutputNames: []string{"out"},
+	}
+	for _, option := range parts[2:] {
+		kv := strings.SplitN(option, "=", 2)
+		if len(kv) != 2 || (kv[0] != "unpack" && kv[0] != "strip_prefix") {
+			return drv, false
+		}
+		drv.Env[kv[0]] = kv[1]
+	}
+	return drv, true
+}
+
+// checkDerivationHashes confirms that fetcher and fixed-output derivations
+// match the hash provided in the derivation or the lockfile.
+func (b *Builder) checkDerivationHashes(drv Derivation) error {
+	if key, found := LockfileKey(drv); found {
+		return b.checkFetchDerivationHashes(drv, key)
+	}
+	if drv.OutputHash != "" {
+		return checkOutputHash(drv, drv.OutputHash)
+	}
+	return nil
+}
+
+func checkOutputHash(drv Derivation, hash string) error {
+	if outputPath := drv.output("out").Path; outputPath != hash {
+		return errors.Errorf(
+			"Output of %s doesn't match with the existing hash. "+
+				"Hash %q was expected but the output was %q",
+			drv.Name, hash, outputPath)
+	}
+	return nil
 }
 
 func (b *Builder) checkFetchDerivationHashes(drv Derivation, url string) error {
 	// Check for a hash in the derivation
-	hash := drv.Env["hash"]
+	hash := drv.OutputHash
+	if hash == "" {
+		hash = drv.Env["hash"]
+	}
 	if hash == "" {
 		// If we don't have that then check in the config map for an
 		// existing value
@@ -185,64 +316,101 @@ func (b *Builder) checkFetchDerivationHashes(drv Derivation, url string) error {
 			hash = existingHash
 		}
 	}
-	outputPath := drv.output("out").Path
 	// If we have a hash to validate, ensure it's valid
-	if hash != "" && outputPath != hash {
-		return errors.Errorf(
-			"Urlfetch content doesn't match with the existing hash. "+
-				"Hash %q was provided by the output was %q",
-			hash, outputPath)
+	if hash != "" {
+		return checkOutputHash(drv, hash)
 	}
 	// If we never had a hash to validate, add it to lockfile
-	if hash == "" {
-		if err := b.lockfileWriter.AddEntry(url, outputPath); err != nil {
-			return err
-		}
-	}
-	return nil
+	return b.lockfileWriter.AddEntry(url, drv.output("out").Path)
 }
 
-func (b *Builder) fetchURLBuilder(ctx context.Context, drv Derivation, outputPaths map[string]string) (err error) {
+func (b *Builder) fetchURLBuilder(ctx context.Context, drv Derivation, outputPaths map[string]string, progress io.Writer) (err error) {
 	var span trace.Span
 	ctx, span = tracer.Start(ctx, "store.fetchURLBuilder")
 	defer span.End()
 	if _, ok := outputPaths["out"]; len(outputPaths) > 1 || !ok {
-		return errors.New("the fetch_url builder can only have the defalt output \"out\"")
+		return errors.New("the fetch_url builder can only have the default output \"out\"")
 	}
-	url, ok := drv.Env["url"]
-	if !ok {
+	urls := fetchURLs(drv.Env)
+	if len(urls) == 0 {
 		return errors.New("fetch_url requires the environment variable 'url' to be set")
 	}
+	dgst, hasDigest, err := fetchDigest(drv.Env)
+	if err != nil {
+		return err
+	}
+	// Files are named after the first url so that every mirror has the same
+	// output
+	name := filepath.Base(urls[0])
+	// The file is already downloaded if it was found in the download cache
+	path := filepath.Join(drv.Env[downloadDirEnvVar], name)
+	if fileutil.FileExists(path) && hasDigest {
+		if err := dgst.check(path); err != nil {
+			return errors.Wrap(err, "cached download doesn't match")
+		}
+	}
 	// derivation can provide a hash, but usually this is just in the lockfile
-	dir, path, err := b.downloadFile(ctx, url)
+	url := urls[0]
+	var failures []string
+	for _, url = range urls {
+		if fileutil.FileExists(path) {
+			break
+		}
+		if err = b.downloadFile(ctx, url, path, progress); err == nil && hasDigest {
+			if err = dgst.check(path); err != nil {
+				_ = os.Remove(path)
+			}
+		}
+		if err == nil || offline.Is(err) {
+			break
+		}
+		// Try the next mirror
+		failures = append(failures, err.Error())
+	}
 	if err != nil {
+		if len(failures) > 1 {
+			return errors.Errorf("fetch_url failed for every url: %s", strings.Join(failures, "; "))
+		}
 		return err
 	}
-	defer func() { _ = os.RemoveAll(dir) }()
 
-	if strings.HasSuffix(drv.Env["url"], ".tar.gz") {
-		f, err := os.Open(path)
-		if err != nil {
-			return err
-		}
-		r, err := gzip.NewReader(f)
-		if err != nil {
-			return errors.Wrap(err, "requires gzip-compressed body")
+	prefix := drv.Env["strip_prefix"]
+	if drv.Env["unpack"] == "false" {
+		if prefix != "" {
+			return errors.New("fetch_url can't use strip_prefix if unpack is false")
 		}
-		if err = untar.Untar(r, outputPaths["out"]); err != nil {
+		return fileutil.CopyFile(path, filepath.Join(outputPaths["out"], name))
+	}
+	unpackDir := outputPaths["out"]
+	if prefix != "" {
+		// Unpack next to the output so that the prefix can be moved into it
+		if unpackDir, err = b.store.storeLengthTempDir(); err != nil {
 			return err
 		}
-		return nil
+		defer func() { _ = os.RemoveAll(unpackDir) }()
+	}
+	unpacked, err := unpackArchive(path, unpackDir)
+	if err != nil {
+		return err
 	}
-	// If it's not .tar.gz just put the file in the output
-	return os.Rename(path, filepath.Join(outputPaths["out"], filepath.Base(url)))
+	if !unpacked {
+		if prefix != "" {
+			return errors.Errorf("fetch_url can't use strip_prefix, %q isn't an archive", url)
+		}
+		// If it's not an archive just put the file in the output
+		return fileutil.CopyFile(path, filepath.Join(outputPaths["out"], name))
+	}
+	if prefix != "" {
+		return stripPrefix(unpackDir, prefix, outputPaths["out"])
+	}
+	return nil
 }
 
-// downloadFile downloads a file into a temp dir
-func (b *Builder) downloadFile(ctx context.Context, url string) (dir, path string, err error) {
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
-	if err != nil {
-		return "", "", err
+// downloadFile downloads url to path. Progress is written to progress if it
+// isn't nil.
+func (b *Builder) downloadFile(ctx context.Context, url, path string, progress io.Writer) (err error) {
+	if err := offline.Check("can't download %q", url); err != nil {
+		return err
 	}
 
 	transport := &http.Transport{
@@ -264,35 +432,15 @@ func (b *Builder) downloadFile(ctx context.Context, url string) (dir, path strin
 	certPool, err := gocertifi.CACerts()
 	transport.TLSClientConfig = &tls.Config{RootCAs: certPool}
 
-	client := http.Client{
-		Transport: transport,
+	opts := download.Options{Client: &http.Client{Transport: transport}}
+	if progress != nil {
+		opts.Progress = download.PrintProgress(progress, filepath.Base(url), time.Second)
 	}
-	resp, err := client.Do(req)
-	if err != nil {
-		err = errors.Wrap(err, fmt.Sprintf("error making request to download %q", url))
-		return
-	}
-	switch resp.StatusCode {
-	case http.StatusOK, http.StatusCreated:
-	default:
-		return "", "", errors.Errorf("Unexpected http status code %d when fetching url %q", resp.StatusCode, url)
-	}
-	defer resp.Body.Close()
-	dir, err = os.MkdirTemp("", "")
-	if err != nil {
-		return "", "", errors.WithStack(err)
-	}
-	f, err := os.Create(filepath.Join(dir, filepath.Base(url)))
-	if err != nil {
-		return "", "", errors.WithStack(err)
-	}
-	if _, err := io.Copy(f, resp.Body); err != nil {
-		return "", "", errors.WithStack(err)
-	}
-	if err := f.Close(); err != nil {
-		return "", "", errors.WithStack(err)
+	if err := download.File(ctx, url, path, opts); err != nil {
+		_ = os.Remove(path)
+		return err
 	}
-	return dir, f.Name(), nil
+	return nil
 }
 
 func (b *Builder) regularBuilder(ctx context.Context, drv Derivation, buildDir string,
@@ -317,7 +465,9 @@ func (b *Builder) regularBuilder(ctx context.Context, drv Derivation, buildDir s
 	var stderr io.Writer = os.Stderr
 	var f *os.File
 	var buf *bufio.Writer
-	if !opts.Verbose {
+	if opts.Output != nil {
+		stdout, stderr = opts.Output, opts.Output
+	} else if !opts.Verbose {
 		f, err = os.CreateTemp("", "")
 		if err != nil {
 			return err
@@ -363,7 +513,9 @@ func (err ExecError) Error() string {
 	return err.Err.Error()
 }
 
-func (s *Store) hashAndMoveBuildOutputs(ctx context.Context, drv Derivation, outputPaths map[string]string, buildDir string) (outputs map[string]Output, err error) {
+// hashAndMoveBuildOutputs hashes the build outputs and moves them into the
+// store. If move is false the outputs are only hashed.
+func (s *Store) hashAndMoveBuildOutputs(ctx context.Context, drv Derivation, outputPaths map[string]string, buildDir string, move bool) (outputs map[string]Output, err error) {
 	var span trace.Span
 	ctx, span = tracer.Start(ctx, "store.store.hashAndMoveBuildOutputs")
 	defer span.End()
@@ -392,7 +544,7 @@ func (s *Store) hashAndMoveBuildOutputs(ctx context.Context, drv Derivation, out
 		// different names can share outputs
 		newPath := s.joinStorePath(hashedFolderName)
 
-		if !fileutil.PathExists(newPath) {
+		if move && !fileutil.PathExists(newPath) {
 			if err := s.unarchiveAndReplaceOutputFolderName(
 				ctx,
 				reptarFile.Name(),
@@ -583,7 +735,7 @@ func (s *Store) archiveAndScanOutputDirectory(ctx context.Context, tarOutput, ha
 	return
 }
 
-func (s *Store) hashNormalizedBuildOutput(location string, hash string) (err error) {
+func hashNormalizedBuildOutput(location string, hash string) (err error) {
 	pipeReader, pipeWriter := io.Pipe()
 	errChan := make(chan error)
 	resultChan := make(chan string)
@@ -2,16 +2,25 @@ package store
 
 import (
 	"archive/tar"
+	"archive/zip"
 	"bytes"
 	"compress/gzip"
 	"context"
 	"fmt"
+	"io/fs"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/maxmcd/bramble/internal/offline"
 	"github.com/maxmcd/bramble/internal/types"
 	"github.com/maxmcd/bramble/pkg/test"
+	"github.com/mholt/archiver/v3"
 	"github.com/stretchr/testify/require"
 )
 
@@ -150,3 +159,591 @@ func TestFetchURLBuilder(t *testing.T) {
 		})
 	}
 }
+
+func TestFetchURLBuilder_archives(t *testing.T) {
+	tarball := bytes.NewBuffer(nil)
+	{
+		tw := tar.NewWriter(tarball)
+		_ = tw.WriteHeader(&tar.Header{Name: "dir-1.2/", Typeflag: tar.TypeDir, Mode: 0755})
+		_ = tw.WriteHeader(&tar.Header{Name: "dir-1.2/foo.txt", Typeflag: tar.TypeReg, Size: 7, Mode: 0644})
+		_, _ = tw.Write([]byte("bramble"))
+		_ = tw.Close()
+	}
+	compress := func(c archiver.Compressor) []byte {
+		buf := bytes.NewBuffer(nil)
+		require.NoError(t, c.Compress(bytes.NewReader(tarball.Bytes()), buf))
+		return buf.Bytes()
+	}
+	zipFile := bytes.NewBuffer(nil)
+	{
+		zw := zip.NewWriter(zipFile)
+		w, _ := zw.Create("dir-1.2/foo.txt")
+		_, _ = w.Write([]byte("bramble"))
+		_ = zw.Close()
+	}
+
+	store, err := NewStore(test.TmpDir(t))
+	require.NoError(t, err)
+	for _, tt := range []struct {
+		name string
+		body []byte
+		env  map[string]string
+		file string
+	}{
+		{"tar", tarball.Bytes(), nil, "dir-1.2/foo.txt"},
+		{"tar.gz", compress(archiver.NewGz()), nil, "dir-1.2/foo.txt"},
+		{"tar.xz", compress(archiver.NewXz()), nil, "dir-1.2/foo.txt"},
+		{"tar.bz2", compress(archiver.NewBz2()), nil, "dir-1.2/foo.txt"},
+		{"tar.zst", compress(archiver.NewZstd()), nil, "dir-1.2/foo.txt"},
+		{"zip", zipFile.Bytes(), nil, "dir-1.2/foo.txt"},
+		{"strip_prefix", compress(archiver.NewXz()), map[string]string{"strip_prefix": "dir-1.2/"}, "foo.txt"},
+		{"zip strip_prefix", zipFile.Bytes(), map[string]string{"strip_prefix": "dir-1.2"}, "foo.txt"},
+		{"unpack false", compress(archiver.NewGz()), map[string]string{"unpack": "false"}, "archive"},
+		{"not an archive", []byte("hi"), nil, "archive"},
+		{"gzip not a tarball", func() []byte {
+			buf := bytes.NewBuffer(nil)
+			require.NoError(t, archiver.NewGz().Compress(strings.NewReader("hi"), buf))
+			return buf.Bytes()
+		}(), nil, "archive"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				_, _ = rw.Write(tt.body)
+			}))
+			defer server.Close()
+
+			// The url has no extension, the format is detected from the content
+			env := map[string]string{"url": server.URL + "/archive"}
+			for k, v := range tt.env {
+				env[k] = v
+			}
+			drv, _, err := store.NewBuilder(testLockfileWriter{}).BuildDerivation(context.Background(), Derivation{
+				Name:        "test",
+				Builder:     "basic_fetch_url",
+				OutputNames: []string{"out"},
+				Env:         env,
+			}, BuildDerivationOptions{})
+			require.NoError(t, err)
+			_, err = os.Stat(store.joinStorePath(drv.output("out").Path, tt.file))
+			require.NoError(t, err)
+		})
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		_, _ = rw.Write(tarball.Bytes())
+	}))
+	defer server.Close()
+	_, _, err = store.NewBuilder(testLockfileWriter{}).BuildDerivation(context.Background(), Derivation{
+		Name:        "test",
+		Builder:     "basic_fetch_url",
+		OutputNames: []string{"out"},
+		Env:         map[string]string{"url": server.URL + "/archive", "strip_prefix": "missing"},
+	}, BuildDerivationOptions{})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "isn't a directory")
+}
+
+func TestFetchURLBuilder_mirrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/good/hi.txt":
+			_, _ = rw.Write([]byte("hi"))
+		case "/other/hi.txt":
+			_, _ = rw.Write([]byte("other"))
+		default:
+			rw.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	const (
+		hiSHA256    = "8f434346648f6b96df89dda901c5176b10a6d83961dd3c1ac88b59b2dc327aa4"
+		hiIntegrity = "sha256-j0NDRmSPa5bfid2pAcUXaxCm2Dlh3TwayItZstwyeqQ="
+	)
+	store, err := NewStore(test.TmpDir(t))
+	require.NoError(t, err)
+
+	for _, tt := range []struct {
+		name        string
+		env         map[string]string
+		errContains string
+	}{
+		{"sha256", map[string]string{"url": "/good/hi.txt", "sha256": hiSHA256}, ""},
+		{"integrity", map[string]string{"url": "/good/hi.txt", "integrity": hiIntegrity}, ""},
+		{"mirror after missing url", map[string]string{"urls": "/missing/hi.txt /good/hi.txt", "sha256": hiSHA256}, ""},
+		{"mirror after wrong content", map[string]string{"url": "/other/hi.txt", "urls": "/good/hi.txt", "integrity": hiIntegrity}, ""},
+		{"wrong content", map[string]string{"url": "/other/hi.txt", "sha256": hiSHA256}, "but " + hiSHA256 + " was expected"},
+		{"every mirror fails", map[string]string{"urls": "/missing/hi.txt /other/hi.txt", "sha256": hiSHA256}, "failed for every url"},
+		{"invalid sha256", map[string]string{"url": "/good/hi.txt", "sha256": "abc"}, "must be a hex encoded"},
+		{"unsupported integrity", map[string]string{"url": "/good/hi.txt", "integrity": "md5-abc"}, "unsupported algorithm"},
+		{"sha256 and integrity", map[string]string{"url": "/good/hi.txt", "sha256": hiSHA256, "integrity": hiIntegrity}, "can't have both"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			env := map[string]string{}
+			for k, v := range tt.env {
+				if k == "url" || k == "urls" {
+					var urls []string
+					for _, path := range strings.Fields(v) {
+						urls = append(urls, server.URL+path)
+					}
+					v = strings.Join(urls, " ")
+				}
+				env[k] = v
+			}
+			lfw := testLockfileWriter{}
+			_, _, err := store.NewBuilder(lfw).BuildDerivation(context.Background(), Derivation{
+				Name:        "test",
+				Builder:     "basic_fetch_url",
+				OutputNames: []string{"out"},
+				Env:         env,
+			}, BuildDerivationOptions{ForceBuild: true})
+			if tt.errContains != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tt.errContains)
+				return
+			}
+			require.NoError(t, err)
+			// The output hash is still recorded with the first url as the key
+			key, _ := LockfileKey(Derivation{Builder: "basic_fetch_url", Env: env})
+			require.Equal(t, "basic_fetch_url "+fetchURLs(env)[0], key)
+			require.Equal(t, "5fpq3tqlfd3r5ncyxwapgu5m7ahehe6r", lfw[key])
+		})
+	}
+}
+
+func TestFetchURLBuilder_resume(t *testing.T) {
+	store, err := NewStore(test.TmpDir(t))
+	require.NoError(t, err)
+	body := bytes.Repeat([]byte("bramble"), 1000)
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			// Drop the connection halfway through the first download
+			rw.Header().Set("Content-Length", fmt.Sprint(len(body)))
+			_, _ = rw.Write(body[:len(body)/2])
+			rw.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+		require.Equal(t, fmt.Sprintf("bytes=%d-", len(body)/2), r.Header.Get("Range"))
+		http.ServeContent(rw, r, "", time.Time{}, bytes.NewReader(body))
+	}))
+	defer server.Close()
+
+	progress := bytes.NewBuffer(nil)
+	drv, _, err := store.NewBuilder(testLockfileWriter{}).BuildDerivation(context.Background(), Derivation{
+		Name:        "test",
+		Builder:     "basic_fetch_url",
+		OutputNames: []string{"out"},
+		Env:         map[string]string{"url": server.URL + "/file.txt"},
+	}, BuildDerivationOptions{Progress: progress})
+	require.NoError(t, err)
+	require.Equal(t, 2, requests)
+	b, err := os.ReadFile(store.joinStorePath(drv.output("out").Path, "file.txt"))
+	require.NoError(t, err)
+	require.Equal(t, body, b)
+	require.Contains(t, progress.String(), "↓ file.txt - 6.8 KiB\n")
+}
+
+func TestFetchURLBuilder_downloadCache(t *testing.T) {
+	store, err := NewStore(test.TmpDir(t))
+	require.NoError(t, err)
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		requests++
+		_, _ = rw.Write([]byte("hi"))
+	}))
+	defer server.Close()
+	const hiSHA256 = "8f434346648f6b96df89dda901c5176b10a6d83961dd3c1ac88b59b2dc327aa4"
+
+	// Derivations with different names are different derivations, like the
+	// same url fetched by two projects
+	fetch := func(name string, lfw testLockfileWriter, env map[string]string, opts BuildDerivationOptions) Derivation {
+		t.Helper()
+		env["url"] = server.URL + "/hi.txt"
+		drv, _, err := store.NewBuilder(lfw).BuildDerivation(context.Background(), Derivation{
+			Name:        name,
+			Builder:     "basic_fetch_url",
+			OutputNames: []string{"out"},
+			Env:         env,
+		}, opts)
+		require.NoError(t, err)
+		return drv
+	}
+	lfw := testLockfileWriter{}
+	first := fetch("a", lfw, map[string]string{}, BuildDerivationOptions{})
+	require.Equal(t, 1, requests)
+
+	// The lockfile has the expected hash so the cached download is used
+	second := fetch("b", lfw, map[string]string{}, BuildDerivationOptions{})
+	require.Equal(t, 1, requests)
+	require.Equal(t, first.Outputs, second.Outputs)
+
+	// A project without a lockfile entry doesn't know what to expect
+	_ = fetch("c", testLockfileWriter{}, map[string]string{}, BuildDerivationOptions{})
+	require.Equal(t, 2, requests)
+
+	// A published digest is also a cache key
+	_ = fetch("d", testLockfileWriter{}, map[string]string{"sha256": hiSHA256}, BuildDerivationOptions{})
+	require.Equal(t, 3, requests)
+	_ = fetch("e", testLockfileWriter{}, map[string]string{"sha256": hiSHA256}, BuildDerivationOptions{})
+	require.Equal(t, 3, requests)
+
+	// Forced builds download again
+	_ = fetch("a", lfw, map[string]string{}, BuildDerivationOptions{ForceBuild: true})
+	require.Equal(t, 4, requests)
+
+	// Cached downloads don't need the network
+	test.SetEnv(t, "BRAMBLE_OFFLINE", "true")
+	_ = fetch("f", lfw, map[string]string{}, BuildDerivationOptions{})
+	require.Equal(t, 4, requests)
+}
+
+// gitRepo creates a git repository in dir with the passed commands
+func gitRepo(t *testing.T, dir string, commands ...[]string) {
+	t.Helper()
+	for _, args := range append([][]string{{"init", "--quiet", "-b", "main"}}, commands...) {
+		cmd := exec.Command("git", append([]string{
+			"-c", "user.name=bramble", "-c", "user.email=bramble@example.com",
+			"-c", "protocol.file.allow=always"}, args...)...)
+		cmd.Dir = dir
+		out, err := cmd.CombinedOutput()
+		require.NoError(t, err, string(out))
+	}
+}
+
+func TestFetchGitBuilder(t *testing.T) {
+	sub := t.TempDir()
+	test.WriteFile(t, filepath.Join(sub, "sub.txt"), "sub")
+	gitRepo(t, sub, []string{"add", "."}, []string{"commit", "--quiet", "-m", "sub"})
+
+	repo := t.TempDir()
+	test.WriteFile(t, filepath.Join(repo, "a.txt"), "1")
+	gitRepo(t, repo,
+		[]string{"add", "."},
+		[]string{"commit", "--quiet", "-m", "1"},
+		[]string{"tag", "v1"},
+	)
+	first, err := exec.Command("git", "-C", repo, "rev-parse", "HEAD").Output()
+	require.NoError(t, err)
+	test.WriteFile(t, filepath.Join(repo, "a.txt"), "2")
+	gitRepo(t, repo,
+		[]string{"submodule", "--quiet", "add", "file://" + sub, "sub"},
+		[]string{"commit", "--quiet", "-am", "2"},
+		[]string{"checkout", "--quiet", "-b", "dev"},
+	)
+	test.WriteFile(t, filepath.Join(repo, "a.txt"), "3")
+	gitRepo(t, repo,
+		[]string{"commit", "--quiet", "-am", "3"},
+		[]string{"checkout", "--quiet", "main"},
+	)
+
+	store, err := NewStore(test.TmpDir(t))
+	require.NoError(t, err)
+	url := "file://" + repo
+	fetch := func(name string, env map[string]string) (drv Derivation, lfw testLockfileWriter, err error) {
+		env["url"] = url
+		lfw = testLockfileWriter{}
+		drv, _, err = store.NewBuilder(lfw).BuildDerivation(context.Background(), Derivation{
+			Name:        name,
+			Builder:     "fetch_git",
+			OutputNames: []string{"out"},
+			Env:         env,
+		}, BuildDerivationOptions{})
+		return drv, lfw, err
+	}
+	for _, tt := range []struct {
+		name      string
+		env       map[string]string
+		a         string
+		submodule bool
+	}{
+		{"head", map[string]string{}, "2", false},
+		{"branch", map[string]string{"reference": "dev"}, "3", false},
+		{"tag", map[string]string{"reference": "v1"}, "1", false},
+		{"commit", map[string]string{"reference": strings.TrimSpace(string(first))}, "1", false},
+		{"submodules", map[string]string{"submodules": "true"}, "2", true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			drv, lfw, err := fetch(tt.name, tt.env)
+			require.NoError(t, err)
+			out := store.joinStorePath(drv.output("out").Path)
+			b, err := os.ReadFile(filepath.Join(out, "a.txt"))
+			require.NoError(t, err)
+			require.Equal(t, tt.a, string(b))
+			_, err = os.Stat(filepath.Join(out, "sub", "sub.txt"))
+			require.Equal(t, tt.submodule, err == nil)
+			require.NoError(t, filepath.WalkDir(out, func(path string, d fs.DirEntry, err error) error {
+				require.NotEqual(t, ".git", d.Name())
+				return err
+			}))
+			key := "fetch_git " + url
+			if ref := tt.env["reference"]; ref != "" {
+				key += "@" + ref
+			}
+			require.Equal(t, testLockfileWriter{key: drv.output("out").Path}, lfw)
+		})
+	}
+
+	// The output only depends on the content of the checkout
+	tag, _, err := fetch("tag-again", map[string]string{"reference": "v1"})
+	require.NoError(t, err)
+	commit, _, err := fetch("commit-again", map[string]string{"reference": strings.TrimSpace(string(first))})
+	require.NoError(t, err)
+	require.Equal(t, tag.Outputs, commit.Outputs)
+
+	_, _, err = fetch("missing", map[string]string{"reference": "missing"})
+	require.Error(t, err)
+
+	test.SetEnv(t, "BRAMBLE_OFFLINE", "true")
+	_, _, err = fetch("offline", map[string]string{"reference": "dev"})
+	require.True(t, offline.Is(err))
+}
+
+func TestFetchGitBuilder_options(t *testing.T) {
+	repo := t.TempDir()
+	test.WriteFile(t, filepath.Join(repo, "a.txt"), "1")
+	gitRepo(t, repo, []string{"add", "."}, []string{"commit", "--quiet", "-m", "1"})
+
+	store, err := NewStore(test.TmpDir(t))
+	require.NoError(t, err)
+	storeEntries := func() []string {
+		entries, err := os.ReadDir(store.StorePath)
+		require.NoError(t, err)
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		return names
+	}
+	before := storeEntries()
+
+	marker := filepath.Join(t.TempDir(), "marker")
+	upload := "--upload-pack=touch " + marker + ";git-upload-pack"
+	for _, env := range []map[string]string{
+		{"url": "file://" + repo, "reference": upload},
+		{"url": upload, "reference": "main"},
+	} {
+		lfw := testLockfileWriter{}
+		_, _, err := store.NewBuilder(lfw).BuildDerivation(context.Background(), Derivation{
+			Name:        "malicious",
+			Builder:     "fetch_git",
+			OutputNames: []string{"out"},
+			Env:         env,
+		}, BuildDerivationOptions{})
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "can't start with")
+		require.Empty(t, lfw)
+	}
+	_, err = os.Stat(marker)
+	require.True(t, os.IsNotExist(err))
+	require.Equal(t, before, storeEntries())
+}
+
+func TestFetchURLBuilder_forceBuildDrift(t *testing.T) {
+	store, err := NewStore(test.TmpDir(t))
+	require.NoError(t, err)
+	body := "hi"
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		_, _ = rw.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	drv := Derivation{
+		Name:        "test",
+		Builder:     "basic_fetch_url",
+		OutputNames: []string{"out"},
+		Env:         map[string]string{"url": server.URL + "/hi.txt"},
+	}
+	lfw := testLockfileWriter{}
+	builder := store.NewBuilder(lfw)
+	_, _, err = builder.BuildDerivation(context.Background(), drv, BuildDerivationOptions{})
+	require.NoError(t, err)
+	require.Len(t, lfw, 1)
+
+	// A forced rebuild fetches the url again and is checked against the
+	// lockfile
+	_, _, err = builder.BuildDerivation(context.Background(), drv, BuildDerivationOptions{ForceBuild: true})
+	require.NoError(t, err)
+	body = "changed"
+	_, _, err = builder.BuildDerivation(context.Background(), drv, BuildDerivationOptions{ForceBuild: true})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "doesn't match")
+}
+
+func TestFetchURLBuilder_verify(t *testing.T) {
+	store, err := NewStore(test.TmpDir(t))
+	require.NoError(t, err)
+	body := "hi"
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		_, _ = rw.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	drv := Derivation{
+		Name:        "test",
+		Builder:     "basic_fetch_url",
+		OutputNames: []string{"out"},
+		Env:         map[string]string{"url": server.URL + "/hi.txt"},
+	}
+	lfw := testLockfileWriter{}
+	builder := store.NewBuilder(lfw)
+	built, _, err := builder.BuildDerivation(context.Background(), drv, BuildDerivationOptions{})
+	require.NoError(t, err)
+	storeEntries := func() []string {
+		entries, err := filepath.Glob(filepath.Join(store.StorePath, "*"))
+		require.NoError(t, err)
+		return entries
+	}
+	before := storeEntries()
+
+	// Verifying fetches the url again and is checked against the lockfile
+	verified, _, err := builder.BuildDerivation(context.Background(), drv, BuildDerivationOptions{Verify: true})
+	require.NoError(t, err)
+	require.Equal(t, built.Outputs, verified.Outputs)
+	body = "changed"
+	_, _, err = builder.BuildDerivation(context.Background(), drv, BuildDerivationOptions{Verify: true})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "doesn't match")
+
+	// Nothing is added to the store
+	require.Equal(t, before, storeEntries())
+}
+
+func TestLockfileKey(t *testing.T) {
+	for _, tt := range []struct {
+		drv   Derivation
+		key   string
+		found bool
+	}{
+		{Derivation{Builder: "basic_fetch_url", Env: map[string]string{"url": "a"}}, "basic_fetch_url a", true},
+		{Derivation{Builder: "fetch_url", Env: map[string]string{"urls": "a b"}}, "fetch_url a", true},
+		{Derivation{Builder: "fetch_url", Env: map[string]string{"url": "a", "unpack": "false"}}, "fetch_url a unpack=false", true},
+		{Derivation{Builder: "fetch_url", Env: map[string]string{"url": "a", "strip_prefix": "b/c"}}, "fetch_url a strip_prefix=b/c", true},
+		{Derivation{Builder: "fetch_git", Env: map[string]string{"url": "a"}}, "fetch_git a", true},
+		{Derivation{Builder: "fetch_git", Env: map[string]string{"url": "a", "reference": "main"}}, "fetch_git a@main", true},
+		{Derivation{Builder: "/bin/sh", Env: map[string]string{"url": "a", "confirm_fetch_url": "true"}}, "", false},
+		{Derivation{Name: "download", Builder: "/bin/sh", Network: true}, "fixed_output download", true},
+		{Derivation{Builder: "/bin/sh", Network: true, OutputHash: "uw5ichj6dhcccmcts6p7jq6etzlh5baf"}, "", false},
+	} {
+		key, found := LockfileKey(tt.drv)
+		require.Equal(t, tt.key, key)
+		require.Equal(t, tt.found, found)
+	}
+}
+
+func TestLockfileKeyDerivation(t *testing.T) {
+	for _, env := range []map[string]string{
+		{"url": "https://example.com/a.tar.gz"},
+		{"url": "https://example.com/a.tar.gz", "unpack": "false"},
+		{"url": "https://example.com/a.tar.gz", "strip_prefix": "a-1.0"},
+	} {
+		key, _ := LockfileKey(Derivation{Builder: "fetch_url", Env: env})
+		drv, found := LockfileKeyDerivation(key)
+		require.True(t, found)
+		require.Equal(t, env, drv.Env)
+	}
+	for _, key := range []string{"fetch_git a", "fixed_output a", "fetch_url a other=b"} {
+		_, found := LockfileKeyDerivation(key)
+		require.False(t, found)
+	}
+}
+
+func TestFetchURLBuilder_offline(t *testing.T) {
+	store, err := NewStore(test.TmpDir(t))
+	require.NoError(t, err)
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		requests++
+		_, _ = rw.Write([]byte("hi"))
+	}))
+	defer server.Close()
+
+	drv := Derivation{
+		Name:        "test",
+		Builder:     "basic_fetch_url",
+		OutputNames: []string{"out"},
+		Env:         map[string]string{"url": server.URL + "/hi.txt"},
+	}
+	builder := store.NewBuilder(testLockfileWriter{})
+	test.SetEnv(t, "BRAMBLE_OFFLINE", "1")
+	_, _, err = builder.BuildDerivation(context.Background(), drv, BuildDerivationOptions{})
+	require.Error(t, err)
+	require.True(t, offline.Is(err))
+	require.Equal(t, 0, requests)
+
+	// Once the output is in the store it can be used offline
+	test.SetEnv(t, "BRAMBLE_OFFLINE", "")
+	_, _, err = builder.BuildDerivation(context.Background(), drv, BuildDerivationOptions{})
+	require.NoError(t, err)
+	test.SetEnv(t, "BRAMBLE_OFFLINE", "1")
+	_, didBuild, err := builder.BuildDerivation(context.Background(), drv, BuildDerivationOptions{})
+	require.NoError(t, err)
+	require.False(t, didBuild)
+	require.Equal(t, 1, requests)
+}
+
+func TestBuildDerivation_offlineNetwork(t *testing.T) {
+	store, err := NewStore(test.TmpDir(t))
+	require.NoError(t, err)
+	test.SetEnv(t, "BRAMBLE_OFFLINE", "true")
+	_, _, err = store.NewBuilder(testLockfileWriter{}).BuildDerivation(context.Background(), Derivation{
+		Name:        "network",
+		Builder:     "/bin/sh",
+		Network:     true,
+		OutputHash:  "uw5ichj6dhcccmcts6p7jq6etzlh5baf",
+		OutputNames: []string{"out"},
+	}, BuildDerivationOptions{})
+	require.Error(t, err)
+	require.True(t, offline.Is(err))
+	require.Contains(t, err.Error(), "derivation network requires network access")
+}
+
+func TestCheckDerivationHashes_fixedOutput(t *testing.T) {
+	store, err := NewStore(test.TmpDir(t))
+	require.NoError(t, err)
+	drv := Derivation{
+		Name:        "go-mod-download",
+		Builder:     "/bin/sh",
+		Network:     true,
+		OutputHash:  "uw5ichj6dhcccmcts6p7jq6etzlh5baf",
+		OutputNames: []string{"out"},
+		Outputs:     []Output{{Path: "uw5ichj6dhcccmcts6p7jq6etzlh5baf"}},
+	}
+
+	// The declared hash is checked without using the lockfile
+	lfw := testLockfileWriter{}
+	builder := store.NewBuilder(lfw)
+	require.NoError(t, builder.checkDerivationHashes(drv))
+	require.Empty(t, lfw)
+	drv.Outputs = []Output{{Path: "p2vbvabkdqckjlm43rf7bfccdseizych"}}
+	err = builder.checkDerivationHashes(drv)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "was expected but the output was")
+	require.Empty(t, lfw)
+}
+
+func TestCheckDerivationHashes_fixedOutputLockfile(t *testing.T) {
+	store, err := NewStore(test.TmpDir(t))
+	require.NoError(t, err)
+	drv := Derivation{
+		Name:        "go-mod-download",
+		Builder:     "/bin/sh",
+		Network:     true,
+		OutputNames: []string{"out"},
+		Outputs:     []Output{{Path: "uw5ichj6dhcccmcts6p7jq6etzlh5baf"}},
+	}
+
+	// The hash is recorded on the first build and checked after that
+	lfw := testLockfileWriter{}
+	builder := store.NewBuilder(lfw)
+	require.NoError(t, builder.checkDerivationHashes(drv))
+	require.Equal(t, testLockfileWriter{"fixed_output go-mod-download": "uw5ichj6dhcccmcts6p7jq6etzlh5baf"}, lfw)
+
+	// A changed build keeps the key, so a different output is reported
+	drv.Args = []string{"-c", "changed"}
+	drv.Outputs = []Output{{Path: "p2vbvabkdqckjlm43rf7bfccdseizych"}}
+	err = builder.checkDerivationHashes(drv)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "was expected but the output was")
+	require.Len(t, lfw, 1)
+}
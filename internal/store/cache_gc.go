@@ -0,0 +1,285 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/maxmcd/bramble/pkg/chunkedarchive"
+	"github.com/pkg/errors"
+)
+
+// CacheRetention is the policy used to remove objects from cache storage.
+// Outputs are removed when they haven't been accessed for MaxAge, and then
+// least recently accessed first until the cache is smaller than MaxSize. A
+// zero value disables that limit. Derivations are removed along with their
+// outputs and chunks are removed once no output refers to them.
+type CacheRetention struct {
+	MaxSize int64
+	MaxAge  time.Duration
+
+	// GracePeriod protects recently written objects that are unreferenced or
+	// incomplete, they are likely part of an upload that is still in progress.
+	GracePeriod time.Duration
+}
+
+// CacheKindUsage is the number and total size of objects of one kind.
+type CacheKindUsage struct {
+	Count int
+	Size  int64
+}
+
+func (ku *CacheKindUsage) add(info CacheObjectInfo) {
+	ku.Count++
+	ku.Size += info.Size
+}
+
+// CacheUsage reports the objects in cache storage.
+type CacheUsage struct {
+	Derivations CacheKindUsage
+	Outputs     CacheKindUsage
+	Chunks      CacheKindUsage
+	Size        int64
+}
+
+func (cu *CacheUsage) add(kind CacheObjectKind, info CacheObjectInfo) {
+	switch kind {
+	case CacheDerivation:
+		cu.Derivations.add(info)
+	case CacheOutput:
+		cu.Outputs.add(info)
+	case CacheChunk:
+		cu.Chunks.add(info)
+	}
+	cu.Size += info.Size
+}
+
+// CacheStorageUsage returns the number and size of the objects in storage.
+func CacheStorageUsage(ctx context.Context, storage CacheStorage) (usage CacheUsage, err error) {
+	for _, kind := range CacheObjectKinds {
+		objects, err := storage.List(ctx, kind)
+		if err != nil {
+			return usage, err
+		}
+		for _, info := range objects {
+			usage.add(kind, info)
+		}
+	}
+	return usage, nil
+}
+
+type cacheGC struct {
+	ctx       context.Context
+	storage   CacheStorage
+	retention CacheRetention
+	now       time.Time
+
+	derivations []CacheObjectInfo
+	outputs     []CacheObjectInfo
+	chunks      map[string]CacheObjectInfo
+
+	// outputChunks is the set of chunks that each output references and
+	// chunkRefs is the number of remaining outputs that reference each chunk
+	outputChunks map[string][]string
+	chunkRefs    map[string]int
+
+	// outputDerivations are the derivations that list each output
+	outputDerivations map[string][]CacheObjectInfo
+
+	removedOutputs     map[string]struct{}
+	removedDerivations map[string]struct{}
+	size               int64
+}
+
+// CollectCacheGarbage removes objects from storage according to the retention
+// policy and returns the usage of the objects that were removed.
+func CollectCacheGarbage(ctx context.Context, storage CacheStorage, retention CacheRetention) (removed CacheUsage, err error) {
+	gc := &cacheGC{
+		ctx:                ctx,
+		storage:            storage,
+		retention:          retention,
+		now:                time.Now(),
+		chunks:             map[string]CacheObjectInfo{},
+		outputChunks:       map[string][]string{},
+		chunkRefs:          map[string]int{},
+		outputDerivations:  map[string][]CacheObjectInfo{},
+		removedOutputs:     map[string]struct{}{},
+		removedDerivations: map[string]struct{}{},
+	}
+	if err := gc.load(); err != nil {
+		return removed, err
+	}
+	gc.expireOutputs()
+
+	// Remove the objects that are now unreferenced in the order that they are
+	// used by substitution, so that a concurrent reader never finds a
+	// derivation that points to deleted outputs
+	for _, info := range gc.derivations {
+		if _, ok := gc.removedDerivations[info.Name]; !ok {
+			continue
+		}
+		if err := storage.Delete(ctx, CacheDerivation, info.Name); err != nil {
+			return removed, err
+		}
+		removed.add(CacheDerivation, info)
+	}
+	for _, info := range gc.outputs {
+		if _, ok := gc.removedOutputs[info.Name]; !ok {
+			continue
+		}
+		if err := storage.Delete(ctx, CacheOutput, info.Name); err != nil {
+			return removed, err
+		}
+		removed.add(CacheOutput, info)
+	}
+	for hash, info := range gc.chunks {
+		if !gc.chunkRemovable(hash) {
+			continue
+		}
+		if err := storage.Delete(ctx, CacheChunk, hash); err != nil {
+			return removed, err
+		}
+		removed.add(CacheChunk, info)
+	}
+	return removed, nil
+}
+
+func (gc *cacheGC) load() (err error) {
+	if gc.derivations, err = gc.storage.List(gc.ctx, CacheDerivation); err != nil {
+		return err
+	}
+	if gc.outputs, err = gc.storage.List(gc.ctx, CacheOutput); err != nil {
+		return err
+	}
+	chunks, err := gc.storage.List(gc.ctx, CacheChunk)
+	if err != nil {
+		return err
+	}
+	for _, info := range chunks {
+		gc.chunks[info.Name] = info
+	}
+	outputs := map[string]struct{}{}
+	for _, info := range gc.outputs {
+		outputs[info.Name] = struct{}{}
+		gc.size += info.Size
+		var toc []chunkedarchive.TOCEntry
+		if err := gc.readJSON(CacheOutput, info.Name, &toc); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		seen := map[string]struct{}{}
+		for _, entry := range toc {
+			for _, hash := range entry.Body {
+				if _, ok := seen[hash]; ok {
+					continue
+				}
+				seen[hash] = struct{}{}
+				gc.outputChunks[info.Name] = append(gc.outputChunks[info.Name], hash)
+				gc.chunkRefs[hash]++
+			}
+		}
+	}
+	for hash, info := range gc.chunks {
+		if !gc.chunkRemovable(hash) {
+			gc.size += info.Size
+		}
+	}
+	return gc.loadDerivations(outputs)
+}
+
+// loadDerivations records the outputs of each derivation. Derivations that
+// have an output that is missing from the cache are removed, unless they're
+// recent, derivations are uploaded before their outputs.
+func (gc *cacheGC) loadDerivations(outputs map[string]struct{}) error {
+	for _, info := range gc.derivations {
+		var drv Derivation
+		if err := gc.readJSON(CacheDerivation, info.Name, &drv); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		gc.size += info.Size
+		complete := true
+		for _, output := range drv.Outputs {
+			if _, ok := outputs[output.Path]; !ok {
+				complete = false
+			}
+			gc.outputDerivations[output.Path] = append(gc.outputDerivations[output.Path], info)
+		}
+		if !complete && !gc.inGracePeriod(info) {
+			gc.removeDerivation(info)
+		}
+	}
+	return nil
+}
+
+func (gc *cacheGC) readJSON(kind CacheObjectKind, name string, v interface{}) error {
+	f, err := gc.storage.Get(gc.ctx, kind, name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(v); err != nil {
+		return errors.Wrapf(err, "error decoding cache %s %q", kind, name)
+	}
+	return nil
+}
+
+func (gc *cacheGC) inGracePeriod(info CacheObjectInfo) bool {
+	return gc.now.Sub(info.LastAccess) < gc.retention.GracePeriod
+}
+
+func (gc *cacheGC) chunkRemovable(hash string) bool {
+	return gc.chunkRefs[hash] == 0 && !gc.inGracePeriod(gc.chunks[hash])
+}
+
+func (gc *cacheGC) removeOutput(info CacheObjectInfo) {
+	if _, ok := gc.removedOutputs[info.Name]; ok {
+		return
+	}
+	gc.removedOutputs[info.Name] = struct{}{}
+	gc.size -= info.Size
+	// Derivations are removed along with their outputs
+	for _, drv := range gc.outputDerivations[info.Name] {
+		gc.removeDerivation(drv)
+	}
+	for _, hash := range gc.outputChunks[info.Name] {
+		gc.chunkRefs[hash]--
+		if chunk, ok := gc.chunks[hash]; ok && gc.chunkRemovable(hash) {
+			gc.size -= chunk.Size
+		}
+	}
+}
+
+func (gc *cacheGC) expireOutputs() {
+	sort.Slice(gc.outputs, func(i, j int) bool {
+		return gc.outputs[i].LastAccess.Before(gc.outputs[j].LastAccess)
+	})
+	for _, info := range gc.outputs {
+		if gc.retention.MaxAge > 0 && gc.now.Sub(info.LastAccess) > gc.retention.MaxAge {
+			gc.removeOutput(info)
+		}
+	}
+	if gc.retention.MaxSize <= 0 {
+		return
+	}
+	for _, info := range gc.outputs {
+		if gc.size <= gc.retention.MaxSize {
+			return
+		}
+		gc.removeOutput(info)
+	}
+}
+
+func (gc *cacheGC) removeDerivation(info CacheObjectInfo) {
+	if _, ok := gc.removedDerivations[info.Name]; ok {
+		return
+	}
+	gc.removedDerivations[info.Name] = struct{}{}
+	gc.size -= info.Size
+}
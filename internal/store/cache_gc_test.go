@@ -0,0 +1,117 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/maxmcd/bramble/pkg/chunkedarchive"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCollectCacheGarbage(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	storage := NewFileCacheStorage(dir)
+	put := func(kind CacheObjectKind, name string, v interface{}, age time.Duration) {
+		b, ok := v.([]byte)
+		if !ok {
+			var err error
+			b, err = json.Marshal(v)
+			require.NoError(t, err)
+		}
+		require.NoError(t, storage.Put(ctx, kind, name, bytes.NewReader(b)))
+		ts := time.Now().Add(-age)
+		require.NoError(t, os.Chtimes(filepath.Join(dir, string(kind), name), ts, ts))
+	}
+	names := func(kind CacheObjectKind) (out []string) {
+		objects, err := storage.List(ctx, kind)
+		require.NoError(t, err)
+		for _, info := range objects {
+			out = append(out, info.Name)
+		}
+		sort.Strings(out)
+		return out
+	}
+	day := time.Hour * 24
+	toc := func(chunks ...string) []chunkedarchive.TOCEntry {
+		return []chunkedarchive.TOCEntry{{Name: "a", Type: "reg", Body: chunks}}
+	}
+
+	put(CacheChunk, "c1", []byte("1"), 3*day)
+	put(CacheChunk, "c2", []byte("2"), 3*day)
+	put(CacheChunk, "c3", []byte("3"), 3*day)
+	put(CacheChunk, "unreferenced", []byte("4"), 3*day)
+	put(CacheChunk, "uploading", []byte("5"), 0)
+	put(CacheOutput, "old", toc("c1", "c2"), 2*day)
+	put(CacheOutput, "new", toc("c2", "c3"), 0)
+	put(CacheDerivation, "old.drv", Derivation{Outputs: []Output{{Path: "old"}}}, 2*day)
+	put(CacheDerivation, "new.drv", Derivation{Outputs: []Output{{Path: "new"}}}, 0)
+	put(CacheDerivation, "incomplete.drv", Derivation{Outputs: []Output{{Path: "missing"}}}, 3*day)
+	put(CacheDerivation, "pending.drv", Derivation{Outputs: []Output{{Path: "missing"}}}, 0)
+
+	before, err := CacheStorageUsage(ctx, storage)
+	require.NoError(t, err)
+	require.Equal(t, 5, before.Chunks.Count)
+	require.Equal(t, int64(5), before.Chunks.Size)
+
+	removed, err := CollectCacheGarbage(ctx, storage, CacheRetention{
+		MaxAge:      day,
+		GracePeriod: time.Hour,
+	})
+	require.NoError(t, err)
+	require.Equal(t, 2, removed.Chunks.Count)
+	require.Equal(t, []string{"c2", "c3", "uploading"}, names(CacheChunk))
+	require.Equal(t, []string{"new"}, names(CacheOutput))
+	require.Equal(t, []string{"new.drv", "pending.drv"}, names(CacheDerivation))
+
+	after, err := CacheStorageUsage(ctx, storage)
+	require.NoError(t, err)
+	require.Equal(t, before.Size-removed.Size, after.Size)
+
+	// A small max size removes everything that isn't protected by the grace
+	// period
+	_, err = CollectCacheGarbage(ctx, storage, CacheRetention{
+		MaxSize:     1,
+		GracePeriod: time.Hour,
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"uploading"}, names(CacheChunk))
+	require.Empty(t, names(CacheOutput))
+	require.Equal(t, []string{"pending.drv"}, names(CacheDerivation))
+}
+
+func TestCollectCacheGarbage_derivationSize(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	storage := NewFileCacheStorage(dir)
+	put := func(kind CacheObjectKind, name string, v interface{}, age time.Duration) {
+		b, err := json.Marshal(v)
+		require.NoError(t, err)
+		require.NoError(t, storage.Put(ctx, kind, name, bytes.NewReader(b)))
+		ts := time.Now().Add(-age)
+		require.NoError(t, os.Chtimes(filepath.Join(dir, string(kind), name), ts, ts))
+	}
+	// The derivations make up almost all of the size of the cache
+	name := strings.Repeat("a", 1000)
+	put(CacheOutput, "old", []chunkedarchive.TOCEntry{}, 2*time.Hour)
+	put(CacheOutput, "new", []chunkedarchive.TOCEntry{}, time.Hour)
+	put(CacheDerivation, "old.drv", Derivation{Name: name, Outputs: []Output{{Path: "old"}}}, 2*time.Hour)
+	put(CacheDerivation, "new.drv", Derivation{Name: name, Outputs: []Output{{Path: "new"}}}, time.Hour)
+
+	// Removing the old output and its derivation is enough to fit
+	removed, err := CollectCacheGarbage(ctx, storage, CacheRetention{MaxSize: 1500})
+	require.NoError(t, err)
+	require.Equal(t, 1, removed.Derivations.Count)
+	require.Equal(t, 1, removed.Outputs.Count)
+	objects, err := storage.List(ctx, CacheDerivation)
+	require.NoError(t, err)
+	require.Len(t, objects, 1)
+	require.Equal(t, "new.drv", objects[0].Name)
+}
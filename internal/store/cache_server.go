@@ -2,6 +2,7 @@ package store
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -9,18 +10,72 @@ import (
 	"os"
 
 	"github.com/maxmcd/bramble/pkg/chunkedarchive"
+	"github.com/maxmcd/bramble/pkg/hasher"
 	"github.com/maxmcd/bramble/pkg/httpx"
+	"github.com/maxmcd/bramble/pkg/metrics"
 	"github.com/pkg/errors"
 )
 
-type storeHashFetcher struct {
-	store *Store
+const maxChunkSize = 4e6
+
+var (
+	cacheLookups = metrics.NewCounter(
+		"bramble_cache_lookups_total",
+		"Cache server GET requests by route and whether the object was found.",
+		"route", "result")
+	cacheBytes = metrics.NewCounter(
+		"bramble_cache_bytes_total",
+		"Bytes received and sent by the cache server.",
+		"route", "direction")
+	cacheObjects = metrics.NewGauge(
+		"bramble_cache_objects",
+		"Number of objects in cache storage.",
+		"kind")
+	cacheSize = metrics.NewGauge(
+		"bramble_cache_size_bytes",
+		"Size of the objects in cache storage.",
+		"kind")
+)
+
+// countingReader counts the bytes read from a request body.
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (n int, err error) {
+	n, err = cr.ReadCloser.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// ReportCacheUsage updates the cache size metrics with the current usage of
+// the storage.
+func ReportCacheUsage(ctx context.Context, storage CacheStorage) error {
+	usage, err := CacheStorageUsage(ctx, storage)
+	if err != nil {
+		return err
+	}
+	for kind, ku := range map[CacheObjectKind]CacheKindUsage{
+		CacheDerivation: usage.Derivations,
+		CacheOutput:     usage.Outputs,
+		CacheChunk:      usage.Chunks,
+	} {
+		cacheObjects.With(string(kind)).Set(float64(ku.Count))
+		cacheSize.With(string(kind)).Set(float64(ku.Size))
+	}
+	return nil
+}
+
+type storageHashFetcher struct {
+	ctx     context.Context
+	storage CacheStorage
 }
 
-var _ chunkedarchive.HashFetcher = new(storeHashFetcher)
+var _ chunkedarchive.HashFetcher = new(storageHashFetcher)
 
-func (hf *storeHashFetcher) Lookup(hash string) (file io.ReadCloser, err error) {
-	return os.Open(hf.store.joinStorePath(hash))
+func (hf *storageHashFetcher) Lookup(hash string) (file io.ReadCloser, err error) {
+	return hf.storage.Get(hf.ctx, CacheChunk, hash)
 }
 
 type OutputRequestBody struct {
@@ -28,103 +83,215 @@ type OutputRequestBody struct {
 	TOC    []chunkedarchive.TOCEntry
 }
 
-// Uploads a derivation and all outputs
-// Sources aren't uploaded
-// Outputs are uploaded in 4mb body chunks
-func (s *Store) CacheServer() http.Handler {
+// CacheServerOptions configure a cache server
+type CacheServerOptions struct {
+	// Token must be sent as a bearer token to upload to the cache or to read
+	// /admin/usage. Both are disabled when it's empty.
+	Token string
+}
+
+// CacheServer serves the build cache from the store's cache storage.
+func (s *Store) CacheServer(opts CacheServerOptions) http.Handler {
+	return NewCacheServer(s.CacheStorage(), opts)
+}
+
+// NewCacheServer serves a build cache backed by the storage. Uploads a
+// derivation and all outputs. Sources aren't uploaded. Outputs are uploaded in
+// 4mb body chunks. The number and size of cached objects is reported to
+// clients with the token at /admin/usage.
+func NewCacheServer(storage CacheStorage, opts CacheServerOptions) http.Handler {
+	cache := storageCache{storage: storage}
 	router := httpx.New()
-	router.GET("/derivation/:filename", func(c httpx.Context) (err error) {
-		f, err := os.Open(s.joinStorePath(c.Params.ByName("filename")))
-		if err != nil {
-			return httpx.ErrNotFound(err)
-		}
-		defer f.Close()
-		_, err = io.Copy(c.ResponseWriter, f)
-		return err
-	})
-	router.GET("/output/:hash", func(c httpx.Context) (err error) {
-		f, err := os.Open(s.joinStorePath(c.Params.ByName("hash")))
-		if err != nil {
-			return httpx.ErrNotFound(err)
-		}
-		var toc []chunkedarchive.TOCEntry
-		if err := json.NewDecoder(f).Decode(&toc); err != nil {
-			// If the hash isn't a valid TOC then it's not an output
-			return httpx.ErrNotFound(err)
-		}
-		_, _ = f.Seek(0, 0)
-		_, err = io.Copy(c.ResponseWriter, f)
-		return err
-	})
-	router.GET("/chunk/:hash", func(c httpx.Context) (err error) {
-		f, err := os.Open(s.joinStorePath(c.Params.ByName("hash")))
-		if err != nil {
-			return httpx.ErrNotFound(err)
-		}
-		_, err = io.Copy(c.ResponseWriter, f)
-		return err
-	})
+	authorize := func(c httpx.Context) error {
+		return httpx.CheckToken(c.Request, opts.Token)
+	}
+	get := func(route string, kind CacheObjectKind, param string) {
+		router.GET(route, func(c httpx.Context) (err error) {
+			f, err := getCacheObject(c.Request.Context(), storage, kind, c.Params.ByName(param))
+			if err != nil {
+				if os.IsNotExist(err) {
+					cacheLookups.With(route, "miss").Inc()
+					return httpx.ErrNotFound(err)
+				}
+				return err
+			}
+			defer f.Close()
+			cacheLookups.With(route, "hit").Inc()
+			n, err := io.Copy(c.ResponseWriter, f)
+			cacheBytes.With(route, "out").Add(float64(n))
+			return err
+		})
+	}
+	get("/derivation/:filename", CacheDerivation, "filename")
+	get("/output/:hash", CacheOutput, "hash")
+	get("/chunk/:hash", CacheChunk, "hash")
+
+	// post counts the bytes received by each upload route
+	post := func(route string, handle func(c httpx.Context) error) {
+		router.POST(route, func(c httpx.Context) error {
+			if err := authorize(c); err != nil {
+				return err
+			}
+			body := &countingReader{ReadCloser: c.Request.Body}
+			c.Request.Body = body
+			defer func() { cacheBytes.With(route, "in").Add(float64(body.n)) }()
+			return handle(c)
+		})
+	}
 
-	router.POST("/derivation", func(c httpx.Context) (err error) {
+	post("/derivation", func(c httpx.Context) (err error) {
 		var drv Derivation
 		if err := json.NewDecoder(c.Request.Body).Decode(&drv); err != nil {
 			return httpx.ErrUnprocessableEntity(err)
 		}
-		var buf bytes.Buffer
-		if err := json.NewEncoder(&buf).Encode(drv); err != nil {
-			return err
-		}
-		filename, err := s.WriteDerivation(drv)
+		filename, err := cache.PostDerivation(c.Request.Context(), drv)
 		if err != nil {
 			return err
 		}
 		fmt.Fprint(c.ResponseWriter, filename)
 		return nil
 	})
-	router.POST("/output", func(c httpx.Context) (err error) {
+	post("/output", func(c httpx.Context) (err error) {
 		var req OutputRequestBody
 		if err := json.NewDecoder(c.Request.Body).Decode(&req); err != nil {
 			return httpx.ErrUnprocessableEntity(err)
 		}
-
-		tempDir, err := os.MkdirTemp("", "")
+		return cache.PostOutput(c.Request.Context(), req)
+	})
+	post("/chunk", func(c httpx.Context) (err error) {
+		hash, err := cache.PostChunk(c.Request.Context(), c.Request.Body)
 		if err != nil {
 			return err
 		}
-		defer os.RemoveAll(tempDir)
-		if err := chunkedarchive.Unarchive(req.TOC, &storeHashFetcher{store: s}, tempDir); err != nil {
-			return err
-		}
-		if err := s.hashNormalizedBuildOutput(tempDir, req.Output.Path); err != nil {
+		fmt.Fprint(c.ResponseWriter, hash)
+		return nil
+	})
+	router.GET("/admin/usage", func(c httpx.Context) (err error) {
+		if err := authorize(c); err != nil {
 			return err
 		}
-		f, err := os.Create(s.joinStorePath(req.Output.Path + ".output"))
+		usage, err := CacheStorageUsage(c.Request.Context(), storage)
 		if err != nil {
 			return err
 		}
-		if err := json.NewEncoder(f).Encode(req.TOC); err != nil {
-			return err
-		}
-		return nil
+		return c.JSON(usage)
 	})
-	router.POST("/chunk", func(c httpx.Context) (err error) {
-		hash, err := s.WriteBlob(c.Request.Body)
-		if err != nil {
-			return err
-		}
-		loc := s.joinStorePath(hash)
-		fi, err := os.Stat(loc)
+
+	return router
+}
+
+// CacheStorage returns the storage used for the store's own build cache.
+func (s *Store) CacheStorage() CacheStorage {
+	return NewFileCacheStorage(s.joinBramblePath("var/cache"))
+}
+
+// LocalCache returns a cache that reads and writes directly to the store's
+// cache storage. It is used to add build outputs to the cache that the store
+// serves with CacheServer without going through http.
+func (s *Store) LocalCache() Cache {
+	return NewStorageCache(s.CacheStorage())
+}
+
+// NewStorageCache returns a Cache that reads and writes directly to the
+// storage.
+func NewStorageCache(storage CacheStorage) Cache {
+	return storageCache{storage: storage}
+}
+
+type storageCache struct {
+	storage CacheStorage
+}
+
+var _ Cache = storageCache{}
+
+func (sc storageCache) PostChunk(ctx context.Context, chunk io.Reader) (hash string, err error) {
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, io.LimitReader(chunk, maxChunkSize+1)); err != nil {
+		return "", err
+	}
+	if buf.Len() > maxChunkSize {
+		return "", httpx.ErrUnprocessableEntity(errors.New("chunk size can't be larger than 4MB"))
+	}
+	h := hasher.New()
+	_, _ = h.Write(buf.Bytes())
+	hash = h.String()
+	return hash, sc.storage.Put(ctx, CacheChunk, hash, &buf)
+}
+
+// PostDerivation stores the derivation. A derivation that is already in the
+// cache is never replaced, clients trust the outputs it lists.
+func (sc storageCache) PostDerivation(ctx context.Context, drv Derivation) (filename string, err error) {
+	drv = formatDerivation(drv)
+	filename = drv.Filename()
+	f, err := sc.storage.Get(ctx, CacheDerivation, filename)
+	if err == nil {
+		defer f.Close()
+		existing, err := io.ReadAll(f)
 		if err != nil {
-			return err
+			return "", err
 		}
-		if fi.Size() > 4e6 {
-			_ = os.Remove(loc)
-			return httpx.ErrUnprocessableEntity(errors.New("chunk size can't be larger than 4MB"))
+		if !bytes.Equal(existing, drv.JSON()) {
+			return "", httpx.ErrConflict(errors.Errorf("derivation %s is already in the cache with different outputs", filename))
 		}
+		return filename, nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+	return filename, sc.storage.Put(ctx, CacheDerivation, filename, bytes.NewReader(drv.JSON()))
+}
 
-		fmt.Fprint(c.ResponseWriter, hash)
-		return nil
-	})
+// PostOutput confirms that the chunks referenced by the TOC make up an output
+// with the expected hash and then stores the TOC.
+func (sc storageCache) PostOutput(ctx context.Context, req OutputRequestBody) (err error) {
+	tempDir, err := os.MkdirTemp("", "")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tempDir)
+	if err := chunkedarchive.Unarchive(req.TOC, &storageHashFetcher{ctx: ctx, storage: sc.storage}, tempDir); err != nil {
+		return err
+	}
+	if err := hashNormalizedBuildOutput(tempDir, req.Output.Path); err != nil {
+		return err
+	}
+	b, err := json.Marshal(req.TOC)
+	if err != nil {
+		return err
+	}
+	return sc.storage.Put(ctx, CacheOutput, req.Output.Path, bytes.NewReader(b))
+}
 
-	return router
+func (sc storageCache) GetDerivation(ctx context.Context, filename string) (drv Derivation, exists bool, err error) {
+	f, err := getCacheObject(ctx, sc.storage, CacheDerivation, filename)
+	if os.IsNotExist(err) {
+		return drv, false, nil
+	}
+	if err != nil {
+		return drv, false, err
+	}
+	defer f.Close()
+	return drv, true, json.NewDecoder(f).Decode(&drv)
+}
+
+func (sc storageCache) GetOutput(ctx context.Context, hash string) (toc []chunkedarchive.TOCEntry, exists bool, err error) {
+	f, err := getCacheObject(ctx, sc.storage, CacheOutput, hash)
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	defer f.Close()
+	return toc, true, json.NewDecoder(f).Decode(&toc)
+}
+
+func (sc storageCache) GetChunk(ctx context.Context, hash string, chunk io.Writer) (err error) {
+	f, err := getCacheObject(ctx, sc.storage, CacheChunk, hash)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(chunk, f)
+	return err
 }
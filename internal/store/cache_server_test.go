@@ -0,0 +1,224 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/maxmcd/bramble/pkg/metrics"
+	"github.com/maxmcd/bramble/pkg/s3"
+	"github.com/maxmcd/bramble/pkg/s3/s3test"
+	"github.com/maxmcd/bramble/pkg/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStoreSubstitute(t *testing.T) {
+	ctx := context.Background()
+	fail := false
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if fail {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = rw.Write([]byte("bramble"))
+	}))
+	drv := Derivation{
+		Name:        "test",
+		Builder:     "basic_fetch_url",
+		OutputNames: []string{"out"},
+		Env:         map[string]string{"url": server.URL + "/hi.txt"},
+	}
+
+	buildStore, err := NewStore(test.TmpDir(t))
+	require.NoError(t, err)
+	built, didBuild, err := buildStore.NewBuilder(testLockfileWriter{}).
+		BuildDerivation(ctx, drv, BuildDerivationOptions{})
+	require.NoError(t, err)
+	require.True(t, didBuild)
+
+	s3Server := s3test.NewServer("key")
+	defer s3Server.Close()
+	cache := NewStorageCache(NewS3CacheStorage(
+		s3.NewClient(s3Server.URL, "", "bucket", "key", "secret"), ""))
+	require.NoError(t, buildStore.UploadDerivationsToCache(ctx, []Derivation{built}, cache))
+
+	// The url is no longer available, the output must come from the cache
+	fail = true
+	clientStore, err := NewStore(test.TmpDir(t))
+	require.NoError(t, err)
+	clientStore.AddCacheSubstituter(cache)
+	substituted, didBuild, err := clientStore.NewBuilder(testLockfileWriter{}).
+		BuildDerivation(ctx, drv, BuildDerivationOptions{})
+	require.NoError(t, err)
+	require.False(t, didBuild)
+	require.Equal(t, built.Outputs, substituted.Outputs)
+	exists, err := clientStore.outputFoldersExist(substituted.Outputs)
+	require.NoError(t, err)
+	require.True(t, exists)
+
+	// Without a cache the build fails
+	emptyStore, err := NewStore(test.TmpDir(t))
+	require.NoError(t, err)
+	_, _, err = emptyStore.NewBuilder(testLockfileWriter{}).
+		BuildDerivation(ctx, drv, BuildDerivationOptions{})
+	require.Error(t, err)
+}
+
+func TestCacheStorage(t *testing.T) {
+	ctx := context.Background()
+	s3Server := s3test.NewServer("key")
+	defer s3Server.Close()
+
+	for _, tt := range []struct {
+		name    string
+		storage CacheStorage
+	}{
+		{"file", NewFileCacheStorage(t.TempDir())},
+		{"s3", NewS3CacheStorage(s3.NewClient(s3Server.URL, "", "bucket", "key", "secret"), "/team/")},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.storage.Get(ctx, CacheChunk, "missing")
+			require.True(t, os.IsNotExist(err))
+
+			require.NoError(t, tt.storage.Put(ctx, CacheChunk, "a", bytes.NewBufferString("chunk")))
+			require.NoError(t, tt.storage.Put(ctx, CacheOutput, "a", bytes.NewBufferString("toc")))
+
+			for kind, want := range map[CacheObjectKind]string{CacheChunk: "chunk", CacheOutput: "toc"} {
+				f, err := tt.storage.Get(ctx, kind, "a")
+				require.NoError(t, err)
+				b, err := io.ReadAll(f)
+				require.NoError(t, err)
+				_ = f.Close()
+				require.Equal(t, want, string(b))
+			}
+			_, err = tt.storage.Get(ctx, CacheDerivation, "a")
+			require.True(t, os.IsNotExist(err))
+
+			require.Error(t, tt.storage.Put(ctx, CacheChunk, "../a", bytes.NewBufferString("")))
+
+			objects, err := tt.storage.List(ctx, CacheChunk)
+			require.NoError(t, err)
+			require.Len(t, objects, 1)
+			require.Equal(t, "a", objects[0].Name)
+			require.Equal(t, int64(5), objects[0].Size)
+			require.False(t, objects[0].LastAccess.IsZero())
+
+			require.NoError(t, tt.storage.Delete(ctx, CacheChunk, "a"))
+			require.NoError(t, tt.storage.Delete(ctx, CacheChunk, "a"))
+			objects, err = tt.storage.List(ctx, CacheChunk)
+			require.NoError(t, err)
+			require.Len(t, objects, 0)
+		})
+	}
+	require.Contains(t, s3Server.Objects(), "bucket/team/output/a")
+}
+
+func TestCacheServerMetrics(t *testing.T) {
+	ctx := context.Background()
+	storage := NewFileCacheStorage(t.TempDir())
+	server := httptest.NewServer(NewCacheServer(storage, CacheServerOptions{Token: "token"}))
+	defer server.Close()
+
+	resp, err := postChunk(server.URL, "token", "chunk")
+	require.NoError(t, err)
+	hash, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	for _, path := range []string{"/chunk/" + string(hash), "/chunk/missing"} {
+		resp, err := http.Get(server.URL + path)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+	}
+	require.NoError(t, ReportCacheUsage(ctx, storage))
+
+	var buf bytes.Buffer
+	require.NoError(t, metrics.DefaultRegistry.Write(&buf))
+	for _, line := range []string{
+		`bramble_cache_lookups_total{route="/chunk/:hash",result="hit"}`,
+		`bramble_cache_lookups_total{route="/chunk/:hash",result="miss"}`,
+		`bramble_cache_bytes_total{route="/chunk",direction="in"}`,
+		`bramble_cache_bytes_total{route="/chunk/:hash",direction="out"}`,
+		`bramble_cache_objects{kind="chunk"} 1`,
+		`bramble_cache_size_bytes{kind="chunk"} 5`,
+		`bramble_http_request_duration_seconds_count{method="GET",route="/chunk/:hash",code="404"}`,
+	} {
+		require.Contains(t, buf.String(), line)
+	}
+}
+
+func postChunk(url, token, chunk string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodPost, url+"/chunk", bytes.NewBufferString(chunk))
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return http.DefaultClient.Do(req)
+}
+
+func TestCacheServerUploadToken(t *testing.T) {
+	for _, tt := range []struct {
+		serverToken string
+		token       string
+		code        int
+	}{
+		{"", "", http.StatusUnauthorized},
+		{"", "token", http.StatusUnauthorized},
+		{"token", "", http.StatusUnauthorized},
+		{"token", "wrong", http.StatusUnauthorized},
+		{"token", "token", http.StatusOK},
+	} {
+		storage := NewFileCacheStorage(t.TempDir())
+		server := httptest.NewServer(NewCacheServer(storage, CacheServerOptions{Token: tt.serverToken}))
+		resp, err := postChunk(server.URL, tt.token, "chunk")
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		server.Close()
+		require.Equal(t, tt.code, resp.StatusCode, tt)
+		objects, err := storage.List(context.Background(), CacheChunk)
+		require.NoError(t, err)
+		require.Equal(t, tt.code == http.StatusOK, len(objects) == 1)
+	}
+
+	// Usage is only reported with the token
+	server := httptest.NewServer(NewCacheServer(NewFileCacheStorage(t.TempDir()), CacheServerOptions{Token: "token"}))
+	defer server.Close()
+	for token, code := range map[string]int{"": http.StatusUnauthorized, "token": http.StatusOK} {
+		req, err := http.NewRequest(http.MethodGet, server.URL+"/admin/usage", nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		require.Equal(t, code, resp.StatusCode)
+	}
+}
+
+func TestStorageCache_PostDerivation(t *testing.T) {
+	ctx := context.Background()
+	cache := NewStorageCache(NewFileCacheStorage(t.TempDir()))
+	drv := Derivation{
+		Name:        "test",
+		Builder:     "/bin/sh",
+		OutputNames: []string{"out"},
+		Outputs:     []Output{{Path: "uw5ichj6dhcccmcts6p7jq6etzlh5baf"}},
+	}
+	filename, err := cache.PostDerivation(ctx, drv)
+	require.NoError(t, err)
+	_, err = cache.PostDerivation(ctx, drv)
+	require.NoError(t, err)
+
+	// The outputs of a cached derivation can't be replaced
+	poisoned := drv
+	poisoned.Outputs = []Output{{Path: "p2vbvabkdqckjlm43rf7bfccdseizych"}}
+	_, err = cache.PostDerivation(ctx, poisoned)
+	require.Error(t, err)
+	cached, _, err := cache.GetDerivation(ctx, filename)
+	require.NoError(t, err)
+	require.Equal(t, drv.Outputs, cached.Outputs)
+}
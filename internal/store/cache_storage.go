@@ -0,0 +1,310 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/maxmcd/bramble/internal/offline"
+	"github.com/maxmcd/bramble/pkg/s3"
+	"github.com/pkg/errors"
+)
+
+// CacheObjectKind is the type of object kept in CacheStorage. Each kind has its
+// own namespace.
+type CacheObjectKind string
+
+const (
+	// CacheChunk objects are output file bodies, split into chunks of at most
+	// 4MB and named by their hash.
+	CacheChunk CacheObjectKind = "chunk"
+	// CacheOutput objects are the TOC of a derivation output, named by the
+	// output hash.
+	CacheOutput CacheObjectKind = "output"
+	// CacheDerivation objects are derivation json, named by the derivation
+	// filename.
+	CacheDerivation CacheObjectKind = "derivation"
+)
+
+// CacheObjectKinds lists every kind of cache object.
+var CacheObjectKinds = []CacheObjectKind{CacheDerivation, CacheOutput, CacheChunk}
+
+// CacheObjectInfo describes an object in CacheStorage.
+type CacheObjectInfo struct {
+	Name string
+	Size int64
+	// LastAccess is the last time the object was written or, for storage that
+	// tracks reads, read.
+	LastAccess time.Time
+}
+
+// CacheStorage is where the build cache keeps its objects. Get returns an error
+// that satisfies os.IsNotExist when an object is missing. Delete does not
+// return an error if the object is already gone.
+type CacheStorage interface {
+	Get(ctx context.Context, kind CacheObjectKind, name string) (io.ReadCloser, error)
+	Put(ctx context.Context, kind CacheObjectKind, name string, body io.Reader) error
+	List(ctx context.Context, kind CacheObjectKind) ([]CacheObjectInfo, error)
+	Delete(ctx context.Context, kind CacheObjectKind, name string) error
+}
+
+// cacheStorageToucher is implemented by storage that can record when an object
+// is read.
+type cacheStorageToucher interface {
+	Touch(ctx context.Context, kind CacheObjectKind, name string) error
+}
+
+// getCacheObject reads an object and records the access if the storage
+// supports it. Reads that are part of the cache's own bookkeeping should call
+// storage.Get directly.
+func getCacheObject(ctx context.Context, storage CacheStorage, kind CacheObjectKind, name string) (io.ReadCloser, error) {
+	f, err := storage.Get(ctx, kind, name)
+	if err != nil {
+		return nil, err
+	}
+	if toucher, ok := storage.(cacheStorageToucher); ok {
+		_ = toucher.Touch(ctx, kind, name)
+	}
+	return f, nil
+}
+
+func validateCacheObjectName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return errors.Errorf("invalid cache object name %q", name)
+	}
+	return nil
+}
+
+// OpenCacheStorage returns the storage for a location. Locations are either
+// directory paths, "file://" urls or "s3://bucket/prefix" urls. S3 urls can
+// set the "endpoint" and "region" query parameters and read credentials from
+// the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment variables.
+func OpenCacheStorage(location string) (CacheStorage, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error parsing cache storage location %q", location)
+	}
+	switch u.Scheme {
+	case "":
+		return NewFileCacheStorage(location), nil
+	case "file":
+		return NewFileCacheStorage(u.Path), nil
+	case "s3":
+		if u.Host == "" {
+			return nil, errors.Errorf("s3 cache storage location %q must include a bucket", location)
+		}
+		client := s3.NewClient(
+			u.Query().Get("endpoint"),
+			u.Query().Get("region"),
+			u.Host,
+			os.Getenv("AWS_ACCESS_KEY_ID"),
+			os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		)
+		return NewS3CacheStorage(client, u.Path), nil
+	}
+	return nil, errors.Errorf("unsupported cache storage scheme %q", u.Scheme)
+}
+
+// NewFileCacheStorage stores cache objects in a directory with a subdirectory
+// for each kind of object. The modification time of objects is used as their
+// last access time.
+func NewFileCacheStorage(dir string) CacheStorage {
+	return fileCacheStorage{dir: dir}
+}
+
+type fileCacheStorage struct {
+	dir string
+}
+
+var _ CacheStorage = fileCacheStorage{}
+
+func (fs fileCacheStorage) path(kind CacheObjectKind, name string) (string, error) {
+	if err := validateCacheObjectName(name); err != nil {
+		return "", err
+	}
+	return filepath.Join(fs.dir, string(kind), name), nil
+}
+
+func (fs fileCacheStorage) Get(ctx context.Context, kind CacheObjectKind, name string) (io.ReadCloser, error) {
+	loc, err := fs.path(kind, name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(loc)
+}
+
+// Touch updates the modification time of the object.
+func (fs fileCacheStorage) Touch(ctx context.Context, kind CacheObjectKind, name string) error {
+	loc, err := fs.path(kind, name)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	return os.Chtimes(loc, now, now)
+}
+
+func (fs fileCacheStorage) Put(ctx context.Context, kind CacheObjectKind, name string, body io.Reader) (err error) {
+	loc, err := fs.path(kind, name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(loc), 0755); err != nil {
+		return err
+	}
+	// Write to a temporary file first so that readers never see a partially
+	// written object
+	f, err := os.CreateTemp(filepath.Dir(loc), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = os.Remove(f.Name())
+		}
+	}()
+	if _, err = io.Copy(f, body); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), loc)
+}
+
+func (fs fileCacheStorage) List(ctx context.Context, kind CacheObjectKind) (objects []CacheObjectInfo, err error) {
+	entries, err := os.ReadDir(filepath.Join(fs.dir, string(kind)))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		// Skip directories and files that are still being written
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".tmp-") {
+			continue
+		}
+		fi, err := entry.Info()
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, CacheObjectInfo{
+			Name:       entry.Name(),
+			Size:       fi.Size(),
+			LastAccess: fi.ModTime(),
+		})
+	}
+	return objects, nil
+}
+
+func (fs fileCacheStorage) Delete(ctx context.Context, kind CacheObjectKind, name string) error {
+	loc, err := fs.path(kind, name)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(loc); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// NewS3CacheStorage stores cache objects in an S3-compatible bucket. Object
+// keys are "{prefix}/{kind}/{name}". S3 doesn't track reads, so the last access
+// time of an object is the time it was last uploaded.
+func NewS3CacheStorage(client *s3.Client, prefix string) CacheStorage {
+	return s3CacheStorage{client: client, prefix: strings.Trim(prefix, "/")}
+}
+
+type s3CacheStorage struct {
+	client *s3.Client
+	prefix string
+}
+
+var _ CacheStorage = s3CacheStorage{}
+
+// online returns an error if the bucket can't be reached in offline mode
+func (ss s3CacheStorage) online() error {
+	return offline.Check("can't reach s3 cache storage")
+}
+
+func (ss s3CacheStorage) key(kind CacheObjectKind, name string) (string, error) {
+	if err := validateCacheObjectName(name); err != nil {
+		return "", err
+	}
+	return path.Join(ss.prefix, string(kind), name), nil
+}
+
+func (ss s3CacheStorage) Get(ctx context.Context, kind CacheObjectKind, name string) (io.ReadCloser, error) {
+	if err := ss.online(); err != nil {
+		return nil, err
+	}
+	key, err := ss.key(kind, name)
+	if err != nil {
+		return nil, err
+	}
+	return ss.client.GetObject(ctx, key)
+}
+
+func (ss s3CacheStorage) Put(ctx context.Context, kind CacheObjectKind, name string, body io.Reader) error {
+	if err := ss.online(); err != nil {
+		return err
+	}
+	key, err := ss.key(kind, name)
+	if err != nil {
+		return err
+	}
+	// Objects are at most one chunk in size, so it's fine to buffer them to
+	// sign the payload
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, body); err != nil {
+		return err
+	}
+	return ss.client.PutObject(ctx, key, buf.Bytes())
+}
+
+func (ss s3CacheStorage) List(ctx context.Context, kind CacheObjectKind) (objects []CacheObjectInfo, err error) {
+	if err := ss.online(); err != nil {
+		return nil, err
+	}
+	prefix := path.Join(ss.prefix, string(kind)) + "/"
+	list, err := ss.client.ListObjects(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	for _, object := range list {
+		name := strings.TrimPrefix(object.Key, prefix)
+		if validateCacheObjectName(name) != nil {
+			continue
+		}
+		objects = append(objects, CacheObjectInfo{
+			Name:       name,
+			Size:       object.Size,
+			LastAccess: object.LastModified,
+		})
+	}
+	return objects, nil
+}
+
+func (ss s3CacheStorage) Delete(ctx context.Context, kind CacheObjectKind, name string) error {
+	if err := ss.online(); err != nil {
+		return err
+	}
+	key, err := ss.key(kind, name)
+	if err != nil {
+		return err
+	}
+	if err := ss.client.DeleteObject(ctx, key); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -37,6 +37,10 @@ type Derivation struct {
 
 	Network bool `json:",omitempty"`
 
+	// OutputHash is the hash that the output of a fixed-output derivation
+	// must match
+	OutputHash string `json:",omitempty"`
+
 	// Outputs are build outputs, a derivation can have many outputs, the
 	// default output is called "out". Multiple outputs are useful when your
 	// build process can produce multiple artifacts, but building them as a
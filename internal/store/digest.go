@@ -0,0 +1,91 @@
+package store
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// digest is a published hash of a downloaded file
+type digest struct {
+	algorithm string
+	newHash   func() hash.Hash
+	sum       []byte
+}
+
+var digestAlgorithms = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"sha384": sha512.New384,
+	"sha512": sha512.New,
+}
+
+// fetchDigest returns the digest that a fetch_url download must match. It's
+// taken from a hex encoded "sha256" or a subresource integrity value like
+// "sha256-<base64>" in "integrity". found is false if neither is set.
+func fetchDigest(env map[string]string) (d digest, found bool, err error) {
+	sha, integrity := env["sha256"], env["integrity"]
+	switch {
+	case sha != "" && integrity != "":
+		return d, false, errors.New("fetch_url can't have both a sha256 and an integrity hash")
+	case sha != "":
+		d = digest{algorithm: "sha256", newHash: sha256.New}
+		if d.sum, err = hex.DecodeString(sha); err != nil || len(d.sum) != sha256.Size {
+			return d, false, errors.Errorf("sha256 %q must be a hex encoded sha256 hash", sha)
+		}
+		return d, true, nil
+	case integrity != "":
+		i := strings.Index(integrity, "-")
+		if i == -1 {
+			return d, false, errors.Errorf("integrity %q must be formatted like \"sha256-<base64 hash>\"", integrity)
+		}
+		d.algorithm = integrity[:i]
+		if d.newHash = digestAlgorithms[d.algorithm]; d.newHash == nil {
+			return d, false, errors.Errorf("integrity %q uses unsupported algorithm %q", integrity, d.algorithm)
+		}
+		if d.sum, err = base64.StdEncoding.DecodeString(integrity[i+1:]); err != nil || len(d.sum) != d.newHash().Size() {
+			return d, false, errors.Errorf("integrity %q doesn't contain a valid base64 encoded %s hash", integrity, d.algorithm)
+		}
+		return d, true, nil
+	}
+	return d, false, nil
+}
+
+// String returns the digest as a subresource integrity value
+func (d digest) String() string {
+	return d.algorithm + "-" + base64.StdEncoding.EncodeToString(d.sum)
+}
+
+// check confirms that the file at path matches the digest
+func (d digest) check(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+	h := d.newHash()
+	if _, err := io.Copy(h, f); err != nil {
+		return errors.WithStack(err)
+	}
+	if sum := h.Sum(nil); !bytes.Equal(sum, d.sum) {
+		return errors.Errorf("%s hash of download was %s but %s was expected",
+			d.algorithm, hex.EncodeToString(sum), hex.EncodeToString(d.sum))
+	}
+	return nil
+}
+
+// fetchURLs returns the urls of a fetch_url derivation in the order they should
+// be tried. "url" is first, followed by the space separated mirrors in "urls".
+func fetchURLs(env map[string]string) (urls []string) {
+	if url := env["url"]; url != "" {
+		urls = append(urls, url)
+	}
+	return append(urls, strings.Fields(env["urls"])...)
+}
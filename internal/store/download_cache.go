@@ -0,0 +1,109 @@
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+
+	"github.com/maxmcd/bramble/pkg/fileutil"
+	"github.com/pkg/errors"
+)
+
+// downloadDirEnvVar is set on fetch derivations to the directory that the url
+// is downloaded into. If the url is in the download cache the file is already
+// in the directory and the fetcher uses it instead of downloading it again.
+const downloadDirEnvVar = "bramble_download_dir"
+
+// downloadCache keeps downloaded files in var/downloads so that a url that is
+// fetched by more than one project is only downloaded once. Files are keyed by
+// their url and a hash they're expected to match, either a published digest or
+// the output hash that's recorded in the lockfile.
+type downloadCache struct {
+	dir string
+}
+
+func (s *Store) downloadCache() downloadCache {
+	return downloadCache{dir: s.joinBramblePath("var/downloads")}
+}
+
+func (dc downloadCache) path(url, hash string) string {
+	sum := sha256.Sum256([]byte(url + "\n" + hash))
+	return filepath.Join(dc.dir, hex.EncodeToString(sum[:]))
+}
+
+// lookup returns the cached download of url that matches one of the hashes
+func (dc downloadCache) lookup(url string, hashes []string) (path string, found bool) {
+	for _, hash := range hashes {
+		if path := dc.path(url, hash); fileutil.FileExists(path) {
+			return path, true
+		}
+	}
+	return "", false
+}
+
+// add copies the downloaded file at path into the cache under each of the
+// hashes
+func (dc downloadCache) add(url string, hashes []string, path string) (err error) {
+	if err := os.MkdirAll(dc.dir, 0755); err != nil {
+		return errors.WithStack(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for _, hash := range hashes {
+		if _, found := dc.lookup(url, []string{hash}); found {
+			continue
+		}
+		f, err := os.CreateTemp(dc.dir, "tmp-")
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		// The mode is part of the output hash so it must match the download
+		_ = f.Chmod(fi.Mode())
+		_ = f.Close()
+		// Copy to a temporary file first so that other builds never see a
+		// partially written file
+		if err := fileutil.CopyFile(path, f.Name()); err != nil {
+			_ = os.Remove(f.Name())
+			return err
+		}
+		if err := os.Rename(f.Name(), dc.path(url, hash)); err != nil {
+			_ = os.Remove(f.Name())
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+// downloadCacheKeys returns the url of a fetch derivation and the hashes that
+// its download is expected to match. url is empty if the derivation doesn't
+// download a single file.
+func (b *Builder) downloadCacheKeys(drv Derivation) (url string, hashes []string, err error) {
+	switch {
+	case drv.Builder == "basic_fetch_url", drv.Builder == "fetch_url":
+		urls := fetchURLs(drv.Env)
+		if len(urls) == 0 {
+			return "", nil, nil
+		}
+		url = urls[0]
+	default:
+		return "", nil, nil
+	}
+	dgst, found, err := fetchDigest(drv.Env)
+	if err != nil {
+		return "", nil, err
+	}
+	if found {
+		hashes = append(hashes, dgst.String())
+	}
+	if hash := drv.Env["hash"]; hash != "" {
+		hashes = append(hashes, hash)
+	} else if key, found := LockfileKey(drv); found {
+		if hash, found := b.lockfileWriter.LookupEntry(key); found {
+			hashes = append(hashes, hash)
+		}
+	}
+	return url, hashes, nil
+}
@@ -0,0 +1,118 @@
+package store
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/maxmcd/bramble/internal/offline"
+	"github.com/maxmcd/bramble/pkg/gitutil"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var commitHashRegexp = regexp.MustCompile("^[0-9a-f]{40}$")
+
+// fetchGitBuilder checks out the git repository at the url in the derivation's
+// environment into the output. The "reference" can be a commit hash, a tag or a
+// branch, HEAD is used if it's empty. Only the reference is fetched, without
+// history. If "submodules" is "true" submodules are checked out as well. The
+// .git directories are removed so that the output only depends on the content
+// of the checkout.
+func (b *Builder) fetchGitBuilder(ctx context.Context, drv Derivation, outputPaths map[string]string) (err error) {
+	var span trace.Span
+	ctx, span = tracer.Start(ctx, "store.fetchGitBuilder")
+	defer span.End()
+	if _, ok := outputPaths["out"]; len(outputPaths) > 1 || !ok {
+		return errors.New("the fetch_git builder can only have the default output \"out\"")
+	}
+	url, ok := drv.Env["url"]
+	if !ok {
+		return errors.New("fetch_git requires the environment variable 'url' to be set")
+	}
+	if err := offline.Check("can't clone %q", url); err != nil {
+		return err
+	}
+	reference := drv.Env["reference"]
+	if reference == "" {
+		reference = "HEAD"
+	}
+	if err := gitutil.CheckURLAndReference(url, reference); err != nil {
+		return errors.Wrap(err, "fetch_git")
+	}
+	out := outputPaths["out"]
+	git := func(args ...string) error {
+		// Repositories on the local filesystem are trusted, so their
+		// submodules can also use the file protocol
+		if strings.HasPrefix(url, "file://") {
+			args = append([]string{"-c", "protocol.file.allow=always"}, args...)
+		}
+		// Ignore the user's configuration so that the checkout is the same on
+		// every system
+		_, err := gitutil.Run(ctx, out, []string{"GIT_CONFIG_GLOBAL=/dev/null", "GIT_CONFIG_NOSYSTEM=1"}, args...)
+		return err
+	}
+
+	if err := git("init", "--quiet"); err != nil {
+		return err
+	}
+	// Relative submodule urls are relative to the origin
+	if err := git("remote", "add", "--end-of-options", "origin", url); err != nil {
+		return err
+	}
+	if err := git("fetch", "--quiet", "--depth", "1", "--end-of-options", "origin", reference); err != nil {
+		// Servers don't always allow fetching a commit that isn't the tip of
+		// a branch, fall back to fetching everything
+		if !commitHashRegexp.MatchString(reference) {
+			return err
+		}
+		if err := git("fetch", "--quiet", "--tags", "origin"); err != nil {
+			return err
+		}
+	} else {
+		reference = "FETCH_HEAD"
+	}
+	// checkout doesn't support --end-of-options, "--" marks the end of the
+	// revisions
+	if err := git("-c", "advice.detachedHead=false", "checkout", "--quiet", reference, "--"); err != nil {
+		return err
+	}
+	if drv.Env["submodules"] == "true" {
+		if err := git("submodule", "update", "--quiet", "--init", "--recursive", "--depth", "1"); err != nil {
+			// The pinned commit might not be the tip of a branch
+			if err := git("submodule", "update", "--quiet", "--init", "--recursive"); err != nil {
+				return err
+			}
+		}
+	}
+	return removeGitDirectories(out)
+}
+
+// removeGitDirectories removes the .git directories of a repository and its
+// submodules, submodules have a .git file instead of a directory
+func removeGitDirectories(dir string) error {
+	var gitDirs []string
+	if err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Name() == ".git" {
+			gitDirs = append(gitDirs, path)
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+		}
+		return nil
+	}); err != nil {
+		return errors.WithStack(err)
+	}
+	for _, path := range gitDirs {
+		if err := os.RemoveAll(path); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
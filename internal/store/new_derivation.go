@@ -22,6 +22,7 @@ type NewDerivationOptions struct {
 	Source       Source
 	Target       string
 	Network      bool
+	OutputHash   string
 }
 
 type SourceFiles struct {
@@ -112,6 +113,7 @@ func (s *Store) NewDerivation(options NewDerivationOptions) (exists bool, drv De
 	drv.Args = options.Args
 	drv.Builder = options.Builder
 	drv.Network = options.Network
+	drv.OutputHash = options.OutputHash
 	drv.Name = options.Name
 	drv.Env = options.Env
 	drv.Dependencies = options.Dependencies
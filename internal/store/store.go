@@ -46,6 +46,15 @@ type Store struct {
 	StorePath   string
 
 	derivationCache *derivationsMap
+
+	substituters []CacheSubstituter
+}
+
+// AddCacheSubstituter adds a cache that will be checked for build outputs
+// before a derivation is built. Caches are checked in the order they are
+// added.
+func (s *Store) AddCacheSubstituter(cs CacheSubstituter) {
+	s.substituters = append(s.substituters, cs)
 }
 
 func (s *Store) checkForBuiltDerivationOutputs(drv Derivation) (outputs []Output, built bool, err error) {
@@ -204,6 +213,9 @@ func ensureBramblePath(s *Store, bramblePath string) (err error) {
 
 		// Dependency metadata
 		"var/dependencies",
+
+		// Downloaded files, see downloadCache
+		"var/downloads",
 	}
 
 	for _, folder := range folders {
@@ -310,6 +322,20 @@ type CacheClient interface {
 	PostOutput(context.Context, OutputRequestBody) error
 }
 
+// CacheSubstituter looks up derivations that were built elsewhere so that their
+// outputs can be downloaded instead of built.
+type CacheSubstituter interface {
+	GetDerivation(context.Context, string) (Derivation, bool, error)
+	GetOutput(context.Context, string) ([]chunkedarchive.TOCEntry, bool, error)
+	GetChunk(context.Context, string, io.Writer) error
+}
+
+// Cache can both receive uploaded build outputs and substitute them.
+type Cache interface {
+	CacheClient
+	CacheSubstituter
+}
+
 func (s *Store) UploadDerivationsToCache(ctx context.Context, derivations []Derivation, cc CacheClient) (err error) {
 	var span trace.Span
 	ctx, span = tracer.Start(ctx, "store.UploadDerivationsToCache")
@@ -330,7 +356,7 @@ func (s *Store) UploadDerivationsToCache(ctx context.Context, derivations []Deri
 					return nil, err
 				}
 				out = append(out, hash)
-				fmt.Println("Finished uploading chunk", hash)
+				logger.Debug("Finished uploading chunk ", hash)
 				if _, err := buf.Peek(1); err != nil {
 					break
 				}
@@ -364,29 +390,31 @@ func (s *Store) UploadDerivationsToCache(ctx context.Context, derivations []Deri
 			uploaded[output.Path] = struct{}{}
 			wg.Add(1)
 			go func(output Output) {
+				defer wg.Done()
 				// Limit parallelism
 				sem <- struct{}{}
 				defer func() { <-sem }()
 				// This will upload using the spawned queue in parallel
 				toc, err := chunkedarchive.Archive(bodyWriter, s.joinStorePath(output.Path))
-				if err != nil {
-					errChan <- err
+				if err == nil {
+					err = cc.PostOutput(ctx, OutputRequestBody{
+						TOC:    toc,
+						Output: output,
+					})
 				}
-
-				if err := cc.PostOutput(ctx, OutputRequestBody{
-					TOC:    toc,
-					Output: output,
-				}); err != nil {
-					errChan <- err
+				if err != nil {
+					select {
+					case errChan <- err:
+					case <-ctx.Done():
+					}
 				}
-				wg.Done()
 			}(output)
 		}
 	}
 
 	go func() {
 		wg.Wait()
-		doneChan <- struct{}{}
+		close(doneChan)
 	}()
 	select {
 	case err := <-errChan:
@@ -0,0 +1,94 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+
+	"github.com/maxmcd/bramble/internal/logger"
+	"github.com/maxmcd/bramble/pkg/chunkedarchive"
+	"github.com/maxmcd/bramble/pkg/fileutil"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// substituteDerivation checks the store's caches for a built copy of the
+// derivation. If one is found its outputs are downloaded into the store and the
+// derivation is returned with its outputs populated. Cache errors are logged
+// and skipped so that a broken cache never prevents a build.
+func (s *Store) substituteDerivation(ctx context.Context, drv Derivation) (_ Derivation, found bool, err error) {
+	var span trace.Span
+	ctx, span = tracer.Start(ctx, "store.substituteDerivation")
+	defer span.End()
+
+	filename := drv.Filename()
+	for _, cache := range s.substituters {
+		cached, exists, err := cache.GetDerivation(ctx, filename)
+		if err != nil {
+			logger.Debug("error looking up derivation in cache ", filename, " ", err)
+			continue
+		}
+		if !exists || cached.missingOutput() || len(cached.Outputs) != len(drv.OutputNames) {
+			continue
+		}
+		if err := s.substituteOutputs(ctx, cache, cached.Outputs); err != nil {
+			logger.Debug("error substituting outputs for ", filename, " ", err)
+			continue
+		}
+		drv.Outputs = cached.Outputs
+		return drv, true, nil
+	}
+	return drv, false, nil
+}
+
+func (s *Store) substituteOutputs(ctx context.Context, cache CacheSubstituter, outputs []Output) (err error) {
+	for _, output := range outputs {
+		if fileutil.DirExists(s.joinStorePath(output.Path)) {
+			continue
+		}
+		toc, exists, err := cache.GetOutput(ctx, output.Path)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return errors.Errorf("output %s is missing from the cache", output.Path)
+		}
+		tempDir, err := s.storeLengthTempDir()
+		if err != nil {
+			return err
+		}
+		if err := s.unarchiveCachedOutput(ctx, cache, toc, tempDir, output.Path); err != nil {
+			_ = os.RemoveAll(tempDir)
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store) unarchiveCachedOutput(ctx context.Context, cache CacheSubstituter, toc []chunkedarchive.TOCEntry, tempDir, hash string) (err error) {
+	if err := chunkedarchive.Unarchive(toc, cacheHashFetcher{ctx: ctx, cache: cache}, tempDir); err != nil {
+		return errors.Wrap(err, "error downloading output from cache")
+	}
+	// Confirm the content we were sent matches the output hash before we put
+	// it in the store
+	if err := hashNormalizedBuildOutput(tempDir, hash); err != nil {
+		return err
+	}
+	return os.Rename(tempDir, s.joinStorePath(hash))
+}
+
+type cacheHashFetcher struct {
+	ctx   context.Context
+	cache CacheSubstituter
+}
+
+var _ chunkedarchive.HashFetcher = cacheHashFetcher{}
+
+func (hf cacheHashFetcher) Lookup(hash string) (io.ReadCloser, error) {
+	var buf bytes.Buffer
+	if err := hf.cache.GetChunk(hf.ctx, hash, &buf); err != nil {
+		return nil, errors.Wrapf(err, "error fetching chunk %s", hash)
+	}
+	return io.NopCloser(&buf), nil
+}
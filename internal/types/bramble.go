@@ -2,6 +2,7 @@ package types
 
 import (
 	"context"
+	"io"
 	"runtime"
 )
 
@@ -9,6 +10,9 @@ func Platform() string { return runtime.GOOS + "_" + runtime.GOARCH }
 
 type BuildOptions struct {
 	Check bool
+	// Output receives build progress and the output of every derivation that
+	// is built. Defaults to stdout.
+	Output io.Writer
 }
 
 type BuildResponse struct {
@@ -32,4 +36,6 @@ type Builder interface {
 
 type NewBuilder func(location string) (Builder, error)
 
-type DownloadGithubRepo func(url string, reference string) (location string, err error)
+// DownloadGitRepo checks out a repository into a new temporary directory, the
+// directory is removed once the repository has been published
+type DownloadGitRepo func(url string, reference string) (location string, err error)
@@ -5,6 +5,7 @@ import (
 	"bufio"
 	"bytes"
 	"compress/gzip"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -132,12 +133,21 @@ func (bw *tarBodyWriter) NewChunk(f io.ReadCloser) (func() ([]string, error), er
 	return func() ([]string, error) { return out, nil }, nil
 }
 
-// footerBytes the 47 byte footer.
+// footerBytes the 47 byte footer. The gzip stream is written by hand because
+// newer versions of compress/flate write a 44 byte empty stream, which doesn't
+// fit the footer. The bytes are the same as older versions wrote, so existing
+// archives can still be read.
 func footerBytes(tocOff int64) []byte {
 	buf := bytes.NewBuffer(make([]byte, 0, footerSize))
-	gz, _ := gzip.NewWriterLevel(buf, gzip.NoCompression)
-	gz.Header.Extra = []byte(fmt.Sprintf("%016xCHUNKA", tocOff))
-	gz.Close()
+	// Magic, deflate, FEXTRA flag, no mtime, no extra flags, unknown OS
+	buf.Write([]byte{0x1f, 0x8b, 8, 4, 0, 0, 0, 0, 0, 0xff})
+	extra := fmt.Sprintf("%016xCHUNKA", tocOff)
+	_ = binary.Write(buf, binary.LittleEndian, uint16(len(extra)))
+	buf.WriteString(extra)
+	// An empty, final, stored deflate block
+	buf.Write([]byte{1, 0, 0, 0xff, 0xff})
+	// CRC-32 and size of the empty content
+	buf.Write(make([]byte, 8))
 	if buf.Len() != footerSize {
 		panic(fmt.Sprintf("footer buffer = %d, not %d", buf.Len(), footerSize))
 	}
@@ -1,7 +1,10 @@
 package chunkedarchive
 
 import (
+	"bytes"
+	"compress/gzip"
 	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"os"
@@ -157,3 +160,45 @@ func fifo(name string) func(dir string) error {
 		return syscall.Mkfifo(j(dir, name), 0755)
 	}
 }
+
+func TestFooter(t *testing.T) {
+	footer := footerBytes(0x1234)
+	tocOff, ok := parseFooter(footer)
+	require.True(t, ok)
+	require.Equal(t, int64(0x1234), tocOff)
+
+	// The footer is a valid, empty, gzip stream
+	zr, err := gzip.NewReader(bytes.NewReader(footer))
+	require.NoError(t, err)
+	b, err := io.ReadAll(zr)
+	require.NoError(t, err)
+	require.Len(t, b, 0)
+}
+
+func TestFooter_format(t *testing.T) {
+	// The footer that archives have always had, it's what compress/gzip wrote
+	// for an empty stream with no compression before the size of that stream
+	// changed in newer Go versions
+	golden, err := hex.DecodeString("1f8b08040000000000ff1600" +
+		hex.EncodeToString([]byte("0000000000001234CHUNKA")) +
+		"010000ffff" + "0000000000000000")
+	require.NoError(t, err)
+	require.Equal(t, golden, footerBytes(0x1234))
+
+	// Archives are still a valid multistream gzip file with the footer as the
+	// last member
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "foo"), []byte("bramble"), 0644))
+	var archive bytes.Buffer
+	require.NoError(t, StreamArchive(&archive, dir))
+	zr, err := gzip.NewReader(bytes.NewReader(archive.Bytes()))
+	require.NoError(t, err)
+	_, err = io.Copy(io.Discard, zr)
+	require.NoError(t, err)
+
+	out := t.TempDir()
+	require.NoError(t, StreamUnarchive(io.NewSectionReader(bytes.NewReader(archive.Bytes()), 0, int64(archive.Len())), out))
+	b, err := os.ReadFile(filepath.Join(out, "foo"))
+	require.NoError(t, err)
+	require.Equal(t, "bramble", string(b))
+}
@@ -0,0 +1,242 @@
+// Package download fetches files over http. Failed requests are retried with
+// exponential backoff and interrupted downloads are resumed with range
+// requests.
+package download
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Progress is the state of a download
+type Progress struct {
+	URL string
+	// Downloaded is the number of bytes that have been downloaded
+	Downloaded int64
+	// Size is the size of the file, or -1 if it isn't known
+	Size int64
+	// Done is true once the download has finished
+	Done bool
+}
+
+// Options configure how File downloads a url
+type Options struct {
+	// Client is used to make requests, defaults to http.DefaultClient
+	Client *http.Client
+	// Attempts is the number of requests that are made before the download
+	// fails, defaults to 5
+	Attempts int
+	// Backoff is how long to wait before the first retry, it's doubled after
+	// every retry. Defaults to half a second.
+	Backoff time.Duration
+	// Progress is called every time data is written to the file
+	Progress func(Progress)
+}
+
+// StatusError is returned when a request returns an unexpected status code
+type StatusError struct {
+	URL        string
+	StatusCode int
+}
+
+func (err StatusError) Error() string {
+	return fmt.Sprintf("Unexpected http status code %d when fetching url %q", err.StatusCode, err.URL)
+}
+
+// retryable returns true for status codes that might succeed if the request is
+// made again
+func retryable(code int) bool {
+	return code == http.StatusRequestTimeout ||
+		code == http.StatusTooManyRequests ||
+		code >= 500
+}
+
+// File downloads url to a new file at path. Requests that fail with a network
+// error or a server error are retried. If a download is interrupted the next
+// request asks for the rest of the file with a range request, servers that
+// don't support ranges send the whole file again.
+func File(ctx context.Context, url, path string, opts Options) (err error) {
+	if opts.Client == nil {
+		opts.Client = http.DefaultClient
+	}
+	if opts.Attempts == 0 {
+		opts.Attempts = 5
+	}
+	if opts.Backoff == 0 {
+		opts.Backoff = 500 * time.Millisecond
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+	d := &download{url: url, file: f, progress: opts.Progress}
+	backoff := opts.Backoff
+	for attempt := 1; ; attempt++ {
+		retry, err := d.get(ctx, opts.Client)
+		if err == nil {
+			return errors.WithStack(f.Close())
+		}
+		if !retry || attempt >= opts.Attempts {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return errors.Wrapf(ctx.Err(), "error downloading %q", url)
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+type download struct {
+	url      string
+	file     *os.File
+	written  int64
+	size     int64
+	progress func(Progress)
+}
+
+// restart discards the data that has been downloaded
+func (d *download) restart() error {
+	d.written = 0
+	if err := d.file.Truncate(0); err != nil {
+		return errors.WithStack(err)
+	}
+	_, err := d.file.Seek(0, io.SeekStart)
+	return errors.WithStack(err)
+}
+
+// get makes a single request, continuing from the end of the data that has
+// already been downloaded. retry is true if the request failed and could
+// succeed if it was made again.
+func (d *download) get(ctx context.Context, client *http.Client) (retry bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.url, nil)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	if d.written > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", d.written))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return ctx.Err() == nil, errors.Wrapf(err, "error making request to download %q", d.url)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		start, size, ok := parseContentRange(resp.Header.Get("Content-Range"))
+		if !ok || start != d.written {
+			// The range can't be used, start from the beginning next time
+			if err := d.restart(); err != nil {
+				return false, err
+			}
+			return true, errors.Errorf("unexpected content range %q when fetching url %q",
+				resp.Header.Get("Content-Range"), d.url)
+		}
+		d.size = size
+	case http.StatusOK, http.StatusCreated:
+		// The server sent the whole file
+		if err := d.restart(); err != nil {
+			return false, err
+		}
+		d.size = resp.ContentLength
+	case http.StatusRequestedRangeNotSatisfiable:
+		if d.written > 0 {
+			if err := d.restart(); err != nil {
+				return false, err
+			}
+			return true, errors.Errorf("range not satisfiable when fetching url %q", d.url)
+		}
+		fallthrough
+	default:
+		return retryable(resp.StatusCode), StatusError{URL: d.url, StatusCode: resp.StatusCode}
+	}
+
+	if _, err := io.Copy(d, resp.Body); err != nil {
+		return ctx.Err() == nil, errors.Wrapf(err, "error downloading %q", d.url)
+	}
+	if d.size >= 0 && d.written != d.size {
+		return true, errors.Wrapf(io.ErrUnexpectedEOF, "error downloading %q, received %d of %d bytes",
+			d.url, d.written, d.size)
+	}
+	if d.progress != nil {
+		d.progress(Progress{URL: d.url, Downloaded: d.written, Size: d.written, Done: true})
+	}
+	return false, nil
+}
+
+func (d *download) Write(b []byte) (n int, err error) {
+	n, err = d.file.Write(b)
+	d.written += int64(n)
+	if d.progress != nil {
+		d.progress(Progress{URL: d.url, Downloaded: d.written, Size: d.size})
+	}
+	return n, err
+}
+
+// parseContentRange parses a Content-Range header like "bytes 100-199/200".
+// size is -1 if the size of the file isn't known.
+func parseContentRange(header string) (start, size int64, ok bool) {
+	header = strings.TrimPrefix(header, "bytes ")
+	i, j := strings.Index(header, "-"), strings.Index(header, "/")
+	if i == -1 || j < i {
+		return 0, 0, false
+	}
+	start, err := strconv.ParseInt(header[:i], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	if header[j+1:] == "*" {
+		return start, -1, true
+	}
+	size, err = strconv.ParseInt(header[j+1:], 10, 64)
+	return start, size, err == nil
+}
+
+// PrintProgress returns a Progress callback that writes the progress of a
+// download to w at most once per interval, and once more when it's done.
+func PrintProgress(w io.Writer, name string, interval time.Duration) func(Progress) {
+	var lock sync.Mutex
+	var last time.Time
+	return func(p Progress) {
+		lock.Lock()
+		defer lock.Unlock()
+		if !p.Done && time.Since(last) < interval {
+			return
+		}
+		last = time.Now()
+		switch {
+		case p.Done:
+			fmt.Fprintf(w, "↓ %s - %s\n", name, formatBytes(p.Downloaded))
+		case p.Size > 0:
+			fmt.Fprintf(w, "↓ %s - %s / %s (%d%%)\n", name, formatBytes(p.Downloaded),
+				formatBytes(p.Size), p.Downloaded*100/p.Size)
+		default:
+			fmt.Fprintf(w, "↓ %s - %s\n", name, formatBytes(p.Downloaded))
+		}
+	}
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
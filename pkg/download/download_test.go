@@ -0,0 +1,128 @@
+package download
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var body = bytes.Repeat([]byte("bramble"), 10000)
+
+// dropConnection sends half of data and then closes the connection
+func dropConnection(rw http.ResponseWriter, data []byte, status int) {
+	rw.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	rw.WriteHeader(status)
+	_, _ = rw.Write(data[:len(data)/2])
+	rw.(http.Flusher).Flush()
+	panic(http.ErrAbortHandler)
+}
+
+func TestFile(t *testing.T) {
+	for _, tt := range []struct {
+		name        string
+		handler     func(request int, rw http.ResponseWriter, r *http.Request)
+		requests    int32
+		errContains string
+	}{
+		{
+			name: "resume after dropped connections",
+			handler: func(request int, rw http.ResponseWriter, r *http.Request) {
+				if request < 3 {
+					// Each request drops halfway through what's left
+					var start int
+					if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-", &start); err == nil {
+						rw.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(body)-1, len(body)))
+						dropConnection(rw, body[start:], http.StatusPartialContent)
+					}
+					dropConnection(rw, body, http.StatusOK)
+				}
+				http.ServeContent(rw, r, "", time.Time{}, bytes.NewReader(body))
+			},
+			requests: 3,
+		},
+		{
+			name: "restart without range support",
+			handler: func(request int, rw http.ResponseWriter, r *http.Request) {
+				if request == 1 {
+					dropConnection(rw, body, http.StatusOK)
+				}
+				_, _ = rw.Write(body)
+			},
+			requests: 2,
+		},
+		{
+			name: "retry server errors",
+			handler: func(request int, rw http.ResponseWriter, r *http.Request) {
+				if request < 3 {
+					rw.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+				_, _ = rw.Write(body)
+			},
+			requests: 3,
+		},
+		{
+			name: "give up",
+			handler: func(request int, rw http.ResponseWriter, r *http.Request) {
+				rw.WriteHeader(http.StatusBadGateway)
+			},
+			requests:    4,
+			errContains: "status code 502",
+		},
+		{
+			name: "don't retry not found",
+			handler: func(request int, rw http.ResponseWriter, r *http.Request) {
+				rw.WriteHeader(http.StatusNotFound)
+			},
+			requests:    1,
+			errContains: "status code 404",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests int32
+			server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				tt.handler(int(atomic.AddInt32(&requests, 1)), rw, r)
+			}))
+			defer server.Close()
+
+			var last Progress
+			path := filepath.Join(t.TempDir(), "file")
+			err := File(context.Background(), server.URL, path, Options{
+				Attempts: 4,
+				Backoff:  time.Millisecond,
+				Progress: func(p Progress) { last = p },
+			})
+			assert.Equal(t, tt.requests, atomic.LoadInt32(&requests))
+			if tt.errContains != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.errContains)
+				return
+			}
+			require.NoError(t, err)
+			b, err := os.ReadFile(path)
+			require.NoError(t, err)
+			assert.Equal(t, body, b)
+			assert.Equal(t, Progress{URL: server.URL, Downloaded: int64(len(body)), Size: int64(len(body)), Done: true}, last)
+		})
+	}
+}
+
+func TestPrintProgress(t *testing.T) {
+	var buf bytes.Buffer
+	progress := PrintProgress(&buf, "go.tar.gz", time.Hour)
+	progress(Progress{Downloaded: 1024, Size: 4096})
+	progress(Progress{Downloaded: 2048, Size: 4096})
+	progress(Progress{Downloaded: 4096, Size: 4096, Done: true})
+	assert.Equal(t, "↓ go.tar.gz - 1.0 KiB / 4.0 KiB (25%)\n↓ go.tar.gz - 4.0 KiB\n", buf.String())
+}
@@ -0,0 +1,37 @@
+// Package gitutil runs git commands for the builders and the dependency
+// server.
+package gitutil
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Run runs git with args in dir and returns what it wrote to stdout. env is
+// added to the environment of the command. Git never prompts for credentials.
+func Run(ctx context.Context, dir string, env []string, args ...string) (stdout string, err error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(append(os.Environ(), "GIT_TERMINAL_PROMPT=0"), env...)
+	var out, buf bytes.Buffer
+	cmd.Stdout, cmd.Stderr = io.MultiWriter(&out, &buf), &buf
+	if err := cmd.Run(); err != nil {
+		return "", errors.Wrapf(err, "git %s: %s", strings.Join(args, " "), buf.String())
+	}
+	return strings.TrimSpace(out.String()), nil
+}
+
+// CheckURLAndReference returns an error if the url or the reference start
+// with a dash, git would read them as options.
+func CheckURLAndReference(url, reference string) error {
+	if strings.HasPrefix(url, "-") || strings.HasPrefix(reference, "-") {
+		return errors.Errorf("git url %q and reference %q can't start with \"-\"", url, reference)
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+package gitutil
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckURLAndReference(t *testing.T) {
+	require.NoError(t, CheckURLAndReference("https://github.com/maxmcd/bramble", "main"))
+	require.NoError(t, CheckURLAndReference("https://github.com/maxmcd/bramble", ""))
+	require.Error(t, CheckURLAndReference("--upload-pack=touch /tmp/pwned", ""))
+	require.Error(t, CheckURLAndReference("https://github.com/maxmcd/bramble", "--orphan=pwned"))
+}
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	_, err := Run(context.Background(), dir, nil, "init", "--quiet")
+	require.NoError(t, err)
+	gitDir, err := Run(context.Background(), dir, []string{"GIT_CONFIG_GLOBAL=/dev/null"}, "rev-parse", "--git-dir")
+	require.NoError(t, err)
+	require.Equal(t, ".git", gitDir)
+
+	_, err = Run(context.Background(), dir, nil, "rev-parse", "HEAD")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "git rev-parse HEAD")
+}
@@ -7,11 +7,21 @@ import (
 	"io"
 	"net/http"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
+	"github.com/maxmcd/bramble/pkg/metrics"
 	"github.com/pkg/errors"
 )
 
+var requestDuration = metrics.NewHistogram(
+	"bramble_http_request_duration_seconds",
+	"Latency of requests handled by a Router.",
+	metrics.DefaultBuckets,
+	"method", "route", "code",
+)
+
 type Context struct {
 	ResponseWriter http.ResponseWriter
 	Request        *http.Request
@@ -37,12 +47,52 @@ type IM map[interface{}]interface{}
 
 func (err ErrHTTPResponse) Error() string { return err.err.Error() }
 func ErrNotFound(err error) error         { return ErrHTTPResponse{err: err, code: http.StatusNotFound} }
+func ErrUnauthorized(err error) error {
+	return ErrHTTPResponse{err: err, code: http.StatusUnauthorized}
+}
+func ErrConflict(err error) error { return ErrHTTPResponse{err: err, code: http.StatusConflict} }
 func ErrUnprocessableEntity(err error) error {
 	return ErrHTTPResponse{err: err, code: http.StatusUnprocessableEntity}
 }
 
-func (r Router) h(handler func(c Context) (err error)) func(http.ResponseWriter, *http.Request, httprouter.Params) {
-	return func(rw http.ResponseWriter, req *http.Request, p httprouter.Params) {
+// statusRecorder records the status code written to a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (sr *statusRecorder) WriteHeader(code int) {
+	if sr.code == 0 {
+		sr.code = code
+	}
+	sr.ResponseWriter.WriteHeader(code)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	if sr.code == 0 {
+		sr.code = http.StatusOK
+	}
+	return sr.ResponseWriter.Write(b)
+}
+
+func (sr *statusRecorder) Flush() {
+	if f, ok := sr.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r Router) h(method, path string, handler func(c Context) (err error)) func(http.ResponseWriter, *http.Request, httprouter.Params) {
+	return func(w http.ResponseWriter, req *http.Request, p httprouter.Params) {
+		start := time.Now()
+		rw := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			code := rw.code
+			if code == 0 {
+				code = http.StatusOK
+			}
+			requestDuration.With(method, path, strconv.Itoa(code)).
+				Observe(time.Since(start).Seconds())
+		}()
 		err := handler(Context{ResponseWriter: rw, Request: req, Params: p})
 		if err != nil {
 			code := http.StatusInternalServerError
@@ -63,9 +113,15 @@ func (r Router) ErrHandler(handle func(http.ResponseWriter, string, int)) {
 	// Support multiple at different path prefixes?
 }
 
-func (r Router) GET(path string, handle func(Context) error)  { r.Router.GET(path, r.h(handle)) }
-func (r Router) POST(path string, handle func(Context) error) { r.Router.POST(path, r.h(handle)) }
-func (r Router) HEAD(path string, handle func(Context) error) { r.Router.HEAD(path, r.h(handle)) }
+func (r Router) GET(path string, handle func(Context) error) {
+	r.Router.GET(path, r.h(http.MethodGet, path, handle))
+}
+func (r Router) POST(path string, handle func(Context) error) {
+	r.Router.POST(path, r.h(http.MethodPost, path, handle))
+}
+func (r Router) HEAD(path string, handle func(Context) error) {
+	r.Router.HEAD(path, r.h(http.MethodHead, path, handle))
+}
 
 func New() Router {
 	return Router{
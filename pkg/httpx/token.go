@@ -0,0 +1,59 @@
+package httpx
+
+import (
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// CheckToken returns an unauthorized error unless the request has an
+// "Authorization: Bearer <token>" header with the token. Every request is
+// unauthorized if the token is empty.
+func CheckToken(req *http.Request, token string) error {
+	if token == "" {
+		return ErrUnauthorized(errors.New("this server doesn't have a token configured"))
+	}
+	sent := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(sent), []byte(token)) != 1 {
+		return ErrUnauthorized(errors.New("a valid token is required"))
+	}
+	return nil
+}
+
+// TokenTransport sends the token as a bearer token with POST requests, the
+// requests that upload. The token is only sent over https or to a loopback
+// address.
+func TokenTransport(token string, next http.RoundTripper) http.RoundTripper {
+	if token == "" {
+		return next
+	}
+	return tokenTransport{token: token, next: next}
+}
+
+type tokenTransport struct {
+	token string
+	next  http.RoundTripper
+}
+
+func (tt tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodPost {
+		return tt.next.RoundTrip(req)
+	}
+	if req.URL.Scheme != "https" && !isLoopback(req.URL.Hostname()) {
+		return nil, errors.Errorf("refusing to send the token to %s over %s", req.URL.Host, req.URL.Scheme)
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+tt.token)
+	return tt.next.RoundTrip(req)
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
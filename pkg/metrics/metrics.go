@@ -0,0 +1,280 @@
+// Package metrics is a small registry of counters, gauges and histograms that
+// are served in the Prometheus text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultRegistry is the registry that package level metrics are added to and
+// that Handler serves.
+var DefaultRegistry = NewRegistry()
+
+// DefaultBuckets are histogram buckets suited to request latency in seconds.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+// Registry holds metrics and writes them out.
+type Registry struct {
+	lock    sync.Mutex
+	metrics []*metric
+}
+
+// NewRegistry returns an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// Handler serves the metrics in DefaultRegistry.
+func Handler() http.Handler { return DefaultRegistry }
+
+func (r *Registry) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_ = r.Write(rw)
+}
+
+// Write writes every metric in the text exposition format.
+func (r *Registry) Write(w io.Writer) error {
+	r.lock.Lock()
+	metrics := append([]*metric{}, r.metrics...)
+	r.lock.Unlock()
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i].name < metrics[j].name })
+
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	return bw.Flush()
+}
+
+func (r *Registry) add(m *metric) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, existing := range r.metrics {
+		if existing.name == m.name {
+			panic(fmt.Sprintf("metric %q is already registered", m.name))
+		}
+	}
+	r.metrics = append(r.metrics, m)
+}
+
+func (r *Registry) newMetric(name, help, kind string, labels []string) *metric {
+	m := &metric{name: name, help: help, kind: kind, labels: labels, series: map[string]*series{}}
+	r.add(m)
+	return m
+}
+
+// NewCounter adds a counter with the label names to the registry.
+func (r *Registry) NewCounter(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{m: r.newMetric(name, help, "counter", labels)}
+}
+
+// NewGauge adds a gauge with the label names to the registry.
+func (r *Registry) NewGauge(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{m: r.newMetric(name, help, "gauge", labels)}
+}
+
+// NewHistogram adds a histogram with the label names to the registry. Buckets
+// are the upper bounds of each bucket in increasing order.
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	m := r.newMetric(name, help, "histogram", labels)
+	m.buckets = buckets
+	return &HistogramVec{m: m}
+}
+
+// NewCounter adds a counter to DefaultRegistry.
+func NewCounter(name, help string, labels ...string) *CounterVec {
+	return DefaultRegistry.NewCounter(name, help, labels...)
+}
+
+// NewGauge adds a gauge to DefaultRegistry.
+func NewGauge(name, help string, labels ...string) *GaugeVec {
+	return DefaultRegistry.NewGauge(name, help, labels...)
+}
+
+// NewHistogram adds a histogram to DefaultRegistry.
+func NewHistogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	return DefaultRegistry.NewHistogram(name, help, buckets, labels...)
+}
+
+type metric struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+
+	lock   sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	labelValues []string
+	value       float64
+
+	// Histogram values, counts are per bucket and not cumulative
+	counts []uint64
+	count  uint64
+}
+
+func (m *metric) with(labelValues []string) *series {
+	if len(labelValues) != len(m.labels) {
+		panic(fmt.Sprintf("metric %q has %d labels, got %d values",
+			m.name, len(m.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	s, ok := m.series[key]
+	if !ok {
+		s = &series{labelValues: append([]string{}, labelValues...)}
+		if m.buckets != nil {
+			s.counts = make([]uint64, len(m.buckets))
+		}
+		m.series[key] = s
+	}
+	return s
+}
+
+func (m *metric) update(s *series, fn func(s *series)) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	fn(s)
+}
+
+func (m *metric) write(w io.Writer) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n", m.name, escapeHelp(m.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.kind)
+	keys := make([]string, 0, len(m.series))
+	for k := range m.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := m.series[k]
+		if m.kind != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", m.name, m.labelString(s, ""), formatFloat(s.value))
+			continue
+		}
+		var cumulative uint64
+		for i, upper := range m.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, m.labelString(s, formatFloat(upper)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, m.labelString(s, "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, m.labelString(s, ""), formatFloat(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", m.name, m.labelString(s, ""), s.count)
+	}
+}
+
+func (m *metric) labelString(s *series, le string) string {
+	pairs := []string{}
+	for i, name := range m.labels {
+		pairs = append(pairs, name+`="`+labelValueReplacer.Replace(s.labelValues[i])+`"`)
+	}
+	if le != "" {
+		pairs = append(pairs, `le="`+le+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeHelp(help string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// CounterVec is a counter partitioned by label values.
+type CounterVec struct{ m *metric }
+
+// With returns the counter for the label values.
+func (cv *CounterVec) With(labelValues ...string) Counter {
+	return Counter{m: cv.m, s: cv.m.with(labelValues)}
+}
+
+// Counter is a value that only increases.
+type Counter struct {
+	m *metric
+	s *series
+}
+
+// Inc adds one to the counter.
+func (c Counter) Inc() { c.Add(1) }
+
+// Add adds v to the counter, v must not be negative.
+func (c Counter) Add(v float64) {
+	if v < 0 {
+		panic("counters can't decrease")
+	}
+	c.m.update(c.s, func(s *series) { s.value += v })
+}
+
+// GaugeVec is a gauge partitioned by label values.
+type GaugeVec struct{ m *metric }
+
+// With returns the gauge for the label values.
+func (gv *GaugeVec) With(labelValues ...string) Gauge {
+	return Gauge{m: gv.m, s: gv.m.with(labelValues)}
+}
+
+// Gauge is a value that can go up and down.
+type Gauge struct {
+	m *metric
+	s *series
+}
+
+// Set sets the value of the gauge.
+func (g Gauge) Set(v float64) { g.m.update(g.s, func(s *series) { s.value = v }) }
+
+// Add adds v to the gauge.
+func (g Gauge) Add(v float64) { g.m.update(g.s, func(s *series) { s.value += v }) }
+
+// HistogramVec is a histogram partitioned by label values.
+type HistogramVec struct{ m *metric }
+
+// With returns the histogram for the label values.
+func (hv *HistogramVec) With(labelValues ...string) Histogram {
+	return Histogram{m: hv.m, s: hv.m.with(labelValues)}
+}
+
+// Histogram counts observations in buckets.
+type Histogram struct {
+	m *metric
+	s *series
+}
+
+// Observe adds an observation to the histogram.
+func (h Histogram) Observe(v float64) {
+	h.m.update(h.s, func(s *series) {
+		s.count++
+		s.value += v
+		for i, upper := range h.m.buckets {
+			if v <= upper {
+				s.counts[i]++
+				break
+			}
+		}
+	})
+}
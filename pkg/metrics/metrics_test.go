@@ -0,0 +1,50 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	requests := r.NewCounter("requests_total", "Requests served.", "route")
+	running := r.NewGauge("running", "Running jobs.")
+	latency := r.NewHistogram("latency_seconds", "Latency.", []float64{0.1, 1})
+
+	requests.With("/a").Inc()
+	requests.With("/a").Add(2)
+	requests.With(`/"b"`).Inc()
+	running.With().Add(2)
+	running.With().Add(-1)
+	latency.With().Observe(0.05)
+	latency.With().Observe(0.5)
+	latency.With().Observe(5)
+
+	var buf bytes.Buffer
+	require.NoError(t, r.Write(&buf))
+	require.Equal(t, `# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 1
+latency_seconds_bucket{le="1"} 2
+latency_seconds_bucket{le="+Inf"} 3
+latency_seconds_sum 5.55
+latency_seconds_count 3
+# HELP requests_total Requests served.
+# TYPE requests_total counter
+requests_total{route="/\"b\""} 1
+requests_total{route="/a"} 3
+# HELP running Running jobs.
+# TYPE running gauge
+running 1
+`, buf.String())
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	require.Equal(t, buf.String(), rec.Body.String())
+
+	require.Panics(t, func() { r.NewGauge("running", "") })
+	require.Panics(t, func() { requests.With() })
+}
@@ -0,0 +1,127 @@
+// Package s3test provides an in-memory stand-in for an S3-compatible server so
+// that code using pkg/s3 can be tested without network access.
+package s3test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server stores objects in memory. Requests must be signed with AccessKeyID
+// and carry a payload hash that matches their body.
+type Server struct {
+	*httptest.Server
+	AccessKeyID string
+
+	lock     sync.Mutex
+	objects  map[string][]byte
+	modified map[string]time.Time
+}
+
+// NewServer starts a server, callers should call Close when done.
+func NewServer(accessKeyID string) *Server {
+	s := &Server{
+		AccessKeyID: accessKeyID,
+		objects:     map[string][]byte{},
+		modified:    map[string]time.Time{},
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// Objects returns a copy of the stored objects keyed by "bucket/key".
+func (s *Server) Objects() map[string][]byte {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	out := make(map[string][]byte, len(s.objects))
+	for k, v := range s.objects {
+		out[k] = v
+	}
+	return out
+}
+
+func (s *Server) handle(rw http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"),
+		"AWS4-HMAC-SHA256 Credential="+s.AccessKeyID+"/") {
+		http.Error(rw, "AccessDenied", http.StatusForbidden)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sum := sha256.Sum256(body)
+	if r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(sum[:]) {
+		http.Error(rw, "XAmzContentSHA256Mismatch", http.StatusBadRequest)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/")
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	switch r.Method {
+	case http.MethodGet:
+		if r.URL.Query().Get("list-type") == "2" {
+			s.list(rw, strings.TrimSuffix(key, "/"), r.URL.Query().Get("prefix"))
+			return
+		}
+		object, ok := s.objects[key]
+		if !ok {
+			http.Error(rw, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		_, _ = rw.Write(object)
+	case http.MethodPut:
+		s.objects[key] = body
+		s.modified[key] = time.Now()
+	case http.MethodDelete:
+		if _, ok := s.objects[key]; !ok {
+			http.Error(rw, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		delete(s.objects, key)
+		delete(s.modified, key)
+		rw.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(rw, "MethodNotAllowed", http.StatusMethodNotAllowed)
+	}
+}
+
+type listObject struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+}
+
+// list writes every object in the bucket with the prefix. Results are never
+// paginated.
+func (s *Server) list(rw http.ResponseWriter, bucket, prefix string) {
+	result := struct {
+		XMLName  xml.Name `xml:"ListBucketResult"`
+		Contents []listObject
+	}{}
+	for key, object := range s.objects {
+		name := strings.TrimPrefix(key, bucket+"/")
+		if name == key || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		result.Contents = append(result.Contents, listObject{
+			Key:          name,
+			Size:         int64(len(object)),
+			LastModified: s.modified[key],
+		})
+	}
+	sort.Slice(result.Contents, func(i, j int) bool {
+		return result.Contents[i].Key < result.Contents[j].Key
+	})
+	_ = xml.NewEncoder(rw).Encode(result)
+}